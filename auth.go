@@ -0,0 +1,43 @@
+package grpc
+
+import (
+	"context"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Authenticator authenticates the calls before they are sent to the workers. The returned context is passed to the
+// next interceptors and the proxy, values stored in it may be forwarded to the worker with RegisterContextValue.
+// The call fails with the returned error: a status error is sent as is (e.g. PermissionDenied), any other error
+// with the Unauthenticated status. The method is available via grpc.Method(ctx).
+type Authenticator interface {
+	Authenticate(ctx context.Context) (context.Context, error)
+}
+
+// RegisterAuthenticator adds the authenticator of the calls, the authenticators are called in the registration order
+// and all of them should succeed. Authenticators should be registered before the plugin starts serving.
+func (p *Plugin) RegisterAuthenticator(auth Authenticator) {
+	p.authenticators = append(p.authenticators, auth)
+}
+
+// authInterceptor calls the registered authenticators
+func (p *Plugin) authInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	for i := 0; i < len(p.authenticators); i++ {
+		authCtx, err := p.authenticators[i].Authenticate(ctx)
+		if err != nil {
+			if _, ok := status.FromError(err); ok {
+				return nil, err
+			}
+
+			return nil, status.Error(codes.Unauthenticated, err.Error())
+		}
+
+		if authCtx != nil {
+			ctx = authCtx
+		}
+	}
+
+	return handler(ctx, req)
+}
@@ -0,0 +1,178 @@
+package grpc
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+type breakerState int
+
+const (
+	breakerClosed breakerState = iota
+	breakerHalfOpen
+	breakerOpen
+)
+
+func (s breakerState) String() string {
+	switch s {
+	case breakerClosed:
+		return "closed"
+	case breakerHalfOpen:
+		return "half-open"
+	case breakerOpen:
+		return "open"
+	default:
+		return "unknown"
+	}
+}
+
+// circuitBreaker fast-fails the calls while the workers are failing en masse (e.g. the database is down) instead of
+// sending every call to the failing workers. The breaker opens when the failures rate within the window exceeds the
+// limit, the calls are rejected during the cooldown, then a few probe calls are allowed (half-open): the breaker is
+// closed when all of them succeed and opened again otherwise.
+type circuitBreaker struct {
+	mu    sync.Mutex
+	cfg   *CircuitBreaker
+	state breakerState
+
+	windowStart time.Time
+	calls       int
+	failures    int
+	openedAt    time.Time
+	probes      int
+
+	stateGauge prometheus.Gauge
+	log        *zap.Logger
+	// called in the background when the breaker is opened
+	onOpen func()
+}
+
+func newCircuitBreaker(cfg *CircuitBreaker, stateGauge prometheus.Gauge, log *zap.Logger) *circuitBreaker {
+	return &circuitBreaker{
+		cfg:         cfg,
+		windowStart: time.Now(),
+		stateGauge:  stateGauge,
+		log:         log,
+	}
+}
+
+// Allow reports whether the call may be sent to the worker
+func (b *circuitBreaker) Allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cfg.Cooldown {
+			return false
+		}
+
+		b.setState(breakerHalfOpen)
+		b.probes = 1
+		return true
+	case breakerHalfOpen:
+		if b.probes >= b.cfg.HalfOpenCalls {
+			return false
+		}
+
+		b.probes++
+		return true
+	default:
+		return true
+	}
+}
+
+// Done records the result of the allowed call. The calls ended by the client (canceled or the deadline of the call
+// exceeded) say nothing about the workers and are not counted, the probe slot is released.
+func (b *circuitBreaker) Done(ctx context.Context, err error) {
+	ended := ctx.Err() != nil
+	failed := !ended && isWorkerFailure(err)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerHalfOpen:
+		if failed {
+			b.open()
+			return
+		}
+
+		b.probes--
+		if ended {
+			return
+		}
+
+		b.calls++
+		// all probes succeeded
+		if b.calls >= b.cfg.HalfOpenCalls {
+			b.setState(breakerClosed)
+			b.resetWindow(time.Now())
+		}
+	case breakerClosed:
+		if ended {
+			return
+		}
+
+		now := time.Now()
+		if now.Sub(b.windowStart) > b.cfg.Window {
+			b.resetWindow(now)
+		}
+
+		b.calls++
+		if failed {
+			b.failures++
+		}
+
+		if b.calls >= b.cfg.MinCalls && float64(b.failures)/float64(b.calls) >= b.cfg.FailureRate {
+			b.open()
+		}
+	case breakerOpen:
+		// the calls allowed before the breaker was opened
+	}
+}
+
+func (b *circuitBreaker) open() {
+	b.log.Warn("circuit breaker was opened, calls are rejected during the cooldown", zap.Int("calls", b.calls), zap.Int("failures", b.failures), zap.Duration("cooldown", b.cfg.Cooldown))
+	b.setState(breakerOpen)
+	b.openedAt = time.Now()
+	b.resetWindow(b.openedAt)
+
+	if b.onOpen != nil {
+		go b.onOpen()
+	}
+}
+
+func (b *circuitBreaker) resetWindow(now time.Time) {
+	b.windowStart = now
+	b.calls = 0
+	b.failures = 0
+}
+
+func (b *circuitBreaker) setState(state breakerState) {
+	if b.state == state {
+		return
+	}
+
+	b.log.Info("circuit breaker state was changed", zap.Stringer("from", b.state), zap.Stringer("to", state))
+	b.state = state
+	b.stateGauge.Set(float64(state))
+}
+
+// isWorkerFailure reports whether the error means the workers are failing, the application errors returned by
+// the workers on purpose (e.g. NotFound) are not the failures. DeadlineExceeded is returned by the workers here
+// (e.g. the upstream timeouts), the calls ended by their own deadline are skipped by Done.
+func isWorkerFailure(err error) bool {
+	switch status.Code(err) { //nolint:exhaustive
+	case codes.Internal, codes.Unknown, codes.Unavailable, codes.DeadlineExceeded, codes.DataLoss:
+		return true
+	default:
+		return false
+	}
+}
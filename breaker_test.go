@@ -0,0 +1,124 @@
+package grpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func testBreaker() *circuitBreaker {
+	return newCircuitBreaker(&CircuitBreaker{
+		FailureRate:   0.5,
+		MinCalls:      4,
+		Window:        time.Minute,
+		Cooldown:      50 * time.Millisecond,
+		HalfOpenCalls: 2,
+	}, prometheus.NewGauge(prometheus.GaugeOpts{Name: "breaker_state"}), zap.NewNop())
+}
+
+func TestCircuitBreakerTransitions(t *testing.T) {
+	ctx := context.Background()
+	failure := status.Error(codes.Unavailable, "worker crashed")
+	b := testBreaker()
+
+	// closed: below the min calls and then below the failure rate
+	for _, err := range []error{failure, failure, nil} {
+		require.True(t, b.Allow())
+		b.Done(ctx, err)
+	}
+	require.Equal(t, breakerClosed, b.state)
+
+	// 3 of 4 calls failed
+	require.True(t, b.Allow())
+	b.Done(ctx, failure)
+	require.Equal(t, breakerOpen, b.state)
+	require.Equal(t, float64(breakerOpen), testutil.ToFloat64(b.stateGauge))
+
+	// open: rejected during the cooldown
+	require.False(t, b.Allow())
+
+	// half-open: only the probe calls are allowed, a failed probe opens the breaker again
+	time.Sleep(60 * time.Millisecond)
+	require.True(t, b.Allow())
+	require.Equal(t, breakerHalfOpen, b.state)
+	require.True(t, b.Allow())
+	require.False(t, b.Allow())
+	b.Done(ctx, nil)
+	b.Done(ctx, failure)
+	require.Equal(t, breakerOpen, b.state)
+	require.False(t, b.Allow())
+
+	// closed after all probes succeeded
+	time.Sleep(60 * time.Millisecond)
+	require.True(t, b.Allow())
+	require.True(t, b.Allow())
+	b.Done(ctx, nil)
+	require.Equal(t, breakerHalfOpen, b.state)
+	b.Done(ctx, nil)
+	require.Equal(t, breakerClosed, b.state)
+	require.Equal(t, float64(breakerClosed), testutil.ToFloat64(b.stateGauge))
+	require.Equal(t, 0, b.calls)
+	require.True(t, b.Allow())
+}
+
+func TestCircuitBreakerClientEnded(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	expired, cancelExpired := context.WithDeadline(context.Background(), time.Now().Add(-time.Second))
+	defer cancelExpired()
+
+	b := testBreaker()
+	for i := 0; i < 10; i++ {
+		require.True(t, b.Allow())
+		b.Done(canceled, status.Error(codes.Canceled, "context canceled"))
+		require.True(t, b.Allow())
+		b.Done(expired, status.Error(codes.DeadlineExceeded, "context deadline exceeded"))
+	}
+	require.Equal(t, breakerClosed, b.state)
+	require.Equal(t, 0, b.calls)
+
+	// the workers returning DeadlineExceeded are failing
+	for i := 0; i < 4; i++ {
+		require.True(t, b.Allow())
+		b.Done(context.Background(), status.Error(codes.DeadlineExceeded, "upstream timeout"))
+	}
+	require.Equal(t, breakerOpen, b.state)
+
+	// the ended probe releases the slot and doesn't close the breaker
+	time.Sleep(60 * time.Millisecond)
+	require.True(t, b.Allow())
+	require.True(t, b.Allow())
+	require.False(t, b.Allow())
+	b.Done(expired, status.Error(codes.DeadlineExceeded, "context deadline exceeded"))
+	require.Equal(t, breakerHalfOpen, b.state)
+	require.True(t, b.Allow())
+}
+
+func TestIsWorkerFailure(t *testing.T) {
+	tests := []struct {
+		err     error
+		failure bool
+	}{
+		{err: nil},
+		{err: status.Error(codes.NotFound, "not found")},
+		{err: status.Error(codes.InvalidArgument, "invalid")},
+		{err: status.Error(codes.Canceled, "canceled")},
+		{err: status.Error(codes.Internal, "internal"), failure: true},
+		{err: status.Error(codes.Unknown, "unknown"), failure: true},
+		{err: status.Error(codes.Unavailable, "unavailable"), failure: true},
+		{err: status.Error(codes.DeadlineExceeded, "deadline"), failure: true},
+		{err: status.Error(codes.DataLoss, "data loss"), failure: true},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.failure, isWorkerFailure(tt.err), status.Code(tt.err).String())
+	}
+}
@@ -1,13 +1,19 @@
 package grpc
 
 import (
+	"compress/gzip"
 	"crypto/tls"
+	"crypto/x509"
+	"fmt"
 	"math"
+	"net"
 	"os"
+	"runtime"
 	"strings"
 	"time"
 
 	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/grpc/v3/proxy"
 	"github.com/roadrunner-server/sdk/v3/pool"
 )
 
@@ -21,24 +27,314 @@ const (
 	RequireAndVerifyClientCert ClientAuthType = "require_and_verify_client_cert"
 )
 
+type CodecType string
+
+const (
+	// RawCodec passes request and response bytes between the client and the workers without decoding
+	RawCodec CodecType = "raw"
+	// ProtoCodec decodes requests and responses into the dynamic messages of the parsed proto files, so the
+	// interceptors (e.g. passed by the other plugins as the server options) receive the decoded messages. The messages
+	// are encoded again for the workers and the clients, should be used only for debugging
+	ProtoCodec CodecType = "proto"
+)
+
 type Config struct {
-	Listen string   `mapstructure:"listen"`
-	Proto  []string `mapstructure:"proto"`
+	// Listen is the address of the listener (tcp://host:port or unix://path). The calls are served over HTTP/2 only:
+	// grpc-go has no HTTP/3 (QUIC) server transport, so HTTP/3 can't be enabled even as an experimental mode. The
+	// HTTP/3 clients should be served through an edge proxy (e.g. Envoy) translating the calls to HTTP/2.
+	Listen string `mapstructure:"listen"`
+	// Proto files, directories (all proto files, recursively) or glob patterns (proto/**/*.proto, ** matches any
+	// number of directories). ${ENV_VAR} references are replaced with the environment variables values.
+	Proto []string `mapstructure:"proto"`
+
+	// FailOnEmptyProto fails the start when a proto file does not declare any service (only warns by default)
+	FailOnEmptyProto bool `mapstructure:"fail_on_empty_proto"`
+
+	// ParseConcurrency is the number of the proto files parsed concurrently on start and on the server rebuilds, the
+	// number of CPUs by default. The services are registered in the order of the files regardless of it.
+	ParseConcurrency int `mapstructure:"parse_concurrency"`
+
+	// FailOnUndefinedTypes compiles the proto files on start and fails when a method request or response type is not
+	// declared or imported (the bodies are proxied as is, so such typos are not noticed otherwise). The imports
+	// are resolved relative to the proto file, the other compilation errors fail the start as well.
+	FailOnUndefinedTypes bool `mapstructure:"fail_on_undefined_types"`
 
 	TLS *TLS `mapstructure:"tls"`
 
-	// Env is environment variables passed to the http pool
+	// Codec used by the gRPC server, raw by default
+	Codec CodecType `mapstructure:"codec"`
+
+	// GzipLevel is the compression level of the gzip compressor: 1 (best speed) .. 9 (best compression),
+	// the default level is used if not set. The compressor is shared by all servers (named instances), so they can't
+	// set the different levels, and the servers without the level use the level set by another server.
+	GzipLevel int `mapstructure:"gzip_level"`
+
+	// CompressMinSize enables the adaptive response compression: the responses smaller than the size in bytes are sent
+	// uncompressed, the bigger ones are compressed with gzip if the client accepts it (grpc-accept-encoding), even
+	// when the request was not compressed. By default, the response is compressed only if the request was.
+	CompressMinSize int `mapstructure:"compress_min_size"`
+
+	// Reflection registers the server reflection services (v1 and v1alpha) describing the services of the proto
+	// files, e.g. for grpcurl. The proto files are compiled on start, imports are resolved relative to the file.
+	Reflection bool `mapstructure:"reflection"`
+
+	// ProtoWatchInterval enables the development mode rebuilding the server when the configured proto files change:
+	// the files are checked every interval, the new methods are served without the restart. The connected clients
+	// are disconnected (GOAWAY) on every rebuild and the imported files are not watched, do not use it in production.
+	// Disabled if not set.
+	ProtoWatchInterval time.Duration `mapstructure:"proto_watch_interval"`
+
+	// ReadinessGate controls the calls made before the first worker is ready: wait - the listener is created only
+	// when a worker is ready (up to ReadinessTimeout, 1m by default, the start fails after), unavailable - the calls
+	// are rejected with the retriable Unavailable status and RetryInfo (1s). No gate if not set.
+	ReadinessGate    string        `mapstructure:"readiness_gate"`
+	ReadinessTimeout time.Duration `mapstructure:"readiness_timeout"`
+
+	// MinReadyWorkers makes the health service and the readiness report NOT_SERVING until at least the number of
+	// workers are active (ready or working), on start and after the reset, so the load balancers don't route the
+	// calls to the instance with the workers still booting. Should not exceed the pool's num_workers.
+	MinReadyWorkers int `mapstructure:"min_ready_workers"`
+
+	// ShutdownTimeout enables the graceful stop: the health service reports NOT_SERVING, the listener is closed after
+	// shutdown_delay (new connections are refused), the health watches are ended, GOAWAY is sent to the connected
+	// clients and the calls in flight are completed up to the timeout, the remaining connections are closed after.
+	// Should be less than the RoadRunner graceful timeout. The server is stopped immediately if not set. The servers
+	// replaced on the rebuilds (register_proto, the connections drain, the proto watch) are stopped gracefully up to
+	// the same timeout, 1m if not set.
+	ShutdownTimeout time.Duration `mapstructure:"shutdown_timeout"`
+
+	// ShutdownDelay is the time between NOT_SERVING and the graceful stop (requires shutdown_timeout): the listener
+	// is still open and the calls are served while the load balancers notice the status and stop routing the calls
+	// to the instance. Both the delay and shutdown_timeout should fit into the RoadRunner graceful timeout.
+	ShutdownDelay time.Duration `mapstructure:"shutdown_delay"`
+
+	// JSONErrorDetails makes the plugin expect the details of the worker errors as the JSON array of
+	// google.protobuf.Any in the JSON form, e.g. [{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "reason": "X"}],
+	// instead of the serialized messages separated by the delimiter. Only the google.rpc error details types are known.
+	JSONErrorDetails bool `mapstructure:"json_error_details"`
+
+	// HealthPoolStats sends the workers count in the headers of the health Check responses: x-workers-total,
+	// x-workers-ready and x-workers-busy. The stats are skipped while the pool is being reset.
+	HealthPoolStats bool `mapstructure:"health_pool_stats"`
+
+	// DisableLogInterceptor removes the calls logging interceptor, log_bodies and latency_log_interval are not recorded
+	// without it. DisableMetricsInterceptor removes the calls duration metric (request_duration_seconds), the worker
+	// metrics are still collected. Both interceptors are enabled by default.
+	DisableLogInterceptor     bool `mapstructure:"disable_log_interceptor"`
+	DisableMetricsInterceptor bool `mapstructure:"disable_metrics_interceptor"`
+
+	// ExperimentalORCA registers the ORCA out-of-band load reporting service (xds.service.orca.v3.OpenRcaService) for
+	// the xDS load balancers: the busy workers ratio is reported as the CPU utilization and the "workers" utilization,
+	// the average worker memory relative to max_worker_memory as the memory utilization. The ORCA support is
+	// experimental in gRPC and the reported values may change.
+	ExperimentalORCA bool `mapstructure:"experimental_orca"`
+
+	// ServiceVersion is the deployed service version attached to all plugin metrics as the service_version label and
+	// to the plugin logs as the field, e.g. to compare the canary with the stable version
+	ServiceVersion string `mapstructure:"service_version"`
+
+	// HTTPHealthPath serves the HTTP/1.1 readiness endpoint (e.g. /healthz) on the gRPC port for the orchestrators
+	// without gRPC health checks: GET responds 200 when the workers are ready, 503 otherwise. The connections are
+	// detected by the first bytes (HTTP/2 preface) or, for TLS, by the ALPN: clients offering h2 are served by gRPC.
+	// With TLS the health checks should use TLS too (plaintext only with allow_plaintext) and present the client
+	// certificate if it is required. Disabled if empty.
+	HTTPHealthPath string `mapstructure:"http_health_path"`
+
+	// LatencyLogInterval enables periodic logging of the calls count and p50/p95/p99 latency per method
+	LatencyLogInterval time.Duration `mapstructure:"latency_log_interval"`
+
+	// MaxResponseMetadataSize limits the size (in bytes) of the response metadata returned by the worker,
+	// len(key) + len(value) + 32 per entry (HTTP/2 header list size). Unlimited if not set.
+	MaxResponseMetadataSize int `mapstructure:"max_response_metadata_size"`
+
+	// MaxResponseMetadataKeys limits the number of the response metadata keys returned by the worker, the call fails
+	// with the Internal status when exceeded. Unlimited if not set.
+	MaxResponseMetadataKeys int `mapstructure:"max_response_metadata_keys"`
+
+	// ContextCodec is the codec of the context sent to the worker and of the response context: json (default) or
+	// msgpack. The worker receives the codec in the frame flags and should respond with the same codec.
+	ContextCodec string `mapstructure:"context_codec"`
+
+	// PeerAddressFormat is the format of the peer address sent to the workers (:peer.address): full - as is, ip:port
+	// (default), ip - the IP only, normalized - the IP with the port. The IPv4-mapped IPv6 addresses are converted to
+	// IPv4 and the IPv6 addresses are written in the canonical form by ip and normalized.
+	PeerAddressFormat string `mapstructure:"peer_address_format"`
+
+	// ContextKeys renames the keys of the context JSON sent to the workers, e.g. for the workers expecting
+	// a different schema. Defaults: service, method, context.
+	ContextKeys *ContextKeys `mapstructure:"context_keys"`
+
+	// MetadataAllowlist limits the metadata keys forwarded to the workers (all keys by default), MetadataDenylist
+	// keys are never forwarded. The trailing * matches any suffix, e.g. x-b3-*. Pseudo-headers and the entries
+	// added by the plugin (:peer.address, :authority etc.) are always forwarded.
+	MetadataAllowlist []string `mapstructure:"metadata_allowlist"`
+	MetadataDenylist  []string `mapstructure:"metadata_denylist"`
+
+	// StatusMetadata echoes the final status code and the percent-encoded message of the calls in the x-status-code
+	// and x-status-message response headers, for debugging the clients which don't surface the gRPC status. The
+	// status is still sent in the trailers as usual.
+	StatusMetadata bool `mapstructure:"status_metadata"`
+
+	// RequestID generates the x-request-id metadata for the calls without it, the id is forwarded to the worker,
+	// sent back in the response headers and added to the logs
+	RequestID bool `mapstructure:"request_id"`
+
+	// LogBodies is a list of full method names (/package.Service/Method) whose raw request and response bodies are
+	// logged base64 encoded, for debugging only: the bodies may contain personal data (PII) and secrets, do not
+	// enable it in production. Bodies are truncated to LogBodiesMaxSize bytes (1024 by default).
+	LogBodies        []string `mapstructure:"log_bodies"`
+	LogBodiesMaxSize int      `mapstructure:"log_bodies_max_size"`
+
+	// WorkerElapsedHeader sends the worker execution time in milliseconds in the x-worker-elapsed-ms response header
+	WorkerElapsedHeader bool `mapstructure:"worker_elapsed_header"`
+
+	// WorkerQueueHeader sends the time the call waited for a free worker in the pool in milliseconds in the
+	// x-worker-queue-ms response header (the worker_queue_wait_seconds metric is always collected). The wait is
+	// reported only by the pools calling proxy.ExecStarted, the RoadRunner static pool doesn't report it.
+	WorkerQueueHeader bool `mapstructure:"worker_queue_header"`
+
+	// InstanceIDHeader sends InstanceID in the x-instance-id header of all responses (including the failed calls) to
+	// correlate the client errors with the server instances. InstanceID is the hostname by default, e.g. the pod name
+	// can be provided with instance_id: ${POD_NAME}.
+	InstanceIDHeader bool   `mapstructure:"instance_id_header"`
+	InstanceID       string `mapstructure:"instance_id"`
+
+	// TimingTrailers sends the call time measured by the logging interceptor in the x-server-time-ms trailer and the
+	// worker execution time in the x-worker-time-ms trailer (when the call reached the worker), in milliseconds.
+	// Requires the logging interceptor.
+	TimingTrailers bool `mapstructure:"timing_trailers"`
+
+	// ResponseEnvelope enables the versioned response envelope: the worker returns the status code, message and
+	// details, the metadata and the trailers as the structured response context instead of the metadata map with
+	// the error key. Workers should be updated to return the envelope for all calls before enabling it.
+	ResponseEnvelope bool `mapstructure:"response_envelope"`
+
+	// HTTPCacheHeaders sends the HTTP caching keys returned in the envelope trailers (cache-control, expires, etag,
+	// last-modified, vary) in the response headers to all clients. The grpc-web clients always receive them in the
+	// headers: grpc-web should be translated to gRPC by a proxy keeping the x-grpc-web header (e.g. Envoy grpc_web
+	// filter), the server doesn't accept the application/grpc-web content type.
+	HTTPCacheHeaders bool `mapstructure:"http_cache_headers"`
+
+	// ErrorKey is the response metadata key used by the workers to return the error (base64 encoded serialized
+	// google.rpc.Status), "error" by default. Changing it allows the workers to return the metadata named "error".
+	ErrorKey string `mapstructure:"error_key"`
+
+	// StatusKey enables the response metadata key used by the workers to set the call status explicitly (base64
+	// encoded serialized google.rpc.Status), e.g. OK with the details of the partial success sent in the
+	// status-details-bin trailer. Disabled by default, the metadata with the key is sent to the client as is then.
+	StatusKey string `mapstructure:"status_key"`
+
+	// ContentTypes restricts the content subtypes accepted by the particular methods
+	ContentTypes []*MethodContentTypes `mapstructure:"content_types"`
+
+	// AffinityMetadata is the metadata key (e.g. x-session-id) of the worker affinity: the calls with the same value
+	// prefer the same worker to reuse its warm caches. The affinity is best-effort and is not kept across the resets,
+	// it requires the pool supporting it (see proxy.AffinityPool), the calls without the key are scheduled as usual.
+	AffinityMetadata string `mapstructure:"affinity_metadata"`
+
+	// RequiredMetadata rejects the calls without the metadata keys with the InvalidArgument status before they are
+	// sent to the workers
+	RequiredMetadata []*RequiredMetadata `mapstructure:"required_metadata"`
+
+	// ClientIdentities allow the calls of the methods only to the clients with the allowed identities, the calls of
+	// the other methods are not checked. Requires the verified client certificates (verify_client_cert_if_given or
+	// require_and_verify_client_cert), the calls without them fail with the PermissionDenied status.
+	ClientIdentities []*ClientIdentities `mapstructure:"client_identities"`
+
+	// FieldMasks clear the request fields before the requests are sent to the workers, e.g. the personal data the
+	// workers should not see or log. The proto files are compiled on start to resolve the request messages.
+	FieldMasks []*FieldMask `mapstructure:"field_masks"`
+
+	// JSONResponses are the full method names whose responses are transcoded from protobuf to JSON when the client
+	// sends the accept: application/json metadata, e.g. for the debugging tools. The gRPC framing and the content type
+	// are not changed, the client should read the raw message. The proto files are compiled on start to resolve the
+	// response messages.
+	JSONResponses []string `mapstructure:"json_responses"`
+
+	// MethodConcurrency limits the number of concurrent calls of the particular methods
+	MethodConcurrency []*MethodConcurrency `mapstructure:"method_concurrency"`
+
+	// MethodMaxRecvMsgSize limits the request size of the particular methods
+	MethodMaxRecvMsgSize []*MethodMsgSize `mapstructure:"method_max_recv_msg_size"`
+
+	// ServicesMetadata overrides the ServiceDesc metadata (proto file path by default) for the particular services
+	ServicesMetadata []*ServiceMetadata `mapstructure:"services_metadata"`
+
+	// MaxDeadline caps the deadline of the calls: the calls without the deadline or with the later one get the
+	// now + max_deadline deadline before they are queued and sent to the workers, bounding the worker occupancy.
+	// The capped calls are logged. Not capped if not set.
+	MaxDeadline time.Duration `mapstructure:"max_deadline"`
+
+	// QueueTimeout enables the queue in front of the pool: calls exceeding the number of workers wait for a free
+	// worker up to the timeout and fail with the ResourceExhausted status after that. QueueSize limits the number
+	// of the waiting calls (0 - unlimited), calls are rejected immediately when the queue is full.
+	QueueTimeout time.Duration `mapstructure:"queue_timeout"`
+	QueueSize    int           `mapstructure:"queue_size"`
+
+	// CircuitBreaker fast-fails the calls with the Unavailable status while the workers are failing
+	CircuitBreaker *CircuitBreaker `mapstructure:"circuit_breaker"`
+
+	// Env is environment variables passed to the workers pool, RR_MODE (grpc) and RR_GRPC_SERVER (the name of
+	// the plugin instance, grpc for the default one) are always set
 	Env map[string]string `mapstructure:"env"`
 
-	GrpcPool              *pool.Config  `mapstructure:"pool"`
-	MaxSendMsgSize        int64         `mapstructure:"max_send_msg_size"`
-	MaxRecvMsgSize        int64         `mapstructure:"max_recv_msg_size"`
-	MaxConnectionIdle     time.Duration `mapstructure:"max_connection_idle"`
+	GrpcPool          *pool.Config  `mapstructure:"pool"`
+	MaxSendMsgSize    int64         `mapstructure:"max_send_msg_size"`
+	MaxRecvMsgSize    int64         `mapstructure:"max_recv_msg_size"`
+	MaxConnectionIdle time.Duration `mapstructure:"max_connection_idle"`
+	// MaxConnectionAge sends GOAWAY to the connections older than the age, gRPC adds the random +/-10% jitter to the
+	// age of every connection to spread the reconnects. MaxConnectionAgeGrace is the time to complete the calls in
+	// flight after that, the connection is closed forcibly after the grace.
 	MaxConnectionAge      time.Duration `mapstructure:"max_connection_age"`
 	MaxConnectionAgeGrace time.Duration `mapstructure:"max_connection_age_grace"`
 	MaxConcurrentStreams  int64         `mapstructure:"max_concurrent_streams"`
 	PingTime              time.Duration `mapstructure:"ping_time"`
 	Timeout               time.Duration `mapstructure:"timeout"`
+
+	// MaxConnectionCalls limits the number of the calls in flight per connection (0 - unlimited), the calls above
+	// the limit fail with the ResourceExhausted status. Unlike MaxConcurrentStreams (rejected by HTTP/2 flow control)
+	// it protects the workers from a single noisy connection.
+	MaxConnectionCalls int `mapstructure:"max_connection_calls"`
+
+	// LogConnections logs the opened and closed connections with the peer address and the close reason
+	// (max_connection_age, max_connection_idle or client_or_network), the keepalive pings sent by the server and the
+	// connections closed without the ping ack. The keepalive parameters are logged on start.
+	LogConnections bool `mapstructure:"log_connections"`
+
+	// Socket options of the tcp listener, replace the default options (SO_REUSEPORT and TCP_FASTOPEN)
+	Socket *SocketOptions `mapstructure:"socket"`
+
+	// IdleTimeout closes the connection if no bytes were received from the client during the timeout. Unlike
+	// MaxConnectionIdle (time without active calls, the connection is closed gracefully with GOAWAY) it detects
+	// half-open connections (e.g. dropped by NAT). Client's keepalive ping ACKs reset the timer, so the connections
+	// with active but silent calls are kept only when PingTime is less than IdleTimeout.
+	IdleTimeout time.Duration `mapstructure:"idle_timeout"`
+
+	// AcceptRate limits the number of accepted connections per second, the connections above the rate are closed
+	// right after accept. AcceptBurst is the max number of connections accepted at once (1 by default).
+	AcceptRate  float64 `mapstructure:"accept_rate"`
+	AcceptBurst int     `mapstructure:"accept_burst"`
+
+	// MaxConnections limits the number of simultaneously open connections (0 - unlimited), the connections above
+	// the limit are closed right after accept.
+	MaxConnections int `mapstructure:"max_connections"`
+
+	// ProxyProtocol requires the PROXY protocol (v1 or v2) header on every connection, e.g. behind L4 load balancer.
+	// The client address from the header is forwarded to the workers, connections without the header are rejected.
+	ProxyProtocol bool `mapstructure:"proxy_protocol"`
+	// ProxyProtocolTimeout limits the time to read the PROXY protocol header
+	ProxyProtocolTimeout time.Duration `mapstructure:"proxy_protocol_timeout"`
+
+	// IPAllowlist is a list of CIDR ranges (or IP addresses) allowed to call the server, all addresses are allowed if empty
+	IPAllowlist []string `mapstructure:"ip_allowlist"`
+	// IPDenylist is a list of CIDR ranges (or IP addresses) denied to call the server, checked before the allowlist
+	IPDenylist []string `mapstructure:"ip_denylist"`
+
+	// parsed ip_allowlist and ip_denylist
+	allowed []*net.IPNet
+	denied  []*net.IPNet
+	// log_bodies set
+	logBodies map[string]struct{}
 }
 
 type TLS struct {
@@ -46,10 +342,150 @@ type TLS struct {
 	Cert     string         `mapstructure:"cert"`
 	RootCA   string         `mapstructure:"root_ca"`
 	AuthType ClientAuthType `mapstructure:"client_auth_type"`
+	// RootCAs are the additional client certificates CA files, e.g. for the clients signed by different issuing CAs.
+	// Both RootCA and RootCAs may be directories, all files of the directory are loaded (not recursively).
+	RootCAs []string `mapstructure:"root_cas"`
+	// RequireClientAuthEKU rejects the calls with the Unauthenticated status when the client certificate does not
+	// have the clientAuth extended key usage, e.g. issued for the server authentication only
+	RequireClientAuthEKU bool `mapstructure:"require_client_auth_eku"`
+	// ExternalCert makes the server certificate provided by the CertProvider registered by another plugin (e.g. from
+	// the secrets manager) instead of the cert and key files, which should not be set then. The client CAs are still
+	// loaded from the files.
+	ExternalCert bool `mapstructure:"external_cert"`
+	// ClientAuthFailure controls how the client certificate missing or failing the verification required by
+	// client_auth_type is reported: handshake (default) - the TLS handshake fails and the clients get the transport
+	// error, unauthenticated - the certificate is only requested in the handshake and the calls fail with the
+	// Unauthenticated status and the reason (e.g. "client certificate required"). The certificate is verified on every
+	// call in the unauthenticated mode, the HTTP health endpoint keeps the handshake checks.
+	ClientAuthFailure string `mapstructure:"client_auth_failure"`
+	// KeyPassword decrypts the encrypted (PKCS#8 or PKCS#1) key, use env variable to provide it: ${TLS_KEY_PASSWORD}
+	KeyPassword string `mapstructure:"key_password"`
+	// AllowPlaintext allows plaintext (h2c) connections on the same port. The first bytes of the connection
+	// are used to distinguish the TLS handshake from the plaintext HTTP/2 preface. Plaintext connections are
+	// not authenticated and not encrypted, so they should be allowed only in trusted networks.
+	AllowPlaintext bool `mapstructure:"allow_plaintext"`
+	// HandshakeTimeout limits the time to detect the connection type and to complete the TLS handshake
+	HandshakeTimeout time.Duration `mapstructure:"handshake_timeout"`
+	// SessionTicketKeys is the file with the session ticket keys shared by the instances (one hex or base64 encoded
+	// 32 bytes key per line, the first one encrypts new tickets). By default, every process generates its own keys,
+	// so the sessions can't be resumed on another instance behind the load balancer.
+	SessionTicketKeys string `mapstructure:"session_ticket_keys"`
+	// SessionTicketKeysReload is the interval to re-read the keys file, keys are rotated by updating the file
+	SessionTicketKeysReload time.Duration `mapstructure:"session_ticket_keys_reload"`
+	// LogHandshakes logs the completed handshakes (version, cipher suite, SNI, ALPN and the client certificate
+	// subject) at the debug level, or at the info level for the handshakes with the client certificate. The handshakes
+	// are counted by the version and the cipher suite in the tls_handshakes_total metric.
+	LogHandshakes bool `mapstructure:"log_handshakes"`
+	// CertCheckCacheTTL is the time the results of the registered client certificate check are cached, 1m by default.
+	// CertCheckTimeout limits the check time, 1s by default: the handshake fails after it, or succeeds when
+	// CertCheckFailOpen is set.
+	CertCheckCacheTTL time.Duration `mapstructure:"cert_check_cache_ttl"`
+	CertCheckTimeout  time.Duration `mapstructure:"cert_check_timeout"`
+	CertCheckFailOpen bool          `mapstructure:"cert_check_fail_open"`
 	// auth type
 	auth tls.ClientAuthType
 }
 
+// ContextKeys are the keys of the context JSON sent to the workers, empty key keeps the default name
+type ContextKeys struct {
+	Service string `mapstructure:"service"`
+	Method  string `mapstructure:"method"`
+	Context string `mapstructure:"context"`
+}
+
+// ServiceMetadata is a metadata value reported for the service, e.g. via reflection
+type ServiceMetadata struct {
+	// Service is a full service name: package.Service
+	Service  string `mapstructure:"service"`
+	Metadata string `mapstructure:"metadata"`
+}
+
+// MethodContentTypes declares content subtypes (application/grpc+<subtype>) the method's worker is able to respond with.
+// The response is always encoded with the same subtype as the request, workers receive it in the :content-subtype context key.
+type MethodContentTypes struct {
+	// Method is a full method name: /package.Service/Method
+	Method       string   `mapstructure:"method"`
+	ContentTypes []string `mapstructure:"content_types"`
+}
+
+// RequiredMetadata declares the metadata keys the calls of the method should have
+type RequiredMetadata struct {
+	// Method is a full method name: /package.Service/Method, the keys are required for all methods if empty
+	Method string   `mapstructure:"method"`
+	Keys   []string `mapstructure:"keys"`
+	// NonEmpty requires at least one non-empty value, otherwise the key presence is enough
+	NonEmpty bool `mapstructure:"non_empty"`
+}
+
+// ClientIdentities declares the client identities allowed to call the method
+type ClientIdentities struct {
+	// Method is a full method name: /package.Service/Method
+	Method string `mapstructure:"method"`
+	// Identities are matched against the subject CN and the DNS, URI (e.g. SPIFFE ID) and email SANs of the client
+	// certificate, the trailing * matches any suffix: spiffe://example.org/ns/billing/*
+	Identities []string `mapstructure:"identities"`
+}
+
+// FieldMask declares the request fields of the method cleared before the request is sent to the worker
+type FieldMask struct {
+	// Method is a full method name: /package.Service/Method
+	Method string `mapstructure:"method"`
+	// Fields are the field names of the request message, the nested fields are separated by the dot: user.email.
+	// The parent fields should be singular messages, repeated and map fields are cleared as a whole.
+	Fields []string `mapstructure:"fields"`
+}
+
+// MethodConcurrency is the max number of the method's calls in flight. Calls over the limit wait for a free slot
+// up to QueueTimeout (immediately when not set) and fail with the ResourceExhausted status.
+type MethodConcurrency struct {
+	// Method is a full method name: /package.Service/Method
+	Method       string        `mapstructure:"method"`
+	Limit        int           `mapstructure:"limit"`
+	QueueTimeout time.Duration `mapstructure:"queue_timeout"`
+}
+
+// CircuitBreaker opens when the rate of the failed calls (Internal, Unknown, Unavailable, DeadlineExceeded, DataLoss)
+// within the window reaches FailureRate, the calls are rejected for the Cooldown, then HalfOpenCalls probe calls are
+// sent to the workers: the breaker is closed when all of them succeed and opened again otherwise.
+type CircuitBreaker struct {
+	// FailureRate 0..1, 0.5 by default
+	FailureRate float64 `mapstructure:"failure_rate"`
+	// MinCalls is the min number of calls within the window to evaluate the rate, 20 by default
+	MinCalls int `mapstructure:"min_calls"`
+	// Window is the interval the calls are counted within, 10s by default
+	Window time.Duration `mapstructure:"window"`
+	// Cooldown is the time the breaker is open, 5s by default
+	Cooldown time.Duration `mapstructure:"cooldown"`
+	// HalfOpenCalls is the number of the probe calls, 1 by default
+	HalfOpenCalls int `mapstructure:"half_open_calls"`
+	// DrainOnOpen sends GOAWAY to all connections when the breaker is opened, so the clients reconnect through
+	// the load balancer to the other instances instead of retrying on the same connection
+	DrainOnOpen bool `mapstructure:"drain_on_open"`
+}
+
+// SocketOptions are the options of the listening socket
+type SocketOptions struct {
+	// ReusePort sets SO_REUSEPORT (Linux, macOS, FreeBSD; ignored with a warning on the other platforms), so a new
+	// process may bind the same port while the old one drains the connections during the zero-downtime restart.
+	ReusePort bool `mapstructure:"reuse_port"`
+	// TCPKeepAlive is the period of the OS-level TCP keepalive probes of the accepted connections, 15s if not set,
+	// negative value disables the probes. Unlike the HTTP/2 pings (ping_time) the probes are not visible to gRPC.
+	TCPKeepAlive time.Duration `mapstructure:"tcp_keepalive"`
+	// Backlog is the max length of the queue of the connections not yet accepted (Linux, macOS, FreeBSD; ignored with
+	// a warning on the other platforms), 0 - the Go default (the OS limit). The kernel silently caps the value
+	// with net.core.somaxconn (Linux) or kern.ipc.somaxconn (macOS, FreeBSD), raise the kernel limit as well.
+	Backlog int `mapstructure:"backlog"`
+}
+
+// MethodMsgSize is the max request size in bytes for the method. gRPC rejects the messages greater than
+// max_recv_msg_size using the message length prefix before reading the message, while this limit is checked after
+// the message is read (gRPC does not expose the length before decoding), but before it is sent to the worker.
+type MethodMsgSize struct {
+	// Method is a full method name: /package.Service/Method
+	Method  string `mapstructure:"method"`
+	MaxSize int    `mapstructure:"max_size"`
+}
+
 func (c *Config) InitDefaults() error { //nolint:gocyclo,gocognit
 	const op = errors.Op("grpc_plugin_config")
 	if c.GrpcPool == nil {
@@ -58,51 +494,110 @@ func (c *Config) InitDefaults() error { //nolint:gocyclo,gocognit
 
 	c.GrpcPool.InitDefaults()
 
-	if !strings.Contains(c.Listen, ":") {
-		return errors.E(op, errors.Errorf("malformed grpc address, provided: %s", c.Listen))
+	switch c.Codec {
+	case "":
+		c.Codec = RawCodec
+	case RawCodec, ProtoCodec:
+	default:
+		return errors.E(op, errors.Errorf("unknown codec: %s, supported: %s, %s", c.Codec, RawCodec, ProtoCodec))
 	}
 
-	for i := 0; i < len(c.Proto); i++ {
-		if c.Proto[i] == "" {
-			continue
-		}
+	switch c.ReadinessGate {
+	case "", gateWait, gateUnavailable:
+	default:
+		return errors.E(op, errors.Errorf("readiness_gate should be %s or %s, provided: %s", gateWait, gateUnavailable, c.ReadinessGate))
+	}
 
-		if _, err := os.Stat(c.Proto[i]); err != nil {
-			if os.IsNotExist(err) {
-				return errors.E(op, errors.Errorf("proto file '%s' does not exists", c.Proto[i]))
-			}
+	if c.MinReadyWorkers < 0 || (c.MinReadyWorkers > 0 && uint64(c.MinReadyWorkers) > c.GrpcPool.NumWorkers) {
+		return errors.E(op, errors.Errorf("min_ready_workers should be in range 0..%d (pool num_workers), provided: %d", c.GrpcPool.NumWorkers, c.MinReadyWorkers))
+	}
 
-			return errors.E(op, err)
-		}
+	if c.ReadinessGate == gateWait && c.ReadinessTimeout == 0 {
+		c.ReadinessTimeout = time.Minute
 	}
 
-	if c.EnableTLS() {
-		if _, err := os.Stat(c.TLS.Key); err != nil {
-			if os.IsNotExist(err) {
-				return errors.E(op, errors.Errorf("key file '%s' does not exists", c.TLS.Key))
-			}
+	if _, err := proxy.NewContextCodec(c.ContextCodec); err != nil {
+		return errors.E(op, err)
+	}
 
-			return errors.E(op, err)
+	if err := proxy.ValidatePeerAddressFormat(c.PeerAddressFormat); err != nil {
+		return errors.E(op, err)
+	}
+
+	// metadata keys are lowercased
+	c.ErrorKey = strings.ToLower(c.ErrorKey)
+	c.StatusKey = strings.ToLower(c.StatusKey)
+	if c.StatusKey != "" && (c.StatusKey == c.ErrorKey || (c.ErrorKey == "" && c.StatusKey == "error")) {
+		return errors.E(op, errors.Errorf("status_key should differ from the error key: %s", c.StatusKey))
+	}
+	for i := 0; i < len(c.MetadataAllowlist); i++ {
+		c.MetadataAllowlist[i] = strings.ToLower(c.MetadataAllowlist[i])
+	}
+
+	c.AffinityMetadata = strings.ToLower(c.AffinityMetadata)
+
+	for i := 0; i < len(c.MetadataDenylist); i++ {
+		c.MetadataDenylist[i] = strings.ToLower(c.MetadataDenylist[i])
+	}
+
+	if c.ShutdownTimeout < 0 {
+		return errors.E(op, errors.Errorf("shutdown_timeout should be positive, provided: %s", c.ShutdownTimeout))
+	}
+
+	if c.ShutdownDelay < 0 {
+		return errors.E(op, errors.Errorf("shutdown_delay should be positive, provided: %s", c.ShutdownDelay))
+	}
+
+	if c.ShutdownDelay > 0 && c.ShutdownTimeout == 0 {
+		return errors.E(op, errors.Str("shutdown_delay requires shutdown_timeout"))
+	}
+
+	if c.InstanceIDHeader && c.InstanceID == "" {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return errors.E(op, errors.Errorf("instance_id is not set and the hostname is not available: %v", err))
 		}
 
-		if _, err := os.Stat(c.TLS.Cert); err != nil {
-			if os.IsNotExist(err) {
-				return errors.E(op, errors.Errorf("cert file '%s' does not exists", c.TLS.Cert))
-			}
+		c.InstanceID = hostname
+	}
+
+	switch {
+	case c.ParseConcurrency < 0:
+		return errors.E(op, errors.Errorf("parse_concurrency should not be negative, provided: %d", c.ParseConcurrency))
+	case c.ParseConcurrency == 0:
+		c.ParseConcurrency = runtime.NumCPU()
+	}
+
+	if c.ProtoWatchInterval < 0 {
+		return errors.E(op, errors.Errorf("proto_watch_interval should be positive, provided: %s", c.ProtoWatchInterval))
+	}
+
+	if c.MaxDeadline < 0 {
+		return errors.E(op, errors.Errorf("max_deadline should be positive, provided: %s", c.MaxDeadline))
+	}
+
+	if c.HTTPHealthPath != "" && !strings.HasPrefix(c.HTTPHealthPath, "/") {
+		return errors.E(op, errors.Errorf("http_health_path should start with /, provided: %s", c.HTTPHealthPath))
+	}
+
+	if !strings.Contains(c.Listen, ":") {
+		return errors.E(op, errors.Errorf("malformed grpc address, provided: %s", c.Listen))
+	}
+
+	protos, err := expandProtoPaths(c.Proto)
+	if err != nil {
+		return errors.E(op, err)
+	}
+	c.Proto = protos
 
+	if c.TLS != nil && (c.TLS.Key != "" || c.TLS.Cert != "" || c.TLS.ExternalCert || c.TLS.clientCAs()) {
+		// all problems are reported at once
+		if err := c.TLS.validate(); err != nil {
 			return errors.E(op, err)
 		}
 
-		// RootCA is optional, but if provided - check it
-		if c.TLS.RootCA != "" {
-			if _, err := os.Stat(c.TLS.RootCA); err != nil {
-				if os.IsNotExist(err) {
-					return errors.E(op, errors.Errorf("root ca path provided, but key file '%s' does not exists", c.TLS.RootCA))
-				}
-				return errors.E(op, err)
-			}
-
-			// auth type used only for the CA
+		// RootCA is optional, auth type used only for the CA
+		if c.TLS.clientCAs() {
 			switch c.TLS.AuthType {
 			case NoClientCert:
 				c.TLS.auth = tls.NoClientCert
@@ -120,9 +615,195 @@ func (c *Config) InitDefaults() error { //nolint:gocyclo,gocognit
 		}
 	}
 
+	if c.TLS != nil {
+		switch c.TLS.ClientAuthFailure {
+		case "":
+			c.TLS.ClientAuthFailure = clientAuthFailureHandshake
+		case clientAuthFailureHandshake, clientAuthFailureUnauthenticated:
+		default:
+			return errors.E(op, errors.Errorf("client_auth_failure should be %s or %s, provided: %s", clientAuthFailureHandshake, clientAuthFailureUnauthenticated, c.TLS.ClientAuthFailure))
+		}
+	}
+
+	if c.TLS != nil && c.TLS.HandshakeTimeout == 0 {
+		c.TLS.HandshakeTimeout = time.Second * 10
+	}
+
+	if c.TLS != nil && c.TLS.CertCheckCacheTTL == 0 {
+		c.TLS.CertCheckCacheTTL = time.Minute
+	}
+
+	if c.TLS != nil && c.TLS.CertCheckTimeout == 0 {
+		c.TLS.CertCheckTimeout = time.Second
+	}
+
+	if c.TLS != nil && c.TLS.SessionTicketKeys != "" && c.TLS.SessionTicketKeysReload == 0 {
+		c.TLS.SessionTicketKeysReload = time.Minute
+	}
+
+	if c.CompressMinSize < 0 {
+		return errors.E(op, errors.Errorf("compress_min_size should not be negative, provided: %d", c.CompressMinSize))
+	}
+
+	if c.GzipLevel != 0 && (c.GzipLevel < gzip.BestSpeed || c.GzipLevel > gzip.BestCompression) {
+		return errors.E(op, errors.Errorf("gzip_level should be in range %d..%d, provided: %d", gzip.BestSpeed, gzip.BestCompression, c.GzipLevel))
+	}
+
+	for i := 0; i < len(c.ServicesMetadata); i++ {
+		if c.ServicesMetadata[i] == nil || c.ServicesMetadata[i].Service == "" {
+			return errors.E(op, errors.Str("services_metadata: service name should not be empty"))
+		}
+	}
+
+	for i := 0; i < len(c.ContentTypes); i++ {
+		if c.ContentTypes[i] == nil || c.ContentTypes[i].Method == "" {
+			return errors.E(op, errors.Str("content_types: method name should not be empty"))
+		}
+
+		for j := 0; j < len(c.ContentTypes[i].ContentTypes); j++ {
+			c.ContentTypes[i].ContentTypes[j] = strings.ToLower(c.ContentTypes[i].ContentTypes[j])
+		}
+	}
+
+	for i := 0; i < len(c.RequiredMetadata); i++ {
+		if c.RequiredMetadata[i] == nil || len(c.RequiredMetadata[i].Keys) == 0 {
+			return errors.E(op, errors.Str("required_metadata: keys should not be empty"))
+		}
+
+		for j := 0; j < len(c.RequiredMetadata[i].Keys); j++ {
+			c.RequiredMetadata[i].Keys[j] = strings.ToLower(c.RequiredMetadata[i].Keys[j])
+		}
+	}
+
+	for i := 0; i < len(c.ClientIdentities); i++ {
+		if c.ClientIdentities[i] == nil || c.ClientIdentities[i].Method == "" {
+			return errors.E(op, errors.Str("client_identities: method name should not be empty"))
+		}
+	}
+
+	if len(c.ClientIdentities) > 0 && (!c.EnableTLS() || (c.TLS.auth != tls.VerifyClientCertIfGiven && c.TLS.auth != tls.RequireAndVerifyClientCert)) {
+		return errors.E(op, errors.Str("client_identities require tls with the verified client certificates: verify_client_cert_if_given or require_and_verify_client_cert client_auth_type and the client CA"))
+	}
+
+	for i := 0; i < len(c.JSONResponses); i++ {
+		if c.JSONResponses[i] == "" {
+			return errors.E(op, errors.Str("json_responses: method name should not be empty"))
+		}
+	}
+
+	for i := 0; i < len(c.FieldMasks); i++ {
+		if c.FieldMasks[i] == nil || c.FieldMasks[i].Method == "" {
+			return errors.E(op, errors.Str("field_masks: method name should not be empty"))
+		}
+
+		if len(c.FieldMasks[i].Fields) == 0 {
+			return errors.E(op, errors.Errorf("field_masks: fields for the method %s should not be empty", c.FieldMasks[i].Method))
+		}
+	}
+
+	for i := 0; i < len(c.MethodConcurrency); i++ {
+		if c.MethodConcurrency[i] == nil || c.MethodConcurrency[i].Method == "" {
+			return errors.E(op, errors.Str("method_concurrency: method name should not be empty"))
+		}
+
+		if c.MethodConcurrency[i].Limit <= 0 {
+			return errors.E(op, errors.Errorf("method_concurrency: limit for the method %s should be greater than 0", c.MethodConcurrency[i].Method))
+		}
+	}
+
+	for i := 0; i < len(c.MethodMaxRecvMsgSize); i++ {
+		if c.MethodMaxRecvMsgSize[i] == nil || c.MethodMaxRecvMsgSize[i].Method == "" {
+			return errors.E(op, errors.Str("method_max_recv_msg_size: method name should not be empty"))
+		}
+
+		if c.MethodMaxRecvMsgSize[i].MaxSize <= 0 {
+			return errors.E(op, errors.Errorf("method_max_recv_msg_size: max size for the method %s should be greater than 0", c.MethodMaxRecvMsgSize[i].Method))
+		}
+	}
+
+	if len(c.LogBodies) > 0 {
+		if c.LogBodiesMaxSize < 0 {
+			return errors.E(op, errors.Errorf("log_bodies_max_size should not be negative, provided: %d", c.LogBodiesMaxSize))
+		}
+
+		if c.LogBodiesMaxSize == 0 {
+			c.LogBodiesMaxSize = 1024
+		}
+
+		c.logBodies = make(map[string]struct{}, len(c.LogBodies))
+		for i := 0; i < len(c.LogBodies); i++ {
+			c.logBodies[c.LogBodies[i]] = struct{}{}
+		}
+	}
+
+	if c.CircuitBreaker != nil {
+		cb := c.CircuitBreaker
+		if cb.FailureRate < 0 || cb.FailureRate > 1 || cb.MinCalls < 0 || cb.Window < 0 || cb.Cooldown < 0 || cb.HalfOpenCalls < 0 {
+			return errors.E(op, errors.Str("circuit_breaker: failure_rate should be in range 0..1, the other options should not be negative"))
+		}
+
+		if cb.FailureRate == 0 {
+			cb.FailureRate = 0.5
+		}
+
+		if cb.MinCalls == 0 {
+			cb.MinCalls = 20
+		}
+
+		if cb.Window == 0 {
+			cb.Window = time.Second * 10
+		}
+
+		if cb.Cooldown == 0 {
+			cb.Cooldown = time.Second * 5
+		}
+
+		if cb.HalfOpenCalls == 0 {
+			cb.HalfOpenCalls = 1
+		}
+	}
+
+	if c.MaxConnectionCalls < 0 {
+		return errors.E(op, errors.Errorf("max_connection_calls should not be negative, provided: %d", c.MaxConnectionCalls))
+	}
+
+	if c.Socket != nil && c.Socket.Backlog < 0 {
+		return errors.E(op, errors.Errorf("socket backlog should not be negative, provided: %d", c.Socket.Backlog))
+	}
+
+	if c.MaxConnections < 0 {
+		return errors.E(op, errors.Errorf("max_connections should not be negative, provided: %d", c.MaxConnections))
+	}
+
+	if c.AcceptRate < 0 || c.AcceptBurst < 0 {
+		return errors.E(op, errors.Errorf("accept_rate and accept_burst should not be negative, provided: %v, %d", c.AcceptRate, c.AcceptBurst))
+	}
+
+	if c.QueueSize < 0 {
+		return errors.E(op, errors.Errorf("queue_size should not be negative, provided: %d", c.QueueSize))
+	}
+
+	if c.QueueSize > 0 && c.QueueTimeout == 0 {
+		return errors.E(op, errors.Str("queue_size requires queue_timeout to be set"))
+	}
+
+	c.allowed, err = parseCIDRs(c.IPAllowlist)
+	if err != nil {
+		return errors.E(op, errors.Errorf("ip_allowlist: %v", err))
+	}
+
+	c.denied, err = parseCIDRs(c.IPDenylist)
+	if err != nil {
+		return errors.E(op, errors.Errorf("ip_denylist: %v", err))
+	}
+
 	// used to set max time
 	infinity := time.Duration(math.MaxInt64)
 
+	if c.ProxyProtocolTimeout == 0 {
+		c.ProxyProtocolTimeout = time.Second
+	}
+
 	if c.PingTime == 0 {
 		c.PingTime = time.Hour * 2
 	}
@@ -165,7 +846,111 @@ func (c *Config) InitDefaults() error { //nolint:gocyclo,gocognit
 
 func (c *Config) EnableTLS() bool {
 	if c.TLS != nil {
-		return (c.TLS.RootCA != "" && c.TLS.Key != "" && c.TLS.Cert != "") || (c.TLS.Key != "" && c.TLS.Cert != "")
+		return (c.TLS.RootCA != "" && c.TLS.Key != "" && c.TLS.Cert != "") || (c.TLS.Key != "" && c.TLS.Cert != "") || c.TLS.ExternalCert
 	}
 	return false
 }
+
+// ServiceMetadata returns the configured metadata for the service or the provided default value
+func (c *Config) ServiceMetadata(service string, def string) string {
+	for i := 0; i < len(c.ServicesMetadata); i++ {
+		if c.ServicesMetadata[i].Service == service {
+			return c.ServicesMetadata[i].Metadata
+		}
+	}
+
+	return def
+}
+
+// validate checks that all TLS files exist, readable, and the cert matches the key
+func (t *TLS) validate() error {
+	var problems []string
+
+	switch {
+	case t.ExternalCert && (t.Key != "" || t.Cert != ""):
+		problems = append(problems, "key and cert should not be set with external_cert")
+	case t.ExternalCert:
+	case t.Key == "" && t.Cert == "":
+		problems = append(problems, "key and cert are required")
+	case t.Key == "":
+		problems = append(problems, "key is required when cert is provided")
+	case t.Cert == "":
+		problems = append(problems, "cert is required when key is provided")
+	}
+
+	key, errK := readTLSFile("key", t.Key)
+	if errK != nil {
+		problems = append(problems, errK.Error())
+	}
+
+	cert, errC := readTLSFile("cert", t.Cert)
+	if errC != nil {
+		problems = append(problems, errC.Error())
+	}
+
+	if len(key) > 0 && len(cert) > 0 {
+		if _, err := keyPair(cert, key, t.KeyPassword); err != nil {
+			problems = append(problems, fmt.Sprintf("cert '%s' and key '%s' can't be loaded: %v", t.Cert, t.Key, err))
+		}
+	}
+
+	files, errCA := t.caFiles()
+	if errCA != nil {
+		problems = append(problems, errCA.Error())
+	}
+
+	for i := 0; i < len(files); i++ {
+		if _, err := appendCAFile(x509.NewCertPool(), files[i]); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if t.SessionTicketKeys != "" {
+		if _, err := readTicketKeys(t.SessionTicketKeys); err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid tls configuration: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// expandEnv replaces ${VAR} (or $VAR) in the path with the environment variable value, unset variables are an error
+func expandEnv(path string) (string, error) {
+	var missing []string
+	expanded := os.Expand(path, func(name string) string {
+		val, ok := os.LookupEnv(name)
+		if !ok {
+			missing = append(missing, name)
+		}
+
+		return val
+	})
+
+	if len(missing) > 0 {
+		return "", errors.Errorf("proto path '%s' references unset environment variables: %s", path, strings.Join(missing, ", "))
+	}
+
+	return expanded, nil
+}
+
+// readTLSFile reads the file if the path is provided
+func readTLSFile(name string, path string) ([]byte, error) {
+	if path == "" {
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("%s file '%s' does not exists", name, path)
+		}
+
+		return nil, errors.Errorf("%s file '%s' is not readable: %v", name, path, err)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,107 @@
+package grpc
+
+import (
+	"context"
+	"math"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/stats"
+)
+
+// connection close reasons reported by the connection logger
+const (
+	closeMaxAge  string = "max_connection_age"
+	closeMaxIdle string = "max_connection_idle"
+	// closed by the client, the network or after the keepalive ping timeout
+	closeOther string = "client_or_network"
+)
+
+type connInfoKey struct{}
+
+type connInfo struct {
+	remote string
+	start  time.Time
+	active atomic.Int64
+	// calls in flight counted by the in-flight limit interceptor
+	inflight atomic.Int64
+	// unix nanoseconds of the last call end
+	lastActive atomic.Int64
+}
+
+// connStats tracks the connections (the calls of the connection see the connection info in the context) and
+// optionally logs the connections lifecycle with the peer address and the close reason. gRPC does not report why
+// the connection was closed, so the reason is inferred from the connection age and the time without active calls.
+type connStats struct {
+	logConns bool
+	maxAge   time.Duration
+	maxIdle  time.Duration
+	log      *zap.Logger
+}
+
+func newConnStats(logConns bool, maxAge, maxIdle time.Duration, log *zap.Logger) *connStats {
+	return &connStats{
+		logConns: logConns,
+		maxAge:   maxAge,
+		maxIdle:  maxIdle,
+		log:      log,
+	}
+}
+
+func (c *connStats) TagConn(ctx context.Context, info *stats.ConnTagInfo) context.Context {
+	ci := &connInfo{
+		remote: info.RemoteAddr.String(),
+		start:  time.Now(),
+	}
+	ci.lastActive.Store(ci.start.UnixNano())
+
+	return context.WithValue(ctx, connInfoKey{}, ci)
+}
+
+func (c *connStats) HandleConn(ctx context.Context, s stats.ConnStats) {
+	ci, ok := ctx.Value(connInfoKey{}).(*connInfo)
+	if !ok || !c.logConns {
+		return
+	}
+
+	switch s.(type) {
+	case *stats.ConnBegin:
+		c.log.Info("connection was opened", zap.String("peer", ci.remote))
+	case *stats.ConnEnd:
+		c.log.Info("connection was closed", zap.String("peer", ci.remote), zap.String("reason", c.closeReason(ci, time.Now())), zap.Duration("age", time.Since(ci.start)))
+	}
+}
+
+// TagRPC is called on the context derived from the connection context
+func (c *connStats) TagRPC(ctx context.Context, _ *stats.RPCTagInfo) context.Context {
+	return ctx
+}
+
+func (c *connStats) HandleRPC(ctx context.Context, s stats.RPCStats) {
+	ci, ok := ctx.Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return
+	}
+
+	switch s.(type) {
+	case *stats.Begin:
+		ci.active.Add(1)
+	case *stats.End:
+		ci.lastActive.Store(time.Now().UnixNano())
+		ci.active.Add(-1)
+	}
+}
+
+func (c *connStats) closeReason(ci *connInfo, now time.Time) string {
+	// infinity - the limit is not set, gRPC adds the +/-10% jitter to the age of every connection
+	if c.maxAge != time.Duration(math.MaxInt64) && now.Sub(ci.start) >= c.maxAge-c.maxAge/10 {
+		return closeMaxAge
+	}
+
+	if c.maxIdle != time.Duration(math.MaxInt64) && ci.active.Load() == 0 && now.Sub(time.Unix(0, ci.lastActive.Load())) >= c.maxIdle {
+		return closeMaxIdle
+	}
+
+	return closeOther
+}
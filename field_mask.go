@@ -0,0 +1,131 @@
+package grpc
+
+import (
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/grpc/v3/proxy"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// requestTransforms returns the transforms clearing the masked fields of the requests, the request messages are
+// resolved from the compiled proto files
+func (p *Plugin) requestTransforms() (map[string]proxy.BodyTransform, error) {
+	const op = errors.Op("grpc_plugin_field_masks")
+
+	if len(p.config.FieldMasks) == 0 {
+		return nil, nil
+	}
+
+	files, _, err := p.compileProtos()
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	transforms := make(map[string]proxy.BodyTransform, len(p.config.FieldMasks))
+	for i := 0; i < len(p.config.FieldMasks); i++ {
+		md, err := findMethod(files, p.config.FieldMasks[i].Method)
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+
+		input := md.Input()
+		paths := make([][]protoreflect.FieldDescriptor, 0, len(p.config.FieldMasks[i].Fields))
+		for j := 0; j < len(p.config.FieldMasks[i].Fields); j++ {
+			path, err := fieldPath(input, p.config.FieldMasks[i].Fields[j])
+			if err != nil {
+				return nil, errors.E(op, errors.Errorf("method %s: %v", p.config.FieldMasks[i].Method, err))
+			}
+
+			paths = append(paths, path)
+		}
+
+		transforms[p.config.FieldMasks[i].Method] = maskTransform(input, paths)
+	}
+
+	return transforms, nil
+}
+
+// findMethod returns the method descriptor: /package.Service/Method
+func findMethod(files *protoregistry.Files, method string) (protoreflect.MethodDescriptor, error) {
+	service, name, ok := strings.Cut(strings.TrimPrefix(method, "/"), "/")
+	if !ok {
+		return nil, errors.Errorf("malformed method name: %s", method)
+	}
+
+	d, err := files.FindDescriptorByName(protoreflect.FullName(service))
+	if err != nil {
+		return nil, errors.Errorf("service of the method %s is not found: %v", method, err)
+	}
+
+	sd, ok := d.(protoreflect.ServiceDescriptor)
+	if !ok {
+		return nil, errors.Errorf("%s is not a service", service)
+	}
+
+	md := sd.Methods().ByName(protoreflect.Name(name))
+	if md == nil {
+		return nil, errors.Errorf("method %s is not found", method)
+	}
+
+	return md, nil
+}
+
+// fieldPath resolves the dotted field path (user.email), the fields on the path should be singular messages
+func fieldPath(msg protoreflect.MessageDescriptor, field string) ([]protoreflect.FieldDescriptor, error) {
+	names := strings.Split(field, ".")
+	path := make([]protoreflect.FieldDescriptor, 0, len(names))
+
+	for i := 0; i < len(names); i++ {
+		if msg == nil {
+			return nil, errors.Errorf("field %s: %s is not a message", field, strings.Join(names[:i], "."))
+		}
+
+		fd := msg.Fields().ByName(protoreflect.Name(names[i]))
+		if fd == nil {
+			return nil, errors.Errorf("field %s is not found in %s", field, msg.FullName())
+		}
+
+		path = append(path, fd)
+
+		msg = nil
+		if fd.Message() != nil && !fd.IsList() && !fd.IsMap() {
+			msg = fd.Message()
+		}
+	}
+
+	return path, nil
+}
+
+// maskTransform clears the fields of the request, the unknown fields are kept as is
+func maskTransform(input protoreflect.MessageDescriptor, paths [][]protoreflect.FieldDescriptor) proxy.BodyTransform {
+	return func(body []byte) ([]byte, error) {
+		msg := dynamicpb.NewMessage(input)
+		err := proto.Unmarshal(body, msg)
+		if err != nil {
+			return nil, err
+		}
+
+		for i := 0; i < len(paths); i++ {
+			clearField(msg, paths[i])
+		}
+
+		return proto.Marshal(msg)
+	}
+}
+
+func clearField(msg protoreflect.Message, path []protoreflect.FieldDescriptor) {
+	for i := 0; i < len(path)-1; i++ {
+		// nothing to clear in the unset parent message
+		if !msg.Has(path[i]) {
+			return
+		}
+
+		msg = msg.Get(path[i]).Message()
+	}
+
+	msg.Clear(path[len(path)-1])
+}
@@ -0,0 +1,41 @@
+package grpc
+
+import (
+	"sync"
+
+	"github.com/roadrunner-server/errors"
+
+	// Will register via init
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+// gzipLevel is the level of the gzip compressor registered globally by grpc-go, shared by all plugin instances
+var gzipLevel = &sharedGzipLevel{} //nolint:gochecknoglobals
+
+// sharedGzipLevel remembers the instance which set the level, the clients negotiate the compressor by its name (gzip),
+// so the instances can't use the compressors with the different levels
+type sharedGzipLevel struct {
+	mu    sync.Mutex
+	level int
+	owner string
+}
+
+// set sets the level of the instance, the different level set by another instance is an error
+func (g *sharedGzipLevel) set(instance string, level int) error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.owner != "" && g.owner != instance && g.level != level {
+		return errors.Errorf("gzip_level %d conflicts with gzip_level %d of the %s server: the gzip compressor is shared by all servers", level, g.level, g.owner)
+	}
+
+	err := gzip.SetLevel(level)
+	if err != nil {
+		return err
+	}
+
+	g.level = level
+	g.owner = instance
+
+	return nil
+}
@@ -2,12 +2,16 @@ package grpc
 
 import (
 	"context"
+	"strconv"
 	"sync"
 
+	"github.com/roadrunner-server/sdk/v3/fsm"
+	"github.com/roadrunner-server/sdk/v3/worker"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/status"
 )
 
@@ -19,24 +23,47 @@ type HealthCheckServer struct {
 	shutdown bool
 	updates  map[grpc_health_v1.Health_WatchServer]chan grpc_health_v1.HealthCheckResponse_ServingStatus
 	status   grpc_health_v1.HealthCheckResponse_ServingStatus
+	// closed when the watches of the server's connections should end, see CloseWatches
+	servers map[*grpc.Server]chan struct{}
+}
+
+// serverHealth is the health service registered on one server: the status is shared, the watches end when
+// the server is being stopped
+type serverHealth struct {
+	*HealthCheckServer
+	closed chan struct{}
+}
+
+func (s *serverHealth) Watch(_ *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+	return s.watch(stream, s.closed)
 }
 
 func NewHeathServer(p *Plugin, log *zap.Logger) *HealthCheckServer {
 	return &HealthCheckServer{
 		updates: make(map[grpc_health_v1.Health_WatchServer]chan grpc_health_v1.HealthCheckResponse_ServingStatus, 1),
+		servers: make(map[*grpc.Server]chan struct{}),
 		plugin:  p,
 		log:     log,
 		status:  grpc_health_v1.HealthCheckResponse_NOT_SERVING,
 	}
 }
 
-func (h *HealthCheckServer) Check(_ context.Context, _ *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+func (h *HealthCheckServer) Check(ctx context.Context, _ *grpc_health_v1.HealthCheckRequest) (*grpc_health_v1.HealthCheckResponse, error) {
+	if h.plugin != nil && h.plugin.config.HealthPoolStats {
+		h.setPoolStats(ctx)
+	}
+
 	return &grpc_health_v1.HealthCheckResponse{
 		Status: h.status,
 	}, nil
 }
 
 func (h *HealthCheckServer) Watch(_ *grpc_health_v1.HealthCheckRequest, stream grpc_health_v1.Health_WatchServer) error {
+	return h.watch(stream, nil)
+}
+
+// watch sends the status updates until the stream ends or closed is closed
+func (h *HealthCheckServer) watch(stream grpc_health_v1.Health_WatchServer, closed <-chan struct{}) error {
 	update := make(chan grpc_health_v1.HealthCheckResponse_ServingStatus, 1)
 	h.mu.Lock()
 
@@ -69,6 +96,9 @@ func (h *HealthCheckServer) Watch(_ *grpc_health_v1.HealthCheckRequest, stream g
 			}
 		case <-stream.Context().Done():
 			return status.Error(codes.Canceled, "Stream has ended")
+		case <-closed:
+			// the client watches the status on the other connection
+			return status.Error(codes.Unavailable, "server is stopping")
 		}
 	}
 }
@@ -76,6 +106,7 @@ func (h *HealthCheckServer) Watch(_ *grpc_health_v1.HealthCheckRequest, stream g
 func (h *HealthCheckServer) SetServingStatus(servingStatus grpc_health_v1.HealthCheckResponse_ServingStatus) {
 	h.mu.Lock()
 	if h.shutdown {
+		h.mu.Unlock()
 		h.log.Info("health status changing is ignored, because health service is shutdown")
 		return
 	}
@@ -94,6 +125,47 @@ func (h *HealthCheckServer) SetServingStatus(servingStatus grpc_health_v1.Health
 	h.mu.Unlock()
 }
 
+// setPoolStats sends the workers count in the response headers
+func (h *HealthCheckServer) setPoolStats(ctx context.Context) {
+	// the pool is locked while being reset, the health check should not wait for it
+	if !h.plugin.mu.TryRLock() {
+		return
+	}
+
+	var workers []*worker.Process
+	if h.plugin.gPool != nil {
+		workers = h.plugin.gPool.Workers()
+	}
+	h.plugin.mu.RUnlock()
+
+	ready, busy := 0, 0
+	for i := 0; i < len(workers); i++ {
+		switch {
+		case workers[i].State().Compare(fsm.StateReady):
+			ready++
+		case workers[i].State().Compare(fsm.StateWorking):
+			busy++
+		}
+	}
+
+	err := grpc.SetHeader(ctx, metadata.Pairs(
+		"x-workers-total", strconv.Itoa(len(workers)),
+		"x-workers-ready", strconv.Itoa(ready),
+		"x-workers-busy", strconv.Itoa(busy),
+	))
+	if err != nil {
+		h.log.Debug("failed to send the pool stats", zap.Error(err))
+	}
+}
+
+// ServingStatus returns the current serving status
+func (h *HealthCheckServer) ServingStatus() grpc_health_v1.HealthCheckResponse_ServingStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.status
+}
+
 func (h *HealthCheckServer) Shutdown() {
 	h.mu.Lock()
 	defer h.mu.Unlock()
@@ -109,5 +181,23 @@ func (h *HealthCheckServer) Shutdown() {
 }
 
 func (h *HealthCheckServer) RegisterServer(serv *grpc.Server) {
-	grpc_health_v1.RegisterHealthServer(serv, h)
+	closed := make(chan struct{})
+
+	h.mu.Lock()
+	h.servers[serv] = closed
+	h.mu.Unlock()
+
+	grpc_health_v1.RegisterHealthServer(serv, &serverHealth{HealthCheckServer: h, closed: closed})
+}
+
+// CloseWatches ends the watches of the server's connections, so they don't hold its graceful stop: the clients
+// receive Unavailable and watch the status again on the new connection
+func (h *HealthCheckServer) CloseWatches(serv *grpc.Server) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if closed, ok := h.servers[serv]; ok {
+		close(closed)
+		delete(h.servers, serv)
+	}
 }
@@ -0,0 +1,310 @@
+package grpc
+
+import (
+	"bytes"
+	"crypto/tls"
+	stderr "errors"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	// HTTP/2 client preface starts with PRI, HTTP/1 requests start with the method
+	http2Preface string = "PRI"
+	// protocol detection timeout for the plaintext connections
+	sniffTimeout = 10 * time.Second
+	// readHeaderTimeout of the health HTTP server
+	healthReadHeaderTimeout = 5 * time.Second
+)
+
+// healthMuxListener serves the HTTP/1 health endpoint on the gRPC listener. The protocol is detected by the first
+// bytes: gRPC connections start with the HTTP/2 preface, HTTP/1 ones with the request line. The TLS connections are
+// detected by the ALPN of the ClientHello (gRPC clients always offer h2), the handshake itself is made by the gRPC
+// credentials or by the health HTTP server.
+type healthMuxListener struct {
+	net.Listener
+
+	grpcConns chan net.Conn
+	http      *chanListener
+	server    *http.Server
+	tlsConfig *tls.Config
+	// plaintext HTTP is accepted without TLS or when the plaintext connections are allowed on the TLS port
+	plaintext bool
+	timeout   time.Duration
+	log       *zap.Logger
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	// closed when the accept loop exits, err holds the reason
+	done chan struct{}
+	err  error
+}
+
+func (p *Plugin) newHealthMuxListener(l net.Listener) *healthMuxListener {
+	timeout := sniffTimeout
+	if p.config.EnableTLS() {
+		timeout = p.config.TLS.HandshakeTimeout
+	}
+
+	m := &healthMuxListener{
+		Listener:  l,
+		grpcConns: make(chan net.Conn),
+		http:      newChanListener(l.Addr()),
+		tlsConfig: p.httpTLSConfig,
+		plaintext: !p.config.EnableTLS() || p.config.TLS.AllowPlaintext,
+		timeout:   timeout,
+		log:       p.log,
+		stop:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(p.config.HTTPHealthPath, p.httpHealthHandler)
+	m.server = &http.Server{
+		Handler:           mux,
+		ReadHeaderTimeout: healthReadHeaderTimeout,
+	}
+
+	go func() {
+		err := m.server.Serve(m.http)
+		if err != nil && !stderr.Is(err, http.ErrServerClosed) {
+			m.log.Debug("health http server was stopped", zap.Error(err))
+		}
+	}()
+
+	go m.acceptLoop()
+
+	return m
+}
+
+// httpHealthHandler responds with the readiness status: 200 when the workers are ready, 503 otherwise
+func (p *Plugin) httpHealthHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	st, err := p.Ready()
+	if err != nil || st == nil {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		return
+	}
+
+	w.WriteHeader(st.Code)
+}
+
+func (m *healthMuxListener) acceptLoop() {
+	for {
+		conn, err := m.Listener.Accept()
+		if err != nil {
+			m.err = err
+			close(m.done)
+			return
+		}
+
+		go m.route(conn)
+	}
+}
+
+// route detects the connection protocol and passes it to the gRPC or to the health HTTP server
+func (m *healthMuxListener) route(conn net.Conn) {
+	err := conn.SetReadDeadline(time.Now().Add(m.timeout))
+	if err != nil {
+		_ = conn.Close()
+		return
+	}
+
+	isGRPC, peeked, err := m.sniff(conn)
+	if err != nil {
+		m.log.Debug("failed to detect the connection protocol", zap.String("peer", conn.RemoteAddr().String()), zap.Error(err))
+		_ = conn.Close()
+		return
+	}
+
+	// the servers set their own deadlines
+	_ = conn.SetReadDeadline(time.Time{})
+	pc := &peekedConn{Conn: conn, peeked: peeked}
+
+	if isGRPC {
+		select {
+		case m.grpcConns <- pc:
+		case <-m.stop:
+			_ = conn.Close()
+		}
+
+		return
+	}
+
+	var hc net.Conn = pc
+	switch {
+	case peeked[0] == tlsHandshakeRecord && m.tlsConfig != nil:
+		hc = tls.Server(pc, m.tlsConfig)
+	case peeked[0] != tlsHandshakeRecord && m.plaintext:
+	default:
+		_ = conn.Close()
+		return
+	}
+
+	if !m.http.put(hc) {
+		_ = conn.Close()
+	}
+}
+
+// sniff reads the first bytes of the connection (the ClientHello for the TLS connections), the read bytes are
+// returned to be replayed
+func (m *healthMuxListener) sniff(conn net.Conn) (bool, []byte, error) {
+	buf := &bytes.Buffer{}
+	first := make([]byte, 1)
+	_, err := io.ReadFull(conn, first)
+	if err != nil {
+		return false, nil, err
+	}
+	buf.Write(first)
+
+	if first[0] == tlsHandshakeRecord {
+		protos, errH := clientHelloALPN(io.MultiReader(bytes.NewReader(first), io.TeeReader(conn, buf)))
+		if errH != nil {
+			return false, nil, errH
+		}
+
+		for i := 0; i < len(protos); i++ {
+			if protos[i] == "h2" {
+				return true, buf.Bytes(), nil
+			}
+		}
+
+		return false, buf.Bytes(), nil
+	}
+
+	rest := make([]byte, len(http2Preface)-1)
+	_, err = io.ReadFull(conn, rest)
+	if err != nil {
+		return false, nil, err
+	}
+	buf.Write(rest)
+
+	return buf.String() == http2Preface, buf.Bytes(), nil
+}
+
+// errHelloRead aborts the handshake once the ClientHello was read
+var errHelloRead = errors.Str("client hello was read") //nolint:gochecknoglobals
+
+// clientHelloALPN reads the ClientHello with the TLS server aborted right after the hello was parsed and returns
+// the protocols offered by the client
+func clientHelloALPN(r io.Reader) ([]string, error) {
+	var protos []string
+	conn := &readOnlyConn{r: r}
+	err := tls.Server(conn, &tls.Config{ //nolint:gosec
+		GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+			protos = append(protos, hello.SupportedProtos...)
+			return nil, errHelloRead
+		},
+	}).Handshake()
+
+	if err != nil && !stderr.Is(err, errHelloRead) {
+		return nil, err
+	}
+
+	return protos, nil
+}
+
+// Accept returns the gRPC connections
+func (m *healthMuxListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-m.grpcConns:
+		return conn, nil
+	case <-m.done:
+		return nil, m.err
+	}
+}
+
+func (m *healthMuxListener) Close() error {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+		_ = m.server.Close()
+	})
+
+	return m.Listener.Close()
+}
+
+// readOnlyConn is the connection for the ClientHello parsing, writes are discarded
+type readOnlyConn struct {
+	net.Conn
+	r io.Reader
+}
+
+func (c *readOnlyConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+func (c *readOnlyConn) Write(b []byte) (int, error) {
+	return len(b), nil
+}
+
+func (c *readOnlyConn) Close() error {
+	return nil
+}
+
+func (c *readOnlyConn) SetDeadline(time.Time) error {
+	return nil
+}
+
+func (c *readOnlyConn) SetReadDeadline(time.Time) error {
+	return nil
+}
+
+func (c *readOnlyConn) SetWriteDeadline(time.Time) error {
+	return nil
+}
+
+// chanListener accepts the connections routed to the health HTTP server
+type chanListener struct {
+	addr      net.Addr
+	conns     chan net.Conn
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func newChanListener(addr net.Addr) *chanListener {
+	return &chanListener{
+		addr:   addr,
+		conns:  make(chan net.Conn),
+		closed: make(chan struct{}),
+	}
+}
+
+func (c *chanListener) put(conn net.Conn) bool {
+	select {
+	case c.conns <- conn:
+		return true
+	case <-c.closed:
+		return false
+	}
+}
+
+func (c *chanListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-c.conns:
+		return conn, nil
+	case <-c.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (c *chanListener) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+	})
+
+	return nil
+}
+
+func (c *chanListener) Addr() net.Addr {
+	return c.addr
+}
@@ -0,0 +1,356 @@
+package grpc
+
+import (
+	"context"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/roadrunner-server/grpc/v3/proxy"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	requestIDKey string = "x-request-id"
+	// the final status of the call echoed in the response headers (pseudo-headers can't be sent by the server)
+	statusCodeKey    string = "x-status-code"
+	statusMessageKey string = "x-status-message"
+)
+
+// unaryInterceptors returns the interceptors of the built server, the first one is the outermost
+func (p *Plugin) unaryInterceptors(built *serverBuild) []grpc.UnaryServerInterceptor {
+	interceptors := make([]grpc.UnaryServerInterceptor, 0, 2)
+
+	// the outermost one to echo the statuses of the calls rejected by the other interceptors
+	if p.config.StatusMetadata {
+		interceptors = append(interceptors, statusMetadataInterceptor)
+	}
+
+	// reject the calls from disallowed addresses before anything else
+	if len(p.config.allowed) > 0 || len(p.config.denied) > 0 {
+		interceptors = append(interceptors, p.ipFilterInterceptor)
+	}
+
+	if p.config.EnableTLS() && p.config.TLS.verifyPerCall() {
+		interceptors = append(interceptors, clientCertInterceptor(p.config.TLS.auth, built.clientCertPool))
+	}
+
+	if p.config.EnableTLS() && p.config.TLS.RequireClientAuthEKU {
+		interceptors = append(interceptors, clientEKUInterceptor)
+	}
+
+	if len(p.config.ClientIdentities) > 0 {
+		interceptors = append(interceptors, p.clientIdentityInterceptor())
+	}
+
+	// should be before the logging interceptor to have the id in the logs
+	if p.config.RequestID {
+		interceptors = append(interceptors, requestIDInterceptor)
+	}
+
+	if !p.config.DisableLogInterceptor {
+		interceptors = append(interceptors, p.interceptor)
+	}
+
+	if !p.config.DisableMetricsInterceptor {
+		interceptors = append(interceptors, p.metricsInterceptor)
+	}
+
+	if p.config.ReadinessGate == gateUnavailable {
+		interceptors = append(interceptors, p.readinessInterceptor)
+	}
+
+	// authentication failures are logged and counted as the other failed calls
+	if len(p.authenticators) > 0 {
+		interceptors = append(interceptors, p.authInterceptor)
+	}
+
+	// the queue wait is bounded by the capped deadline as well
+	if p.config.MaxDeadline > 0 {
+		interceptors = append(interceptors, p.maxDeadlineInterceptor)
+	}
+
+	if p.config.MaxConnectionCalls > 0 {
+		interceptors = append(interceptors, p.connCallsInterceptor)
+	}
+
+	if len(p.config.MethodConcurrency) > 0 {
+		interceptors = append(interceptors, p.concurrencyInterceptor())
+	}
+
+	if len(p.config.MethodMaxRecvMsgSize) > 0 {
+		interceptors = append(interceptors, p.msgSizeInterceptor())
+	}
+
+	if len(p.config.ContentTypes) > 0 {
+		interceptors = append(interceptors, p.contentTypeInterceptor())
+	}
+
+	if len(p.config.RequiredMetadata) > 0 {
+		interceptors = append(interceptors, p.requiredMetadataInterceptor())
+	}
+
+	// the response returned by the queued handler is transcoded
+	if len(built.jsonTypes) > 0 {
+		interceptors = append(interceptors, jsonResponseInterceptor(built.jsonTypes))
+	}
+
+	// the calls rejected by the interceptors above should not take the queue place
+	if p.config.QueueTimeout > 0 {
+		// shared by the servers rebuilt with the new proto files
+		if p.queue == nil {
+			p.queue = newWorkerQueue(p.config.GrpcPool.NumWorkers, p.config.QueueSize, p.config.QueueTimeout, p.metrics.queueDepth)
+		}
+
+		interceptors = append(interceptors, p.queue.interceptor)
+	}
+
+	return interceptors
+}
+
+// contentTypeInterceptor rejects calls with content subtypes not declared for the method
+func (p *Plugin) contentTypeInterceptor() grpc.UnaryServerInterceptor {
+	allowed := make(map[string]map[string]struct{}, len(p.config.ContentTypes))
+	for _, ct := range p.config.ContentTypes {
+		allowed[ct.Method] = make(map[string]struct{}, len(ct.ContentTypes))
+		for _, sub := range ct.ContentTypes {
+			allowed[ct.Method][sub] = struct{}{}
+		}
+	}
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		subtypes, ok := allowed[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		sub := proxy.ContentSubtype(ctx)
+		if _, ok = subtypes[sub]; !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "content subtype %s is not supported by the method %s", sub, info.FullMethod)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// requiredMetadataInterceptor rejects the calls without the required metadata keys
+func (p *Plugin) requiredMetadataInterceptor() grpc.UnaryServerInterceptor {
+	var global []*RequiredMetadata
+	methods := make(map[string][]*RequiredMetadata, len(p.config.RequiredMetadata))
+	for _, rm := range p.config.RequiredMetadata {
+		if rm.Method == "" {
+			global = append(global, rm)
+			continue
+		}
+
+		methods[rm.Method] = append(methods[rm.Method], rm)
+	}
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		md, _ := metadata.FromIncomingContext(ctx)
+
+		var missing []string
+		missing = missingMetadata(md, global, missing)
+		missing = missingMetadata(md, methods[info.FullMethod], missing)
+		if len(missing) > 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "required metadata is missing: %s", strings.Join(missing, ", "))
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// missingMetadata appends the required keys missing in the metadata
+func missingMetadata(md metadata.MD, required []*RequiredMetadata, missing []string) []string {
+	for _, rm := range required {
+		for _, key := range rm.Keys {
+			values := md.Get(key)
+			if len(values) == 0 || (rm.NonEmpty && !hasNonEmpty(values)) {
+				missing = append(missing, key)
+			}
+		}
+	}
+
+	return missing
+}
+
+func hasNonEmpty(values []string) bool {
+	for i := 0; i < len(values); i++ {
+		if values[i] != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// concurrencyInterceptor limits the number of concurrent calls per method
+func (p *Plugin) concurrencyInterceptor() grpc.UnaryServerInterceptor {
+	type limiter struct {
+		sem     chan struct{}
+		timeout time.Duration
+	}
+
+	limiters := make(map[string]*limiter, len(p.config.MethodConcurrency))
+	for _, mc := range p.config.MethodConcurrency {
+		limiters[mc.Method] = &limiter{
+			sem:     make(chan struct{}, mc.Limit),
+			timeout: mc.QueueTimeout,
+		}
+	}
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		l, ok := limiters[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		select {
+		case l.sem <- struct{}{}:
+		default:
+			if l.timeout == 0 {
+				return nil, status.Errorf(codes.ResourceExhausted, "concurrency limit (%d) for the method %s exceeded", cap(l.sem), info.FullMethod)
+			}
+
+			timer := time.NewTimer(l.timeout)
+			select {
+			case l.sem <- struct{}{}:
+				timer.Stop()
+			case <-timer.C:
+				return nil, status.Errorf(codes.ResourceExhausted, "concurrency limit (%d) for the method %s exceeded", cap(l.sem), info.FullMethod)
+			case <-ctx.Done():
+				timer.Stop()
+				return nil, status.FromContextError(ctx.Err()).Err()
+			}
+		}
+
+		// released even if the handler panics
+		defer func() {
+			<-l.sem
+		}()
+
+		return handler(ctx, req)
+	}
+}
+
+// connCallsInterceptor limits the number of the calls in flight per connection, the connection is tracked by the
+// stats handler
+func (p *Plugin) connCallsInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	ci, ok := ctx.Value(connInfoKey{}).(*connInfo)
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	defer ci.inflight.Add(-1)
+	if ci.inflight.Add(1) > int64(p.config.MaxConnectionCalls) {
+		return nil, status.Errorf(codes.ResourceExhausted, "calls in flight limit (%d) per connection exceeded, method %s", p.config.MaxConnectionCalls, info.FullMethod)
+	}
+
+	return handler(ctx, req)
+}
+
+// maxDeadlineInterceptor replaces the missing deadline and the deadline later than max_deadline with now + max_deadline
+func (p *Plugin) maxDeadlineInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	capped := time.Now().Add(p.config.MaxDeadline)
+
+	deadline, ok := ctx.Deadline()
+	if ok && !deadline.After(capped) {
+		return handler(ctx, req)
+	}
+
+	if ok {
+		p.log.Info("call deadline was capped", zap.String("method", info.FullMethod), zap.Duration("requested", time.Until(deadline)), zap.Duration("max_deadline", p.config.MaxDeadline))
+	} else {
+		// most of the clients don't set the deadline
+		p.log.Debug("call without deadline was capped", zap.String("method", info.FullMethod), zap.Duration("max_deadline", p.config.MaxDeadline))
+	}
+
+	ctx, cancel := context.WithDeadline(ctx, capped)
+	defer cancel()
+
+	if !ok {
+		// the worker sees the grpc-timeout header only when the client sent it
+		ctx = proxy.WithServerDeadline(ctx)
+	}
+
+	return handler(ctx, req)
+}
+
+// msgSizeInterceptor rejects requests greater than the method's limit before they are sent to the worker
+func (p *Plugin) msgSizeInterceptor() grpc.UnaryServerInterceptor {
+	limits := make(map[string]int, len(p.config.MethodMaxRecvMsgSize))
+	for _, ms := range p.config.MethodMaxRecvMsgSize {
+		limits[ms.Method] = ms.MaxSize
+	}
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		limit, ok := limits[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		if in, ok := messageBytes(req); ok && len(in) > limit {
+			return nil, status.Errorf(codes.ResourceExhausted, "request size (%d) of the method %s exceeds the limit (%d)", len(in), info.FullMethod, limit)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// statusMetadataInterceptor echoes the status code and the percent-encoded message in the response headers for the
+// clients reading only the headers. The headers of the failed calls are sent before the status, so they are not
+// merged into the trailers.
+func statusMetadataInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	resp, err := handler(ctx, req)
+
+	st := status.Convert(err)
+	md := metadata.Pairs(statusCodeKey, strconv.Itoa(int(st.Code())))
+	if st.Message() != "" {
+		md.Set(statusMessageKey, url.PathEscape(st.Message()))
+	}
+
+	if err != nil {
+		// error is possible when the headers were already sent (e.g. by the worker metadata), nothing to echo then
+		_ = grpc.SendHeader(ctx, md)
+		return resp, err
+	}
+
+	_ = grpc.SetHeader(ctx, md)
+	return resp, nil
+}
+
+// requestIDInterceptor reuses the x-request-id provided by the client or generates a new one. The id is added to the
+// incoming metadata (and forwarded to the worker) and sent back in the response headers.
+func requestIDInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		md = metadata.MD{}
+	}
+
+	if len(md.Get(requestIDKey)) == 0 || md.Get(requestIDKey)[0] == "" {
+		md = md.Copy()
+		md.Set(requestIDKey, uuid.NewString())
+		ctx = metadata.NewIncomingContext(ctx, md)
+	}
+
+	// error is possible only when there is no server stream in the context
+	_ = grpc.SetHeader(ctx, metadata.Pairs(requestIDKey, md.Get(requestIDKey)[0]))
+
+	return handler(ctx, req)
+}
+
+// requestID returns the request id from the incoming metadata
+func requestID(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(requestIDKey)) == 0 {
+		return ""
+	}
+
+	return md.Get(requestIDKey)[0]
+}
@@ -0,0 +1,75 @@
+package grpc
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roadrunner-server/grpc/v3/codec"
+	"github.com/roadrunner-server/grpc/v3/proxy"
+	"github.com/roadrunner-server/grpc/v3/proxy/proxytest"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestMaxDeadlineGrpcTimeout(t *testing.T) {
+	p := &Plugin{config: &Config{MaxDeadline: 10 * time.Second}, log: zap.NewNop()}
+
+	tests := []struct {
+		name string
+		// client deadline, 0 - not sent
+		timeout time.Duration
+		// max forwarded timeout, 0 - not forwarded
+		forwarded time.Duration
+	}{
+		{name: "no client deadline", timeout: 0},
+		{name: "client deadline", timeout: time.Second, forwarded: time.Second},
+		{name: "capped client deadline", timeout: time.Minute, forwarded: 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := proxytest.NewPool(proxytest.Reply([]byte("ok"), nil))
+			px := proxy.NewProxy("app.Service", "", pool, &sync.RWMutex{}, nil)
+			px.RegisterMethod("Method")
+
+			ctx := context.Background()
+			if tt.timeout > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.timeout)
+				defer cancel()
+			}
+
+			ctx, _ = proxytest.NewContext(ctx, "/app.Service/Method")
+			dec := func(in any) error {
+				*in.(*codec.RawMessage) = codec.RawMessage{}
+				return nil
+			}
+
+			_, err := px.ServiceDesc().Methods[0].Handler(nil, ctx, dec, p.maxDeadlineInterceptor)
+			require.NoError(t, err)
+
+			rc := struct {
+				Context map[string][]string `json:"context"`
+			}{}
+			require.NoError(t, json.Unmarshal(pool.Last().Context, &rc))
+
+			if tt.forwarded == 0 {
+				require.NotContains(t, rc.Context, "grpc-timeout")
+				return
+			}
+
+			require.Len(t, rc.Context["grpc-timeout"], 1)
+			timeout := rc.Context["grpc-timeout"][0]
+			require.Equal(t, "u", timeout[len(timeout)-1:])
+
+			us, err := strconv.ParseInt(timeout[:len(timeout)-1], 10, 64)
+			require.NoError(t, err)
+			require.LessOrEqual(t, time.Duration(us)*time.Microsecond, tt.forwarded)
+			require.Greater(t, time.Duration(us)*time.Microsecond, tt.forwarded-time.Second)
+		})
+	}
+}
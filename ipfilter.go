@@ -0,0 +1,91 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// parseCIDRs parses the list of CIDR ranges, single IP addresses are treated as /32 (IPv4) or /128 (IPv6) ranges
+func parseCIDRs(list []string) ([]*net.IPNet, error) {
+	nets := make([]*net.IPNet, 0, len(list))
+	for _, cidr := range list {
+		cidr = strings.TrimSpace(cidr)
+		if !strings.Contains(cidr, "/") {
+			ip := net.ParseIP(cidr)
+			if ip == nil {
+				return nil, errors.Errorf("invalid IP address: %s", cidr)
+			}
+
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+
+			nets = append(nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, ipNet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		nets = append(nets, ipNet)
+	}
+
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, n := range nets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// peerIP returns the client IP address, it is the address from the PROXY protocol header when it is enabled
+func peerIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.TCPAddr:
+		return a.IP
+	case *net.UDPAddr:
+		return a.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return net.ParseIP(addr.String())
+		}
+
+		return net.ParseIP(host)
+	}
+}
+
+// ipFilterInterceptor rejects the calls from the denied addresses or from the addresses not in the allowlist
+func (p *Plugin) ipFilterInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	pr, ok := peer.FromContext(ctx)
+	if !ok || pr.Addr == nil {
+		return nil, status.Error(codes.PermissionDenied, "client address is unknown")
+	}
+
+	ip := peerIP(pr.Addr)
+	if ip == nil {
+		return nil, status.Errorf(codes.PermissionDenied, "client address %s is not allowed", pr.Addr.String())
+	}
+
+	if containsIP(p.config.denied, ip) || (len(p.config.allowed) > 0 && !containsIP(p.config.allowed, ip)) {
+		return nil, status.Errorf(codes.PermissionDenied, "client address %s is not allowed", ip.String())
+	}
+
+	return handler(ctx, req)
+}
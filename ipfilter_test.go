@@ -0,0 +1,118 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseCIDRs(t *testing.T) {
+	tests := []struct {
+		name     string
+		cidr     string
+		contains []string
+		excludes []string
+		err      bool
+	}{
+		{name: "ipv4 range", cidr: "10.0.0.0/8", contains: []string{"10.1.2.3", "::ffff:10.0.0.1"}, excludes: []string{"11.0.0.1", "::1"}},
+		{name: "ipv6 range", cidr: "2001:db8::/32", contains: []string{"2001:db8::1"}, excludes: []string{"2001:db9::1", "10.0.0.1"}},
+		{name: "bare ipv4", cidr: " 192.168.1.10 ", contains: []string{"192.168.1.10"}, excludes: []string{"192.168.1.11"}},
+		{name: "bare ipv6", cidr: "::1", contains: []string{"::1"}, excludes: []string{"::2", "127.0.0.1"}},
+		{name: "invalid ip", cidr: "10.0.0", err: true},
+		{name: "invalid cidr", cidr: "10.0.0.0/33", err: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nets, err := parseCIDRs([]string{tt.cidr})
+			if tt.err {
+				require.Error(t, err)
+				return
+			}
+
+			require.NoError(t, err)
+			for _, ip := range tt.contains {
+				require.True(t, containsIP(nets, net.ParseIP(ip)), ip)
+			}
+
+			for _, ip := range tt.excludes {
+				require.False(t, containsIP(nets, net.ParseIP(ip)), ip)
+			}
+		})
+	}
+}
+
+type testAddr string
+
+func (a testAddr) Network() string { return "test" }
+func (a testAddr) String() string  { return string(a) }
+
+func TestPeerIP(t *testing.T) {
+	tests := []struct {
+		name string
+		addr net.Addr
+		ip   string
+	}{
+		{name: "tcp ipv4", addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 5000}, ip: "10.0.0.1"},
+		{name: "tcp ipv6", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 5000}, ip: "2001:db8::1"},
+		{name: "udp", addr: &net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 5000}, ip: "10.0.0.2"},
+		{name: "host and port", addr: testAddr("10.0.0.3:5000"), ip: "10.0.0.3"},
+		{name: "ipv6 host and port", addr: testAddr("[2001:db8::3]:5000"), ip: "2001:db8::3"},
+		{name: "bare ip", addr: testAddr("10.0.0.4"), ip: "10.0.0.4"},
+		{name: "bare ipv6", addr: testAddr("2001:db8::4"), ip: "2001:db8::4"},
+		{name: "unix socket", addr: &net.UnixAddr{Name: "/tmp/rr.sock", Net: "unix"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ip := peerIP(tt.addr)
+			if tt.ip == "" {
+				require.Nil(t, ip)
+				return
+			}
+
+			require.True(t, net.ParseIP(tt.ip).Equal(ip), ip.String())
+		})
+	}
+}
+
+func TestIPFilterInterceptor(t *testing.T) {
+	allowed, err := parseCIDRs([]string{"10.0.0.0/8", "2001:db8::/32"})
+	require.NoError(t, err)
+	denied, err := parseCIDRs([]string{"10.0.0.13"})
+	require.NoError(t, err)
+
+	p := &Plugin{config: &Config{allowed: allowed, denied: denied}}
+	handler := func(context.Context, any) (any, error) {
+		return "ok", nil
+	}
+
+	tests := []struct {
+		name string
+		addr net.Addr
+		code codes.Code
+	}{
+		{name: "allowed", addr: &net.TCPAddr{IP: net.ParseIP("10.1.1.1")}, code: codes.OK},
+		{name: "allowed ipv6", addr: &net.TCPAddr{IP: net.ParseIP("2001:db8::1")}, code: codes.OK},
+		{name: "denied", addr: &net.TCPAddr{IP: net.ParseIP("10.0.0.13")}, code: codes.PermissionDenied},
+		{name: "not allowed", addr: &net.TCPAddr{IP: net.ParseIP("192.168.0.1")}, code: codes.PermissionDenied},
+		{name: "unknown address", addr: &net.UnixAddr{Name: "/tmp/rr.sock", Net: "unix"}, code: codes.PermissionDenied},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := peer.NewContext(context.Background(), &peer.Peer{Addr: tt.addr})
+			_, err := p.ipFilterInterceptor(ctx, nil, &grpc.UnaryServerInfo{FullMethod: "/app.Service/Method"}, handler)
+			require.Equal(t, tt.code, status.Code(err))
+		})
+	}
+
+	_, err = p.ipFilterInterceptor(context.Background(), nil, &grpc.UnaryServerInfo{FullMethod: "/app.Service/Method"}, handler)
+	require.Equal(t, codes.PermissionDenied, status.Code(err))
+}
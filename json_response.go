@@ -0,0 +1,108 @@
+package grpc
+
+import (
+	"context"
+	"mime"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/grpc/v3/codec"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+const (
+	acceptKey string = "accept"
+	jsonMIME  string = "application/json"
+)
+
+// jsonResponseTypes returns the response message descriptors of the json_responses methods, resolved from the
+// compiled proto files
+func (p *Plugin) jsonResponseTypes() (map[string]protoreflect.MessageDescriptor, error) {
+	const op = errors.Op("grpc_plugin_json_responses")
+
+	if len(p.config.JSONResponses) == 0 {
+		return nil, nil
+	}
+
+	files, _, err := p.compileProtos()
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	types := make(map[string]protoreflect.MessageDescriptor, len(p.config.JSONResponses))
+	for i := 0; i < len(p.config.JSONResponses); i++ {
+		md, err := findMethod(files, p.config.JSONResponses[i])
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+
+		types[p.config.JSONResponses[i]] = md.Output()
+	}
+
+	return types, nil
+}
+
+// jsonResponseInterceptor transcodes the protobuf response of the method to JSON when the client accepts
+// application/json (accept metadata), the gRPC framing and the content type of the response are not changed
+func jsonResponseInterceptor(types map[string]protoreflect.MessageDescriptor) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		output, ok := types[info.FullMethod]
+		if !ok || !acceptsJSON(ctx) {
+			return handler(ctx, req)
+		}
+
+		resp, err := handler(ctx, req)
+		if err != nil {
+			return resp, err
+		}
+
+		// already decoded with the proto codec
+		msg, ok := resp.(proto.Message)
+		if !ok {
+			body, isRaw := resp.(codec.RawMessage)
+			if !isRaw {
+				return resp, nil
+			}
+
+			msg = dynamicpb.NewMessage(output)
+			err = proto.Unmarshal(body, msg)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "response transcoding failed: %v", err)
+			}
+		}
+
+		data, err := protojson.Marshal(msg)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "response transcoding failed: %v", err)
+		}
+
+		return codec.RawMessage(data), nil
+	}
+}
+
+// acceptsJSON reports whether the accept metadata contains application/json
+func acceptsJSON(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+
+	values := md.Get(acceptKey)
+	for i := 0; i < len(values); i++ {
+		for _, accepted := range strings.Split(values[i], ",") {
+			mediaType, _, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+			if err == nil && mediaType == jsonMIME {
+				return true
+			}
+		}
+	}
+
+	return false
+}
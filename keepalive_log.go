@@ -0,0 +1,197 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"sync/atomic"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+)
+
+// HTTP/2 framing used to find the keepalive pings
+const (
+	clientPrefaceLen int  = 24
+	frameHeaderLen   int  = 9
+	framePing        byte = 0x6
+	flagPingAck      byte = 0x1
+	pingDataLen      int  = 8
+)
+
+// pingLogCreds logs the keepalive pings of the connections. gRPC does not report the keepalive pings (stats handlers
+// see only the connections and the calls), so the HTTP/2 frames of the connection are scanned after the handshake.
+// The keepalive pings are the pings with the zero data, gRPC uses the fixed non-zero data for the BDP and GOAWAY pings.
+// Nil credentials - plaintext connections.
+type pingLogCreds struct {
+	credentials.TransportCredentials
+	log *zap.Logger
+}
+
+func newPingLogCreds(creds credentials.TransportCredentials, log *zap.Logger) credentials.TransportCredentials {
+	return &pingLogCreds{
+		TransportCredentials: creds,
+		log:                  log,
+	}
+}
+
+func (p *pingLogCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	var info credentials.AuthInfo
+	c := conn
+	if p.TransportCredentials != nil {
+		var err error
+		c, info, err = p.TransportCredentials.ServerHandshake(conn)
+		if err != nil {
+			return c, info, err
+		}
+	}
+
+	return &pingLogConn{
+		Conn: c,
+		log:  p.log,
+		peer: conn.RemoteAddr().String(),
+		in:   frameScanner{skip: clientPrefaceLen},
+	}, info, nil
+}
+
+func (p *pingLogCreds) Info() credentials.ProtocolInfo {
+	if p.TransportCredentials == nil {
+		return credentials.ProtocolInfo{}
+	}
+
+	return p.TransportCredentials.Info()
+}
+
+func (p *pingLogCreds) Clone() credentials.TransportCredentials {
+	var creds credentials.TransportCredentials
+	if p.TransportCredentials != nil {
+		creds = p.TransportCredentials.Clone()
+	}
+
+	return &pingLogCreds{
+		TransportCredentials: creds,
+		log:                  p.log,
+	}
+}
+
+func (p *pingLogCreds) ClientHandshake(_ context.Context, _ string, _ net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.Str("ping log credentials can be used only on the server side")
+}
+
+// pingLogConn logs the keepalive pings sent by the server, the acks of the client and the connections closed
+// while the ping was not acknowledged (ping_timeout, usually dropped by a middlebox)
+type pingLogConn struct {
+	net.Conn
+	log  *zap.Logger
+	peer string
+	// gRPC reads and writes the connection from a single goroutine each
+	in  frameScanner
+	out frameScanner
+	// unix nanoseconds of the last keepalive ping, 0 - acknowledged
+	pingSent atomic.Int64
+}
+
+func (c *pingLogConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.in.scan(b[:n], c.received)
+	return n, err
+}
+
+func (c *pingLogConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.out.scan(b[:n], c.sent)
+	return n, err
+}
+
+func (c *pingLogConn) Close() error {
+	if sent := c.pingSent.Swap(0); sent != 0 {
+		c.log.Info("connection was closed without the keepalive ping ack", zap.String("peer", c.peer), zap.Duration("waited", time.Since(time.Unix(0, sent))))
+	}
+
+	return c.Conn.Close()
+}
+
+func (c *pingLogConn) sent(ack bool) {
+	// acks of the client pings
+	if ack {
+		return
+	}
+
+	c.pingSent.Store(time.Now().UnixNano())
+	c.log.Info("keepalive ping was sent", zap.String("peer", c.peer))
+}
+
+func (c *pingLogConn) received(ack bool) {
+	// client keepalive pings
+	if !ack {
+		return
+	}
+
+	if sent := c.pingSent.Swap(0); sent != 0 {
+		c.log.Debug("keepalive ping was acknowledged", zap.String("peer", c.peer), zap.Duration("rtt", time.Since(time.Unix(0, sent))))
+	}
+}
+
+// frameScanner finds the keepalive pings in the HTTP/2 frames stream split into chunks of any size
+type frameScanner struct {
+	// bytes of the client preface left
+	skip   int
+	header [frameHeaderLen]byte
+	hn     int
+	// bytes of the current frame payload left
+	payload int
+	ping    bool
+	data    [pingDataLen]byte
+	dn      int
+}
+
+// scan calls onPing with the ack flag for every ping frame with the zero data
+func (s *frameScanner) scan(b []byte, onPing func(ack bool)) {
+	for len(b) > 0 {
+		switch {
+		case s.skip > 0:
+			n := s.skip
+			if n > len(b) {
+				n = len(b)
+			}
+
+			s.skip -= n
+			b = b[n:]
+		case s.hn < frameHeaderLen:
+			n := copy(s.header[s.hn:], b)
+			s.hn += n
+			b = b[n:]
+
+			if s.hn == frameHeaderLen {
+				s.payload = int(s.header[0])<<16 | int(s.header[1])<<8 | int(s.header[2])
+				s.ping = s.header[3] == framePing && s.payload == pingDataLen
+				s.dn = 0
+				if s.payload == 0 {
+					s.hn = 0
+				}
+			}
+		default:
+			n := s.payload
+			if n > len(b) {
+				n = len(b)
+			}
+
+			if s.ping {
+				s.dn += copy(s.data[s.dn:], b[:n])
+			}
+
+			s.payload -= n
+			b = b[n:]
+
+			if s.payload > 0 {
+				continue
+			}
+
+			s.hn = 0
+			if s.ping && s.data == [pingDataLen]byte{} {
+				onPing(s.header[4]&flagPingAck != 0)
+			}
+		}
+	}
+}
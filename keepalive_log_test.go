@@ -0,0 +1,46 @@
+package grpc
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/http2"
+)
+
+func TestFrameScanner(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(http2.ClientPreface)
+
+	fr := http2.NewFramer(&buf, nil)
+	require.NoError(t, fr.WriteSettings())
+	require.NoError(t, fr.WritePing(false, [8]byte{}))
+	require.NoError(t, fr.WriteData(1, false, make([]byte, 100)))
+	// BDP ping
+	require.NoError(t, fr.WritePing(false, [8]byte{2, 4, 16, 16, 9, 14, 7, 7}))
+	require.NoError(t, fr.WriteSettingsAck())
+	require.NoError(t, fr.WritePing(true, [8]byte{}))
+	// the ping data inside of the data frame
+	require.NoError(t, fr.WriteData(1, true, []byte{0, 0, 8, framePing, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}))
+
+	stream := buf.Bytes()
+
+	for _, chunk := range []int{1, 5, 9, 17, len(stream)} {
+		s := frameScanner{skip: clientPrefaceLen}
+
+		var pings []bool
+		for b := stream; len(b) > 0; {
+			n := chunk
+			if n > len(b) {
+				n = len(b)
+			}
+
+			s.scan(b[:n], func(ack bool) {
+				pings = append(pings, ack)
+			})
+			b = b[n:]
+		}
+
+		require.Equal(t, []bool{false, true}, pings, chunk)
+	}
+}
@@ -0,0 +1,113 @@
+package grpc
+
+import (
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// max number of samples kept per method during the interval, reservoir sampling is used after that
+const maxLatencySamples int = 10000
+
+// latencyAggregator collects the calls' latencies and periodically logs the per-method summary
+type latencyAggregator struct {
+	mu      sync.Mutex
+	methods map[string]*latencyWindow
+	log     *zap.Logger
+	stopCh  chan struct{}
+}
+
+type latencyWindow struct {
+	count   uint64
+	samples []time.Duration
+}
+
+func newLatencyAggregator(log *zap.Logger) *latencyAggregator {
+	return &latencyAggregator{
+		methods: make(map[string]*latencyWindow),
+		log:     log,
+		stopCh:  make(chan struct{}),
+	}
+}
+
+func (l *latencyAggregator) record(method string, elapsed time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	w, ok := l.methods[method]
+	if !ok {
+		w = &latencyWindow{samples: make([]time.Duration, 0, 16)}
+		l.methods[method] = w
+	}
+
+	w.count++
+	if len(w.samples) < maxLatencySamples {
+		w.samples = append(w.samples, elapsed)
+		return
+	}
+
+	// replace a random sample with decreasing probability to keep the sample uniform
+	if i := rand.Int63n(int64(w.count)); i < int64(maxLatencySamples) { //nolint:gosec
+		w.samples[i] = elapsed
+	}
+}
+
+// start logs the summary every interval until stop is called
+func (l *latencyAggregator) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				l.flush(interval)
+			case <-l.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (l *latencyAggregator) stop() {
+	close(l.stopCh)
+}
+
+func (l *latencyAggregator) flush(interval time.Duration) {
+	l.mu.Lock()
+	methods := l.methods
+	l.methods = make(map[string]*latencyWindow, len(methods))
+	l.mu.Unlock()
+
+	for method, w := range methods {
+		sort.Slice(w.samples, func(i, j int) bool {
+			return w.samples[i] < w.samples[j]
+		})
+
+		l.log.Info("method latency summary",
+			zap.String("method", method),
+			zap.Duration("interval", interval),
+			zap.Uint64("calls", w.count),
+			zap.Duration("p50", percentile(w.samples, 50)),
+			zap.Duration("p95", percentile(w.samples, 95)),
+			zap.Duration("p99", percentile(w.samples, 99)),
+		)
+	}
+}
+
+// percentile returns the nearest-rank percentile of the sorted samples
+func percentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+
+	return sorted[rank-1]
+}
@@ -0,0 +1,374 @@
+package grpc
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/pires/go-proxyproto"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+// listen creates the plugin's listener, the wrappers are applied in order: accept rate limit, max connections,
+// PROXY protocol, idle timeout, HTTP health endpoint
+func (p *Plugin) listen() (*handoffListener, error) {
+	l, err := p.createListener()
+	if err != nil {
+		return nil, err
+	}
+
+	if p.config.AcceptRate > 0 {
+		l = newRateLimitListener(l, p.config.AcceptRate, p.config.AcceptBurst, p.metrics.connAccepted, p.metrics.connRejected)
+	}
+
+	if p.config.MaxConnections > 0 {
+		l = newMaxConnListener(l, p.config.MaxConnections, p.metrics.connLimited, p.log)
+	}
+
+	if p.config.ProxyProtocol {
+		l = &proxyproto.Listener{
+			Listener: l,
+			// fail closed, connections without the header are rejected
+			Policy: func(net.Addr) (proxyproto.Policy, error) {
+				return proxyproto.REQUIRE, nil
+			},
+			ReadHeaderTimeout: p.config.ProxyProtocolTimeout,
+		}
+	}
+
+	if p.config.IdleTimeout > 0 {
+		if p.config.PingTime >= p.config.IdleTimeout {
+			p.log.Warn("ping_time is greater than idle_timeout, connections with active but silent calls will be closed", zap.Duration("ping_time", p.config.PingTime), zap.Duration("idle_timeout", p.config.IdleTimeout))
+		}
+
+		l = newIdleTimeoutListener(l, p.config.IdleTimeout)
+	}
+
+	if p.config.HTTPHealthPath != "" {
+		l = p.newHealthMuxListener(l)
+	}
+
+	return newHandoffListener(l), nil
+}
+
+// handoffListener accepts connections on the underlying listener and hands them off to the currently
+// serving gRPC server. It allows replacing the gRPC server without closing the listening socket.
+type handoffListener struct {
+	net.Listener
+
+	conns chan net.Conn
+	// closed by Close
+	stop     chan struct{}
+	stopOnce sync.Once
+	// closed when the accept loop exits, err holds the reason
+	done chan struct{}
+	err  error
+}
+
+func newHandoffListener(l net.Listener) *handoffListener {
+	h := &handoffListener{
+		Listener: l,
+		conns:    make(chan net.Conn),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+
+	go h.acceptLoop()
+
+	return h
+}
+
+func (h *handoffListener) acceptLoop() {
+	var tempDelay time.Duration
+
+	for {
+		conn, err := h.Listener.Accept()
+		if err != nil {
+			// retry on temporary errors (e.g. too many open files) the same way the gRPC server does
+			if ne, ok := err.(interface{ Temporary() bool }); ok && ne.Temporary() { //nolint:errorlint
+				if tempDelay == 0 {
+					tempDelay = 5 * time.Millisecond
+				} else {
+					tempDelay *= 2
+				}
+
+				if tempDelay > time.Second {
+					tempDelay = time.Second
+				}
+
+				select {
+				case <-time.After(tempDelay):
+					continue
+				case <-h.stop:
+				}
+			}
+
+			h.err = err
+			close(h.done)
+			return
+		}
+
+		tempDelay = 0
+
+		select {
+		case h.conns <- conn:
+		case <-h.stop:
+			_ = conn.Close()
+		}
+	}
+}
+
+// Close closes the underlying listener, all servers' listeners stop accepting connections.
+func (h *handoffListener) Close() error {
+	h.stopOnce.Do(func() {
+		close(h.stop)
+	})
+
+	return h.Listener.Close()
+}
+
+// serverListener returns a listener for the particular gRPC server. Closing it (which is done by the gRPC server
+// on Stop/GracefulStop and by the plugin before the server is replaced) does not affect the underlying listener.
+func (h *handoffListener) serverListener() *serverListener {
+	return &serverListener{
+		h:      h,
+		closed: make(chan struct{}),
+		served: make(chan struct{}),
+	}
+}
+
+// handBack returns the connection taken by the closed server listener to the next server
+func (h *handoffListener) handBack(conn net.Conn) {
+	select {
+	case h.conns <- conn:
+	case <-h.stop:
+		_ = conn.Close()
+	}
+}
+
+type serverListener struct {
+	h      *handoffListener
+	closed chan struct{}
+	once   sync.Once
+	// closed when the server stopped accepting the connections (Serve returned)
+	served chan struct{}
+}
+
+func (s *serverListener) Accept() (net.Conn, error) {
+	select {
+	case <-s.closed:
+		return nil, net.ErrClosed
+	default:
+	}
+
+	select {
+	case conn := <-s.h.conns:
+		select {
+		case <-s.closed:
+			// the server is being replaced and would close the connection
+			go s.h.handBack(conn)
+			return nil, net.ErrClosed
+		default:
+			return conn, nil
+		}
+	case <-s.h.done:
+		return nil, s.h.err
+	case <-s.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (s *serverListener) Close() error {
+	s.once.Do(func() {
+		close(s.closed)
+	})
+
+	return nil
+}
+
+func (s *serverListener) isClosed() bool {
+	select {
+	case <-s.closed:
+		return true
+	default:
+		return false
+	}
+}
+
+func (s *serverListener) Addr() net.Addr {
+	return s.h.Addr()
+}
+
+// idleTimeoutListener closes the connections which did not receive any data during the timeout
+type idleTimeoutListener struct {
+	net.Listener
+	timeout time.Duration
+}
+
+func newIdleTimeoutListener(l net.Listener, timeout time.Duration) net.Listener {
+	return &idleTimeoutListener{
+		Listener: l,
+		timeout:  timeout,
+	}
+}
+
+func (l *idleTimeoutListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	return &idleTimeoutConn{Conn: conn, timeout: l.timeout}, nil
+}
+
+type idleTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleTimeoutConn) Read(b []byte) (int, error) {
+	err := c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	if err != nil {
+		return 0, err
+	}
+
+	return c.Conn.Read(b)
+}
+
+// interval between the logs about the rejected connections
+const rejectLogInterval = time.Second * 10
+
+// maxConnListener closes the connections accepted above the limit of the simultaneously open connections
+type maxConnListener struct {
+	net.Listener
+
+	limit  int64
+	active atomic.Int64
+
+	rejected prometheus.Counter
+	// rejections since the last log
+	notLogged atomic.Int64
+	lastLog   atomic.Int64
+	log       *zap.Logger
+}
+
+func newMaxConnListener(l net.Listener, limit int, rejected prometheus.Counter, log *zap.Logger) net.Listener {
+	return &maxConnListener{
+		Listener: l,
+		limit:    int64(limit),
+		rejected: rejected,
+		log:      log,
+	}
+}
+
+func (l *maxConnListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.active.Add(1) <= l.limit {
+			return &limitedConn{Conn: conn, release: func() { l.active.Add(-1) }}, nil
+		}
+
+		l.active.Add(-1)
+		l.rejected.Inc()
+		_ = conn.Close()
+		l.logRejected()
+	}
+}
+
+// logRejected logs the number of the rejected connections at most once per interval to avoid the log floods
+func (l *maxConnListener) logRejected() {
+	l.notLogged.Add(1)
+
+	now := time.Now().UnixNano()
+	last := l.lastLog.Load()
+	if now-last < int64(rejectLogInterval) || !l.lastLog.CompareAndSwap(last, now) {
+		return
+	}
+
+	l.log.Warn("max connections limit reached, connections were rejected", zap.Int64("limit", l.limit), zap.Int64("rejected", l.notLogged.Swap(0)))
+}
+
+// limitedConn releases the connection slot once on Close
+type limitedConn struct {
+	net.Conn
+	once    sync.Once
+	release func()
+}
+
+func (c *limitedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// rateLimitListener closes the connections accepted above the rate (token bucket) right away, before the PROXY
+// protocol header is read and the TLS handshake is made, so a connections flood doesn't consume the CPU.
+type rateLimitListener struct {
+	net.Listener
+
+	mu     sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	accepted prometheus.Counter
+	rejected prometheus.Counter
+}
+
+func newRateLimitListener(l net.Listener, rate float64, burst int, accepted, rejected prometheus.Counter) net.Listener {
+	if burst < 1 {
+		burst = 1
+	}
+
+	return &rateLimitListener{
+		Listener: l,
+		rate:     rate,
+		burst:    float64(burst),
+		tokens:   float64(burst),
+		last:     time.Now(),
+		accepted: accepted,
+		rejected: rejected,
+	}
+}
+
+func (l *rateLimitListener) Accept() (net.Conn, error) {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+
+		if l.allow(time.Now()) {
+			l.accepted.Inc()
+			return conn, nil
+		}
+
+		l.rejected.Inc()
+		_ = conn.Close()
+	}
+}
+
+// allow takes a token if available, tokens are refilled with the rate up to the burst
+func (l *rateLimitListener) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+
+	if l.tokens < 1 {
+		return false
+	}
+
+	l.tokens--
+	return true
+}
@@ -0,0 +1,225 @@
+package grpc
+
+import (
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+// testListener returns the queued connections, net.ErrClosed when the queue is closed
+type testListener struct {
+	conns chan net.Conn
+}
+
+func newTestListener(conns ...net.Conn) *testListener {
+	l := &testListener{conns: make(chan net.Conn, len(conns))}
+	for i := 0; i < len(conns); i++ {
+		l.conns <- conns[i]
+	}
+	close(l.conns)
+
+	return l
+}
+
+func (l *testListener) Accept() (net.Conn, error) {
+	conn, ok := <-l.conns
+	if !ok {
+		return nil, net.ErrClosed
+	}
+
+	return conn, nil
+}
+
+func (l *testListener) Close() error {
+	return nil
+}
+
+func (l *testListener) Addr() net.Addr {
+	return testAddr("127.0.0.1:9001")
+}
+
+type testConn struct {
+	net.Conn
+	closed atomic.Bool
+}
+
+func (c *testConn) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func TestRateLimitAllow(t *testing.T) {
+	start := time.Now()
+
+	tests := []struct {
+		name  string
+		rate  float64
+		burst int
+		// offsets of the accepted connections from the start and the expected result
+		at    []time.Duration
+		allow []bool
+	}{
+		{
+			name:  "burst",
+			rate:  1,
+			burst: 3,
+			at:    []time.Duration{0, 0, 0, 0},
+			allow: []bool{true, true, true, false},
+		},
+		{
+			name:  "refill",
+			rate:  2,
+			burst: 1,
+			at:    []time.Duration{0, 0, 250 * time.Millisecond, 500 * time.Millisecond, 600 * time.Millisecond},
+			allow: []bool{true, false, false, true, false},
+		},
+		{
+			name:  "refill is capped by the burst",
+			rate:  10,
+			burst: 2,
+			at:    []time.Duration{0, 0, time.Minute, time.Minute, time.Minute},
+			allow: []bool{true, true, true, true, false},
+		},
+		{
+			name:  "zero burst",
+			rate:  1,
+			burst: 0,
+			at:    []time.Duration{0, 0, time.Second},
+			allow: []bool{true, false, true},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newRateLimitListener(newTestListener(), tt.rate, tt.burst, prometheus.NewCounter(prometheus.CounterOpts{Name: "accepted"}), prometheus.NewCounter(prometheus.CounterOpts{Name: "rejected"})).(*rateLimitListener)
+			l.last = start
+
+			for i := 0; i < len(tt.at); i++ {
+				require.Equal(t, tt.allow[i], l.allow(start.Add(tt.at[i])), i)
+			}
+		})
+	}
+}
+
+func TestRateLimitListener(t *testing.T) {
+	conns := []*testConn{{}, {}, {}, {}}
+	accepted := prometheus.NewCounter(prometheus.CounterOpts{Name: "accepted"})
+	rejected := prometheus.NewCounter(prometheus.CounterOpts{Name: "rejected"})
+
+	// no refill during the test
+	l := newRateLimitListener(newTestListener(conns[0], conns[1], conns[2], conns[3]), 0.001, 2, accepted, rejected)
+
+	for i := 0; i < 2; i++ {
+		conn, err := l.Accept()
+		require.NoError(t, err)
+		require.Same(t, conns[i], conn)
+	}
+
+	// the connections above the rate are closed until the listener is closed
+	_, err := l.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	require.False(t, conns[0].closed.Load())
+	require.False(t, conns[1].closed.Load())
+	require.True(t, conns[2].closed.Load())
+	require.True(t, conns[3].closed.Load())
+	require.Equal(t, float64(2), testutil.ToFloat64(accepted))
+	require.Equal(t, float64(2), testutil.ToFloat64(rejected))
+}
+
+func TestMaxConnListener(t *testing.T) {
+	conns := []*testConn{{}, {}, {}, {}, {}}
+	rejected := prometheus.NewCounter(prometheus.CounterOpts{Name: "rejected"})
+	core, logs := observer.New(zap.WarnLevel)
+
+	l := newMaxConnListener(newTestListener(conns[0], conns[1], conns[2], conns[3], conns[4]), 2, rejected, zap.New(core))
+
+	first, err := l.Accept()
+	require.NoError(t, err)
+	second, err := l.Accept()
+	require.NoError(t, err)
+
+	// the slot is released once
+	require.NoError(t, first.Close())
+	require.NoError(t, first.Close())
+	require.True(t, conns[0].closed.Load())
+
+	third, err := l.Accept()
+	require.NoError(t, err)
+	require.Same(t, conns[2], third.(*limitedConn).Conn)
+
+	// the connections above the limit are closed until the listener is closed
+	_, err = l.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+
+	require.False(t, conns[1].closed.Load())
+	require.True(t, conns[3].closed.Load())
+	require.True(t, conns[4].closed.Load())
+	require.Equal(t, float64(2), testutil.ToFloat64(rejected))
+	require.Equal(t, int64(2), l.(*maxConnListener).active.Load())
+
+	// logged once per interval
+	require.Equal(t, 1, logs.FilterMessage("max connections limit reached, connections were rejected").Len())
+
+	require.NoError(t, second.Close())
+	require.Equal(t, int64(1), l.(*maxConnListener).active.Load())
+}
+
+func TestMaxConnLogRejected(t *testing.T) {
+	core, logs := observer.New(zap.WarnLevel)
+	l := newMaxConnListener(newTestListener(), 1, prometheus.NewCounter(prometheus.CounterOpts{Name: "rejected"}), zap.New(core)).(*maxConnListener)
+
+	for i := 0; i < 3; i++ {
+		l.logRejected()
+	}
+	require.Equal(t, 1, logs.Len())
+	require.Equal(t, int64(1), logs.All()[0].ContextMap()["rejected"])
+
+	// the rejections since the last log are reported after the interval
+	l.lastLog.Store(time.Now().Add(-rejectLogInterval).UnixNano())
+	l.logRejected()
+	require.Equal(t, 2, logs.Len())
+	require.Equal(t, int64(3), logs.All()[1].ContextMap()["rejected"])
+}
+
+func TestServerListenerHandBack(t *testing.T) {
+	l := &testListener{conns: make(chan net.Conn)}
+	h := newHandoffListener(l)
+
+	old := h.serverListener()
+	require.NoError(t, old.Close())
+	_, err := old.Accept()
+	require.ErrorIs(t, err, net.ErrClosed)
+	require.True(t, old.isClosed())
+
+	// the connections go to the new server only
+	next := h.serverListener()
+	first := &testConn{}
+	l.conns <- first
+	conn, err := next.Accept()
+	require.NoError(t, err)
+	require.Same(t, first, conn)
+
+	// the connection taken by the closed listener is handed to the new server
+	second := &testConn{}
+	go h.handBack(second)
+	conn, err = next.Accept()
+	require.NoError(t, err)
+	require.Same(t, second, conn)
+
+	// closed when the listener is stopped
+	require.NoError(t, h.Close())
+	third := &testConn{}
+	h.handBack(third)
+	require.True(t, third.closed.Load())
+
+	close(l.conns)
+	<-h.done
+}
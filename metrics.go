@@ -1,9 +1,16 @@
 package grpc
 
 import (
+	"context"
+	"time"
+
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/roadrunner-server/sdk/v3/metrics"
 	"github.com/roadrunner-server/sdk/v3/state/process"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/status"
 )
 
 // Informer used to get workers from particular plugin or set of plugins
@@ -14,22 +21,178 @@ type Informer interface {
 func (p *Plugin) MetricsCollector() []prometheus.Collector {
 	// p - implements Exporter interface (workers)
 	// other - request duration and count
-	return []prometheus.Collector{p.statsExporter}
+	return []prometheus.Collector{p.statsExporter, p.metrics.requestDuration, p.metrics.workerDuration, p.metrics.workerQueueWait, p.metrics.queueDepth, p.metrics.connAccepted, p.metrics.connRejected, p.metrics.connLimited, p.metrics.breakerState, p.metrics.protocolErrors, p.metrics.tlsHandshakes}
 }
 
 const (
 	namespace = "rr_grpc"
 )
 
-func newStatsExporter(stats Informer) *metrics.StatsExporter {
+// constLabels are attached to all metrics of the plugin
+func constLabels(serviceVersion string) prometheus.Labels {
+	if serviceVersion == "" {
+		return nil
+	}
+
+	return prometheus.Labels{"service_version": serviceVersion}
+}
+
+// metricsNamespace returns the metrics namespace, the named instances have their own namespace (rr_grpc_internal)
+// because the metrics of all instances are registered in the same registry
+func (p *Plugin) metricsNamespace() string {
+	if p.name == "" || p.name == pluginName {
+		return namespace
+	}
+
+	return "rr_" + p.name
+}
+
+func newStatsExporter(stats Informer, namespace string, labels prometheus.Labels) *metrics.StatsExporter {
 	return &metrics.StatsExporter{
-		TotalMemoryDesc:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "workers_memory_bytes"), "Memory usage by workers", nil, nil),
-		StateDesc:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "worker_state"), "Worker current state", []string{"state", "pid"}, nil),
-		WorkerMemoryDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "worker_memory_bytes"), "Worker current memory usage", []string{"pid"}, nil),
-		TotalWorkersDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "total_workers"), "Total number of workers used by the plugin", nil, nil),
-		WorkersReady:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "workers_ready"), "Workers currently in ready state", nil, nil),
-		WorkersWorking:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "workers_working"), "Workers currently in working state", nil, nil),
-		WorkersInvalid:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "workers_invalid"), "Workers currently in invalid,killing,destroyed,errored,inactive states", nil, nil),
+		TotalMemoryDesc:  prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "workers_memory_bytes"), "Memory usage by workers", nil, labels),
+		StateDesc:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "worker_state"), "Worker current state", []string{"state", "pid"}, labels),
+		WorkerMemoryDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "worker_memory_bytes"), "Worker current memory usage", []string{"pid"}, labels),
+		TotalWorkersDesc: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "total_workers"), "Total number of workers used by the plugin", nil, labels),
+		WorkersReady:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "workers_ready"), "Workers currently in ready state", nil, labels),
+		WorkersWorking:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "workers_working"), "Workers currently in working state", nil, labels),
+		WorkersInvalid:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "workers_invalid"), "Workers currently in invalid,killing,destroyed,errored,inactive states", nil, labels),
 		Workers:          stats,
 	}
 }
+
+// rpcMetrics are the calls' metrics collected by the metrics interceptor
+type rpcMetrics struct {
+	requestDuration *prometheus.HistogramVec
+	workerDuration  *prometheus.HistogramVec
+	workerQueueWait *prometheus.HistogramVec
+	queueDepth      prometheus.Gauge
+	connAccepted    prometheus.Counter
+	connRejected    prometheus.Counter
+	connLimited     prometheus.Counter
+	breakerState    prometheus.Gauge
+	protocolErrors  *prometheus.CounterVec
+	tlsHandshakes   *prometheus.CounterVec
+}
+
+func newRPCMetrics(namespace string, labels prometheus.Labels) *rpcMetrics {
+	return &rpcMetrics{
+		requestDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			ConstLabels: labels,
+			Name:        "request_duration_seconds",
+			Help:        "Calls duration",
+		}, []string{"method", "code"}),
+		workerDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			ConstLabels: labels,
+			Name:        "worker_duration_seconds",
+			Help:        "Worker execution time of the calls, including the wait for a free worker",
+		}, []string{"method"}),
+		workerQueueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace:   namespace,
+			ConstLabels: labels,
+			Name:        "worker_queue_wait_seconds",
+			Help:        "Wait for a free worker in the pool, reported only by the pools supporting it",
+		}, []string{"method"}),
+		queueDepth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: labels,
+			Name:        "queue_depth",
+			Help:        "Calls waiting for a free worker in the queue",
+		}),
+		connAccepted: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			ConstLabels: labels,
+			Name:        "connections_accepted_total",
+			Help:        "Connections accepted by the accept rate limiter",
+		}),
+		connRejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			ConstLabels: labels,
+			Name:        "connections_rejected_total",
+			Help:        "Connections closed by the accept rate limiter",
+		}),
+		connLimited: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace:   namespace,
+			ConstLabels: labels,
+			Name:        "connections_limit_rejected_total",
+			Help:        "Connections closed because of the max_connections limit",
+		}),
+		breakerState: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace:   namespace,
+			ConstLabels: labels,
+			Name:        "circuit_breaker_state",
+			Help:        "Circuit breaker state: 0 - closed, 1 - half-open, 2 - open",
+		}),
+		protocolErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			ConstLabels: labels,
+			Name:        "worker_protocol_errors_total",
+			Help:        "Worker responses with the response context that can't be decoded",
+		}, []string{"method"}),
+		tlsHandshakes: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace:   namespace,
+			ConstLabels: labels,
+			Name:        "tls_handshakes_total",
+			Help:        "Completed TLS handshakes (counted when log_handshakes is enabled)",
+		}, []string{"version", "cipher_suite"}),
+	}
+}
+
+// metricsInterceptor observes the calls' duration. When the call is traced, the trace id is attached to the
+// observation as an exemplar (exposed only in the OpenMetrics format), linking the latency to the trace.
+func (p *Plugin) metricsInterceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+
+	observer := p.metrics.requestDuration.WithLabelValues(info.FullMethod, status.Code(err).String())
+	elapsed := time.Since(start).Seconds()
+
+	sc := trace.SpanContextFromContext(ctx)
+	if eo, ok := observer.(prometheus.ExemplarObserver); ok && sc.IsSampled() {
+		eo.ObserveWithExemplar(elapsed, prometheus.Labels{"trace_id": sc.TraceID().String()})
+	} else {
+		observer.Observe(elapsed)
+	}
+
+	return resp, err
+}
+
+type workerElapsedKey struct{}
+
+// observeExec records the worker execution time reported by the proxy, the time is also logged by the logging
+// interceptor
+func (p *Plugin) observeExec(ctx context.Context, method string, elapsed time.Duration) {
+	p.metrics.workerDuration.WithLabelValues(method).Observe(elapsed.Seconds())
+
+	if we, ok := ctx.Value(workerElapsedKey{}).(*time.Duration); ok {
+		*we = elapsed
+	}
+}
+
+// observeQueueWait reports the wait for a free worker in the pool
+func (p *Plugin) observeQueueWait(_ context.Context, method string, wait time.Duration) {
+	p.metrics.workerQueueWait.WithLabelValues(method).Observe(wait.Seconds())
+}
+
+// maxProtocolErrorContext limits the raw response context logged on the protocol errors
+const maxProtocolErrorContext int = 1024
+
+// observeProtocolError reports the response context the proxy failed to decode, it points to a bug in the worker
+// or the worker SDK rather than to the handler error
+func (p *Plugin) observeProtocolError(ctx context.Context, method string, data []byte, err error) {
+	p.metrics.protocolErrors.WithLabelValues(method).Inc()
+
+	raw := data
+	if len(raw) > maxProtocolErrorContext {
+		raw = raw[:maxProtocolErrorContext]
+	}
+
+	p.log.Error("worker returned malformed response context",
+		zap.String("method", method),
+		zap.String("request_id", requestID(ctx)),
+		zap.ByteString("context", raw),
+		zap.Int("context_size", len(data)),
+		zap.Error(err),
+	)
+}
@@ -0,0 +1,116 @@
+package grpc
+
+import (
+	"time"
+
+	orcaservice "github.com/cncf/xds/go/xds/service/orca/v3"
+	"github.com/roadrunner-server/sdk/v3/fsm"
+	"github.com/roadrunner-server/sdk/v3/state/process"
+	"github.com/roadrunner-server/sdk/v3/worker"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/orca"
+)
+
+const (
+	// interval to refresh the reported load from the pool, the clients receive it every reporting interval (30s min)
+	orcaRefresh = time.Second
+	// named utilization metric: busy workers ratio
+	orcaWorkersUtilization string = "workers"
+)
+
+// orcaReporter publishes the pool load with the ORCA out-of-band service: the busy workers ratio is reported as the
+// CPU utilization (the PHP workers are the bottleneck, not the server CPU) and as the workers utilization, the memory
+// utilization is the average worker memory relative to the supervisor's max_worker_memory (not reported without it).
+type orcaReporter struct {
+	service *orca.Service
+	plugin  *Plugin
+	stopCh  chan struct{}
+}
+
+func newORCAReporter(p *Plugin) (*orcaReporter, error) {
+	service, err := orca.NewService(orca.ServiceOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return &orcaReporter{
+		service: service,
+		plugin:  p,
+		stopCh:  make(chan struct{}),
+	}, nil
+}
+
+// register registers the service on the server, the same service is shared by the servers rebuilt with the new proto
+// files
+func (o *orcaReporter) register(server *grpc.Server) {
+	orcaservice.RegisterOpenRcaServiceServer(server, o.service)
+}
+
+// start refreshes the load until stop is called
+func (o *orcaReporter) start() {
+	go func() {
+		ticker := time.NewTicker(orcaRefresh)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				o.refresh()
+			case <-o.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (o *orcaReporter) stop() {
+	close(o.stopCh)
+}
+
+func (o *orcaReporter) refresh() {
+	// the pool is locked while being reset, the previous load is reported until the next refresh
+	if !o.plugin.mu.TryRLock() {
+		return
+	}
+
+	var workers []*worker.Process
+	if o.plugin.gPool != nil {
+		workers = o.plugin.gPool.Workers()
+	}
+	o.plugin.mu.RUnlock()
+
+	if len(workers) == 0 {
+		return
+	}
+
+	busy := 0
+	var memory uint64
+	for i := 0; i < len(workers); i++ {
+		if workers[i].State().Compare(fsm.StateWorking) {
+			busy++
+		}
+
+		state, err := process.WorkerProcessState(workers[i])
+		if err == nil {
+			memory += state.MemoryUsage
+		}
+	}
+
+	utilization := float64(busy) / float64(len(workers))
+	o.service.SetCPUUtilization(utilization)
+	o.service.SetUtilization(orcaWorkersUtilization, utilization)
+
+	if o.plugin.config.GrpcPool.Supervisor != nil && o.plugin.config.GrpcPool.Supervisor.MaxWorkerMemory > 0 {
+		// max_worker_memory is in MB
+		limit := float64(o.plugin.config.GrpcPool.Supervisor.MaxWorkerMemory) * 1024 * 1024
+		o.service.SetMemoryUtilization(minFloat(float64(memory)/float64(len(workers))/limit, 1))
+	}
+}
+
+func minFloat(a, b float64) float64 {
+	if a < b {
+		return a
+	}
+
+	return b
+}
@@ -8,6 +8,12 @@ import (
 	pp "github.com/emicklei/proto"
 )
 
+// PackageOption is the file option overriding the package prefix of the service names, for the clients calling the
+// services in another namespace than the proto package. The extension should be declared for protoc:
+//
+//	option (roadrunner.package) = "acme.api.v1";
+const PackageOption string = "(roadrunner.package)"
+
 // Service contains information about singular GRPC service.
 type Service struct {
 	// Package defines service namespace.
@@ -67,13 +73,19 @@ func parse(reader io.Reader, importPath string) ([]Service, error) {
 }
 
 func parsePackage(proto *pp.Proto) string {
+	pkg := ""
 	for _, e := range proto.Elements {
-		if p, ok := e.(*pp.Package); ok {
-			return p.Name
+		switch el := e.(type) {
+		case *pp.Option:
+			if el.Name == PackageOption && el.Constant.Source != "" {
+				return el.Constant.Source
+			}
+		case *pp.Package:
+			pkg = el.Name
 		}
 	}
 
-	return ""
+	return pkg
 }
 
 func parseServices(proto *pp.Proto, pkg string, importPath string) ([]Service, error) {
@@ -74,3 +74,27 @@ message Message {
 
 	assert.Equal(t, "app.namespace", services[0].Package)
 }
+
+func TestParsePackageOption(t *testing.T) {
+	services, err := Bytes([]byte(`
+syntax = "proto3";
+package app.namespace;
+
+option go_package = "github.com/acme/app";
+option (roadrunner.package) = "acme.api.v1";
+
+service PingService {
+   rpc Ping (Message) returns (Message) {
+   }
+}
+
+message Message {
+   string msg = 1;
+}
+`))
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+
+	assert.Equal(t, "acme.api.v1", services[0].Package)
+	assert.Equal(t, "PingService", services[0].Name)
+}
@@ -2,31 +2,30 @@ package grpc
 
 import (
 	"context"
+	"crypto/tls"
 	stderr "errors"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/roadrunner-server/errors"
-	"github.com/roadrunner-server/grpc/v3/codec"
 	"github.com/roadrunner-server/grpc/v3/proxy"
 	"github.com/roadrunner-server/sdk/v3/metrics"
 	"github.com/roadrunner-server/sdk/v3/payload"
 	"github.com/roadrunner-server/sdk/v3/pool"
 	staticPool "github.com/roadrunner-server/sdk/v3/pool/static_pool"
 	"github.com/roadrunner-server/sdk/v3/state/process"
-	"github.com/roadrunner-server/sdk/v3/utils"
 	"github.com/roadrunner-server/sdk/v3/worker"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
-	"google.golang.org/grpc/encoding"
 	"google.golang.org/grpc/health/grpc_health_v1"
-
-	// Will register via init
-	_ "google.golang.org/grpc/encoding/gzip"
 )
 
 const (
 	pluginName string = "grpc"
 	RrMode     string = "RR_MODE"
+	// RrGRPCServer is the workers env variable with the name of the plugin instance (config section) serving the calls
+	RrGRPCServer string = "RR_GRPC_SERVER"
 )
 
 type Configurer interface {
@@ -56,31 +55,70 @@ type Server interface {
 }
 
 type Plugin struct {
-	mu            *sync.RWMutex
-	config        *Config
-	gPool         Pool
-	opts          []grpc.ServerOption
-	server        *grpc.Server
-	rrServer      Server
-	proxyList     []*proxy.Proxy
-	healthServer  *HealthCheckServer
+	mu *sync.RWMutex
+	// serializes the server rebuilds (RegisterProto, DrainConnections, proto watcher), the pool's lock is taken
+	// only for the swap
+	rebuildMu sync.Mutex
+	config    *Config
+	gPool     Pool
+	opts      []grpc.ServerOption
+	server    *grpc.Server
+	listener  *handoffListener
+	// listener of the current server
+	serverListener *serverListener
+	errCh          chan error
+	rrServer       Server
+	proxyList      []*proxy.Proxy
+	healthServer   *HealthCheckServer
+	latency        *latencyAggregator
+	ticketKeys     *ticketKeys
+	orca           *orcaReporter
+	certChecker    *certChecker
+	certs          *certSource
+	protoWatcher   *protoWatcher
+	workersGate    *workersGate
+	// TLS config of the HTTP health endpoint
+	httpTLSConfig *tls.Config
+	queue         *workerQueue
+	breaker       *circuitBreaker
 	statsExporter *metrics.StatsExporter
+	metrics       *rpcMetrics
+	// the first worker was ready, see the readiness gate
+	ready atomic.Bool
+	// Stop was called, the listener errors are expected
+	stopping atomic.Bool
+
+	// registered by the other plugins before Serve
+	transforms     map[string]proxy.BodyTransform
+	validators     map[string]proxy.RequestValidator
+	errorMapper    proxy.ErrorMapper
+	authenticators []Authenticator
+	certCheck      CertificateCheck
+	certProvider   CertProvider
+	contextValues  []*proxy.ContextValue
+
+	// config section and plugin name, grpc if empty
+	name string
 
 	log *zap.Logger
 }
 
+// NewNamed returns the plugin configured by the name section (e.g. grpc_internal) instead of grpc, so several gRPC
+// servers with the different TLS and proto files can be served by one RoadRunner instance. The instances don't share
+// any state: each one has its own listener, workers pool and metrics (rr_<name> namespace). Workers receive
+// the same call context from all instances, the instance name is set in the RR_GRPC_SERVER env variable of the
+// workers (grpc for the default instance) to tell them apart.
+func NewNamed(name string) *Plugin {
+	return &Plugin{name: name}
+}
+
 func (p *Plugin) Init(cfg Configurer, log *zap.Logger, server Server) error {
 	const op = errors.Op("grpc_plugin_init")
 
-	if !cfg.Has(pluginName) {
+	if !cfg.Has(p.Name()) {
 		return errors.E(errors.Disabled)
 	}
-	// register the codec
-	encoding.RegisterCodec(&codec.Codec{
-		Base: encoding.GetCodec(codec.Name),
-	})
-
-	err := cfg.UnmarshalKey(pluginName, &p.config)
+	err := cfg.UnmarshalKey(p.Name(), &p.config)
 	if err != nil {
 		return errors.E(op, err)
 	}
@@ -90,6 +128,14 @@ func (p *Plugin) Init(cfg Configurer, log *zap.Logger, server Server) error {
 		return errors.E(op, err)
 	}
 
+	if p.config.GzipLevel != 0 {
+		// the compressor is registered globally
+		err = gzipLevel.set(p.Name(), p.config.GzipLevel)
+		if err != nil {
+			return errors.E(op, err)
+		}
+	}
+
 	p.opts = make([]grpc.ServerOption, 0)
 	p.rrServer = server
 	p.proxyList = make([]*proxy.Proxy, 0, 1)
@@ -99,11 +145,24 @@ func (p *Plugin) Init(cfg Configurer, log *zap.Logger, server Server) error {
 		p.config.Env = make(map[string]string)
 	}
 	p.config.Env[RrMode] = pluginName
+	// the workers of the named instances are told apart by the instance name
+	p.config.Env[RrGRPCServer] = p.Name()
 
 	p.log = new(zap.Logger)
 	*p.log = *log
+	if p.config.ServiceVersion != "" {
+		p.log = p.log.With(zap.String("service_version", p.config.ServiceVersion))
+	}
+	if p.name != "" && p.name != pluginName {
+		p.log = p.log.With(zap.String("server", p.name))
+	}
+	if len(p.config.LogBodies) > 0 {
+		p.log.Warn("request and response bodies are logged, they may contain personal data, use it only for debugging", zap.Strings("methods", p.config.LogBodies))
+	}
+
 	p.mu = &sync.RWMutex{}
-	p.statsExporter = newStatsExporter(p)
+	p.statsExporter = newStatsExporter(p, p.metricsNamespace(), constLabels(p.config.ServiceVersion))
+	p.metrics = newRPCMetrics(p.metricsNamespace(), constLabels(p.config.ServiceVersion))
 
 	return nil
 }
@@ -127,57 +186,211 @@ func (p *Plugin) Serve() chan error {
 		return errCh
 	}
 
-	p.server, err = p.createGRPCserver()
+	if p.config.AffinityMetadata != "" {
+		if _, ok := p.gPool.(proxy.AffinityPool); !ok {
+			p.log.Warn("the workers pool does not support the affinity, the calls are scheduled as usual", zap.String("affinity_metadata", p.config.AffinityMetadata))
+		}
+	}
+
+	p.errCh = errCh
+	p.healthServer = NewHeathServer(p, p.log)
+
+	if p.config.EnableTLS() && p.config.TLS.SessionTicketKeys != "" {
+		p.ticketKeys, err = newTicketKeys(p.config.TLS.SessionTicketKeys, p.log)
+		if err != nil {
+			errCh <- errors.E(op, err)
+			return errCh
+		}
+	}
+
+	if p.config.ExperimentalORCA {
+		p.orca, err = newORCAReporter(p)
+		if err != nil {
+			errCh <- errors.E(op, err)
+			return errCh
+		}
+	}
+
+	if p.config.ReadinessGate == gateWait {
+		err = p.waitReady(p.config.ReadinessTimeout)
+		if err != nil {
+			errCh <- errors.E(op, err)
+			return errCh
+		}
+	}
+
+	built, err := p.createGRPCserver()
 	if err != nil {
 		errCh <- errors.E(op, err)
 		return errCh
 	}
 
-	l, err := utils.CreateListener(p.config.Listen)
+	p.setServer(built)
+
+	p.listener, err = p.listen()
 	if err != nil {
 		errCh <- errors.E(op, err)
 		return errCh
 	}
 
-	p.healthServer = NewHeathServer(p, p.log)
-	p.healthServer.RegisterServer(p.server)
+	if p.config.LatencyLogInterval > 0 {
+		p.latency = newLatencyAggregator(p.log)
+		p.latency.start(p.config.LatencyLogInterval)
+	}
 
-	go func() {
-		p.log.Info("grpc server was started", zap.String("address", p.config.Listen))
+	if p.ticketKeys != nil {
+		p.ticketKeys.start(p.config.TLS.SessionTicketKeysReload)
+	}
+
+	if p.orca != nil {
+		p.orca.start()
+	}
 
+	if p.config.ProtoWatchInterval > 0 {
+		p.log.Warn("proto files are watched, the server is rebuilt and the clients are reconnected on every change, use it only for development")
+		p.protoWatcher = newProtoWatcher(p)
+		p.protoWatcher.start(p.config.ProtoWatchInterval)
+	}
+
+	p.log.Info("grpc server was started", zap.String("address", p.config.Listen))
+	if p.config.LogConnections {
+		// the server pings the connection after ping_time without activity
+		p.log.Info("keepalive parameters", zap.Duration("ping_time", p.config.PingTime), zap.Duration("ping_timeout", p.config.Timeout),
+			zap.Duration("max_connection_idle", p.config.MaxConnectionIdle), zap.Duration("max_connection_age", p.config.MaxConnectionAge))
+	}
+
+	if p.config.MinReadyWorkers > 0 {
+		// SERVING when enough workers are active
+		p.workersGate = newWorkersGate(p, p.config.MinReadyWorkers)
+		p.workersGate.start()
+	} else {
 		p.healthServer.SetServingStatus(grpc_health_v1.HealthCheckResponse_SERVING)
-		err = p.server.Serve(l)
-		p.healthServer.Shutdown()
+	}
+
+	p.serve(p.server)
+
+	return errCh
+}
+
+// serve starts serving connections accepted by the plugin's listener on the provided server
+func (p *Plugin) serve(server *grpc.Server) {
+	const op = errors.Op("grpc_plugin_serve")
+
+	ln := p.listener.serverListener()
+	p.serverListener = ln
+
+	go func() {
+		defer close(ln.served)
+
+		err := server.Serve(ln)
 		if err != nil {
-			// skip errors when stopping the server
-			if stderr.Is(err, grpc.ErrServerStopped) {
+			// skip errors when stopping or replacing the server
+			if stderr.Is(err, grpc.ErrServerStopped) || p.stopping.Load() || ln.isClosed() {
 				return
 			}
 
+			p.healthServer.Shutdown()
 			p.log.Error("grpc server was stopped", zap.Error(err))
-			errCh <- errors.E(op, err)
+			p.errCh <- errors.E(op, err)
 			return
 		}
 	}()
-
-	return errCh
 }
 
 func (p *Plugin) Stop() error {
+	p.stopping.Store(true)
+
+	if p.protoWatcher != nil {
+		p.protoWatcher.stop()
+	}
+
+	if p.workersGate != nil {
+		p.workersGate.stop()
+	}
+
+	if p.config.ShutdownTimeout > 0 {
+		p.gracefulStop()
+	}
+
 	p.mu.Lock()
 	defer p.mu.Unlock()
 
 	p.healthServer.SetServingStatus(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
 
+	for i := 0; i < len(p.proxyList); i++ {
+		p.proxyList[i].Stop()
+	}
+
 	if p.server != nil {
 		p.server.Stop()
 	}
 
+	if p.listener != nil {
+		_ = p.listener.Close()
+	}
+
+	if p.latency != nil {
+		p.latency.stop()
+	}
+
+	if p.ticketKeys != nil {
+		p.ticketKeys.stop()
+	}
+
+	if p.orca != nil {
+		p.orca.stop()
+	}
+
+	if p.certs != nil {
+		p.certs.stop()
+	}
+
 	p.healthServer.Shutdown()
 	return nil
 }
 
+// gracefulStop stops accepting the connections and waits for the calls in flight up to the shutdown timeout. The calls
+// hold the pool's read lock, so the server is stopped without the write lock.
+func (p *Plugin) gracefulStop() {
+	p.mu.RLock()
+	p.healthServer.SetServingStatus(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
+	p.mu.RUnlock()
+
+	if p.config.ShutdownDelay > 0 {
+		// the load balancers see NOT_SERVING and stop routing the new calls, the calls routed meanwhile are served
+		p.log.Info("waiting for the load balancers to stop routing the calls", zap.Duration("delay", p.config.ShutdownDelay))
+		time.Sleep(p.config.ShutdownDelay)
+	}
+
+	p.mu.RLock()
+	server := p.server
+	if p.listener != nil {
+		_ = p.listener.Close()
+	}
+	p.mu.RUnlock()
+
+	if server == nil {
+		return
+	}
+
+	// the health watch streams never end on their own and would hold the graceful stop until the timeout
+	p.healthServer.CloseWatches(server)
+
+	p.log.Info("graceful stop was started", zap.Duration("timeout", p.config.ShutdownTimeout))
+
+	if stopGracefully(server, p.config.ShutdownTimeout) {
+		p.log.Info("graceful stop was completed")
+		return
+	}
+
+	p.log.Warn("graceful stop timeout was reached, the remaining calls are canceled", zap.Duration("timeout", p.config.ShutdownTimeout))
+}
+
 func (p *Plugin) Name() string {
+	if p.name != "" {
+		return p.name
+	}
+
 	return pluginName
 }
 
@@ -186,10 +399,25 @@ func (p *Plugin) Reset() error {
 	defer p.mu.Unlock()
 
 	p.healthServer.SetServingStatus(grpc_health_v1.HealthCheckResponse_NOT_SERVING)
-	defer p.healthServer.SetServingStatus(grpc_health_v1.HealthCheckResponse_SERVING)
+	// the workers gate sets SERVING when enough new workers are active
+	if p.workersGate == nil {
+		defer p.healthServer.SetServingStatus(grpc_health_v1.HealthCheckResponse_SERVING)
+	}
 
 	const op = errors.Op("grpc_plugin_reset")
 	p.log.Info("reset signal was received")
+
+	// reject new calls with Unavailable while the pool is being reset, so the clients may retry them
+	for i := 0; i < len(p.proxyList); i++ {
+		p.proxyList[i].Stop()
+	}
+
+	defer func() {
+		for i := 0; i < len(p.proxyList); i++ {
+			p.proxyList[i].Start()
+		}
+	}()
+
 	// destroy old pool
 	err := p.gPool.Reset(context.Background())
 	if err != nil {
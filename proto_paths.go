@@ -0,0 +1,191 @@
+package grpc
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+)
+
+const protoExt string = ".proto"
+
+// expandProtoPaths replaces the directories and the glob patterns of the proto paths with the matched proto files.
+// Files matched by several entries are kept once, in the order of the first match.
+func expandProtoPaths(paths []string) ([]string, error) {
+	files := make([]string, 0, len(paths))
+	seen := make(map[string]struct{}, len(paths))
+
+	for i := 0; i < len(paths); i++ {
+		if paths[i] == "" {
+			continue
+		}
+
+		path, err := expandEnv(paths[i])
+		if err != nil {
+			return nil, err
+		}
+
+		matches, err := protoFiles(path)
+		if err != nil {
+			return nil, err
+		}
+
+		for j := 0; j < len(matches); j++ {
+			file := filepath.Clean(matches[j])
+			if _, ok := seen[file]; ok {
+				continue
+			}
+
+			seen[file] = struct{}{}
+			files = append(files, file)
+		}
+	}
+
+	return files, nil
+}
+
+// protoFiles returns the proto files of the path: the file itself, all proto files of the directory (recursively)
+// or the files matched by the glob pattern, ** matches any number of the directories
+func protoFiles(path string) ([]string, error) {
+	if hasMeta(path) {
+		matches, err := globProto(path)
+		if err != nil {
+			return nil, err
+		}
+
+		if len(matches) == 0 {
+			return nil, errors.Errorf("proto pattern '%s' does not match any file", path)
+		}
+
+		return matches, nil
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, errors.Errorf("proto file '%s' does not exists", path)
+		}
+
+		return nil, err
+	}
+
+	if !info.IsDir() {
+		return []string{path}, nil
+	}
+
+	var matches []string
+	err = filepath.WalkDir(path, func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if !d.IsDir() && filepath.Ext(file) == protoExt {
+			matches = append(matches, file)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(matches) == 0 {
+		return nil, errors.Errorf("proto directory '%s' does not contain any proto file", path)
+	}
+
+	return matches, nil
+}
+
+// globProto walks the directory preceding the first pattern segment and returns the files matching the pattern
+func globProto(pattern string) ([]string, error) {
+	pattern = filepath.ToSlash(filepath.Clean(pattern))
+	segments := strings.Split(pattern, "/")
+
+	root := 0
+	for root < len(segments) && !hasMeta(segments[root]) {
+		root++
+	}
+
+	dir := strings.Join(segments[:root], "/")
+	switch {
+	case dir == "" && strings.HasPrefix(pattern, "/"):
+		dir = "/"
+	case dir == "":
+		dir = "."
+	}
+
+	// validate the segments once, filepath.Match reports the malformed pattern only when the name is matched
+	for i := root; i < len(segments); i++ {
+		if _, err := filepath.Match(segments[i], ""); err != nil {
+			return nil, errors.Errorf("malformed proto pattern '%s': %v", pattern, err)
+		}
+	}
+
+	var matches []string
+	err := filepath.WalkDir(filepath.FromSlash(dir), func(file string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return fs.SkipDir
+			}
+
+			return err
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		rel, errR := filepath.Rel(filepath.FromSlash(dir), file)
+		if errR != nil {
+			return errR
+		}
+
+		if matchSegments(segments[root:], strings.Split(filepath.ToSlash(rel), "/")) {
+			matches = append(matches, file)
+		}
+
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(matches)
+	return matches, nil
+}
+
+// matchSegments matches the path segments with the pattern segments, ** matches zero or more segments
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if len(path) == 0 {
+		return false
+	}
+
+	// the pattern was validated
+	ok, _ := filepath.Match(pattern[0], path[0])
+	if !ok {
+		return false
+	}
+
+	return matchSegments(pattern[1:], path[1:])
+}
+
+func hasMeta(path string) bool {
+	return strings.ContainsAny(path, "*?[")
+}
@@ -0,0 +1,107 @@
+package grpc
+
+import (
+	"crypto/sha256"
+	"os"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// protoWatcher rebuilds the server when the configured proto files change, for the development only: the files are
+// polled every interval and the new server with the re-parsed services is swapped with the current one behind the
+// same listener, the same way as on RegisterProto. The connected clients receive GOAWAY and reconnect (a brief blip),
+// the calls in flight are completed by the old server. The imported files are not watched.
+type protoWatcher struct {
+	plugin *Plugin
+	sums   map[string][sha256.Size]byte
+	log    *zap.Logger
+	stopCh chan struct{}
+}
+
+func newProtoWatcher(p *Plugin) *protoWatcher {
+	w := &protoWatcher{
+		plugin: p,
+		sums:   make(map[string][sha256.Size]byte),
+		log:    p.log,
+		stopCh: make(chan struct{}),
+	}
+
+	// the files are already parsed by the running server
+	w.changed()
+
+	return w
+}
+
+// start polls the files until stop is called
+func (w *protoWatcher) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				if w.changed() {
+					w.reload()
+				}
+			case <-w.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (w *protoWatcher) stop() {
+	close(w.stopCh)
+}
+
+// changed updates the checksums of the files and reports whether any of them was changed. The files seen for
+// the first time (added by RegisterProto) are already parsed by the rebuilt server, their checksums are recorded
+// without reporting a change, so the server is not rebuilt again.
+func (w *protoWatcher) changed() bool {
+	w.plugin.mu.RLock()
+	files := make([]string, len(w.plugin.config.Proto))
+	copy(files, w.plugin.config.Proto)
+	w.plugin.mu.RUnlock()
+
+	changed := false
+	for i := 0; i < len(files); i++ {
+		if files[i] == "" {
+			continue
+		}
+
+		data, err := os.ReadFile(files[i])
+		if err != nil {
+			// e.g. the file is being replaced by the editor, checked on the next tick
+			continue
+		}
+
+		sum := sha256.Sum256(data)
+		prev, ok := w.sums[files[i]]
+		w.sums[files[i]] = sum
+		if ok && prev != sum {
+			changed = true
+		}
+	}
+
+	return changed
+}
+
+func (w *protoWatcher) reload() {
+	p := w.plugin
+
+	p.rebuildMu.Lock()
+	defer p.rebuildMu.Unlock()
+
+	rebuilt, err := p.rebuildServer()
+	if err != nil {
+		// the current server is kept until the files are fixed
+		w.log.Error("failed to rebuild the grpc server with the changed proto files", zap.Error(err))
+		return
+	}
+
+	if rebuilt {
+		w.log.Info("grpc server was rebuilt with the changed proto files", zap.Strings("proto", p.config.Proto))
+	}
+}
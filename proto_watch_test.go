@@ -0,0 +1,77 @@
+package grpc
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roadrunner-server/grpc/v3/proxy/proxytest"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func writeTestProto(t *testing.T, dir, name, service string) string {
+	t.Helper()
+
+	file := filepath.Join(dir, name)
+	content := "syntax = \"proto3\";\npackage app;\nservice " + service + " { rpc Call (M) returns (M) {} }\nmessage M { string a = 1; }\n"
+	require.NoError(t, os.WriteFile(file, []byte(content), 0o600))
+
+	return file
+}
+
+func TestProtoWatchRegisterProto(t *testing.T) {
+	dir := t.TempDir()
+	a := writeTestProto(t, dir, "a.proto", "A")
+	b := writeTestProto(t, dir, "b.proto", "B")
+
+	core, logs := observer.New(zap.InfoLevel)
+	p := &Plugin{
+		config: &Config{Listen: "tcp://127.0.0.1:0", Proto: []string{a}},
+		gPool:  proxytest.NewPool(),
+		log:    zap.New(core),
+		mu:     &sync.RWMutex{},
+		errCh:  make(chan error, 1),
+	}
+	require.NoError(t, p.config.InitDefaults())
+	p.metrics = newRPCMetrics(namespace, nil)
+	p.healthServer = NewHeathServer(p, p.log)
+
+	built, err := p.createGRPCserver()
+	require.NoError(t, err)
+	p.setServer(built)
+
+	p.listener, err = p.listen()
+	require.NoError(t, err)
+	p.serve(p.server)
+
+	defer func() {
+		p.stopping.Store(true)
+		p.mu.Lock()
+		p.server.Stop()
+		p.mu.Unlock()
+		_ = p.listener.Close()
+	}()
+
+	w := newProtoWatcher(p)
+	w.start(10 * time.Millisecond)
+	defer w.stop()
+
+	// the registered file is not reported as changed by the watcher
+	require.NoError(t, p.RegisterProto(b))
+	time.Sleep(100 * time.Millisecond)
+	require.Equal(t, 1, logs.FilterMessage("grpc server was rebuilt with the new proto file").Len())
+	require.Equal(t, 0, logs.FilterMessage("grpc server was rebuilt with the changed proto files").Len())
+
+	// the changes of the registered file are watched
+	writeTestProto(t, dir, "b.proto", "C")
+	require.Eventually(t, func() bool {
+		return logs.FilterMessage("grpc server was rebuilt with the changed proto files").Len() == 1
+	}, time.Second, 10*time.Millisecond)
+
+	time.Sleep(50 * time.Millisecond)
+	require.Equal(t, 1, logs.FilterMessage("grpc server was rebuilt with the changed proto files").Len())
+}
@@ -0,0 +1,77 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/goridge/v3/pkg/frame"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// supported context codecs
+const (
+	JSONContext    string = "json"
+	MsgpackContext string = "msgpack"
+)
+
+// ContextCodec encodes the call context sent to the worker and decodes the response context returned by the worker.
+type ContextCodec interface {
+	// Frame returns the goridge frame codec flag, the worker uses it to choose the decoder.
+	Frame() byte
+	Marshal(v any) ([]byte, error)
+	Unmarshal(data []byte, v any) error
+}
+
+// NewContextCodec returns the context codec by name: json (default) or msgpack.
+func NewContextCodec(name string) (ContextCodec, error) {
+	switch name {
+	case "", JSONContext:
+		return jsonCodec{}, nil
+	case MsgpackContext:
+		return msgpackCodec{}, nil
+	default:
+		return nil, errors.Errorf("unknown context codec: %s, supported: %s, %s", name, JSONContext, MsgpackContext)
+	}
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Frame() byte {
+	return frame.CodecJSON
+}
+
+func (jsonCodec) Marshal(v any) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Frame() byte {
+	return frame.CodecMsgpack
+}
+
+// Marshal uses the json tags, so the keys are the same as for the JSON context
+func (msgpackCodec) Marshal(v any) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	enc := msgpack.NewEncoder(buf)
+	enc.SetCustomStructTag("json")
+
+	err := enc.Encode(v)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v any) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(v)
+}
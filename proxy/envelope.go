@@ -0,0 +1,138 @@
+package proxy
+
+import (
+	"context"
+
+	"github.com/roadrunner-server/sdk/v3/payload"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/anypb"
+)
+
+// envelopeVersion is the only supported version of the response envelope
+const envelopeVersion int = 1
+
+// responseEnvelope is the response context returned by the worker when the envelope is enabled, it replaces
+// the legacy format where the status is mixed into the metadata (error and status keys). The body is sent separately
+// as usual. Details are serialized google.protobuf.Any messages (base64 encoded strings in JSON).
+//
+//	{"version": 1, "code": 5, "message": "user was not found", "details": ["..."],
+//	 "metadata": {"x-key": "value"}, "trailers": {"x-key": "value"}}
+//
+// The HTTP caching keys (cache-control, expires, etag, last-modified, vary) are sent in the headers to the grpc-web
+// clients and to all clients with Options.HTTPCacheHeaders.
+type responseEnvelope struct {
+	Version  int               `json:"version"`
+	Code     uint32            `json:"code"`
+	Message  string            `json:"message"`
+	Details  [][]byte          `json:"details"`
+	Metadata map[string]string `json:"metadata"`
+	Trailers map[string]string `json:"trailers"`
+}
+
+// grpcWebHeader is set by the grpc-web clients and kept by the gateways translating the calls to gRPC (e.g. Envoy
+// grpc_web filter). The grpc-web calls can't reach the server directly: gRPC rejects the application/grpc-web
+// content type with 415 before the handler is called.
+const grpcWebHeader string = "x-grpc-web"
+
+// httpCacheKeys are the HTTP caching headers the worker may return for the grpc-web clients: the gateways (e.g. Envoy
+// grpc_web filter) translate the response headers to the HTTP response headers, while the trailers are sent in the
+// response body and can't be seen by the HTTP caches.
+var httpCacheKeys = []string{"cache-control", "expires", "etag", "last-modified", "vary"} //nolint:gochecknoglobals
+
+// isGRPCWeb reports whether the call is made by the grpc-web client through the gateway
+func isGRPCWeb(ctx context.Context) bool {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return false
+	}
+
+	return len(md.Get(grpcWebHeader)) > 0
+}
+
+// moveHTTPCacheKeys moves the HTTP caching keys set by the worker in the trailers to the headers
+func moveHTTPCacheKeys(trailer, header metadata.MD) {
+	for _, key := range httpCacheKeys {
+		if v := trailer.Get(key); len(v) > 0 {
+			header.Append(key, v...)
+			trailer.Delete(key)
+		}
+	}
+}
+
+// setEnvelope sends the metadata and the trailers of the envelope and returns the envelope's status error.
+// Details of the OK status are sent in the status-details-bin trailer.
+func (p *Proxy) setEnvelope(ctx context.Context, resp *payload.Payload) error {
+	env := &responseEnvelope{}
+	if resp != nil && len(resp.Context) > 0 {
+		err := p.ctxCodec.Unmarshal(resp.Context, env)
+		if err != nil {
+			return &malformedContextError{what: "response envelope", data: resp.Context, err: err}
+		}
+	}
+
+	if env.Version != envelopeVersion {
+		return status.Errorf(codes.Internal, "worker returned unsupported response envelope version: %d, supported: %d", env.Version, envelopeVersion)
+	}
+
+	if p.opts.MaxMetadataKeys > 0 {
+		if len(env.Metadata) > p.opts.MaxMetadataKeys {
+			return metadataKeysError(len(env.Metadata), p.opts.MaxMetadataKeys)
+		}
+
+		if len(env.Trailers) > p.opts.MaxMetadataKeys {
+			return status.Errorf(codes.Internal, "worker response trailers have %d keys, exceeds the limit (%d)", len(env.Trailers), p.opts.MaxMetadataKeys)
+		}
+	}
+
+	if p.opts.MaxMetadataSize > 0 {
+		err := checkMetadataSize(env.Metadata, p.opts.MaxMetadataSize)
+		if err != nil {
+			return err
+		}
+	}
+
+	st := &spb.Status{Code: int32(env.Code), Message: env.Message}
+	for i := 0; i < len(env.Details); i++ {
+		detail := &anypb.Any{}
+		err := proto.Unmarshal(env.Details[i], detail)
+		if err != nil {
+			return status.Errorf(codes.Internal, "worker returned malformed response envelope detail %d: %v", i, err)
+		}
+
+		st.Details = append(st.Details, detail)
+	}
+
+	md := metadata.New(env.Metadata)
+	trailer := metadata.New(env.Trailers)
+	if p.opts.HTTPCacheHeaders || isGRPCWeb(ctx) {
+		moveHTTPCacheKeys(trailer, md)
+	}
+	p.setHeader(ctx, md)
+
+	if codes.Code(env.Code) == codes.OK && len(st.Details) > 0 {
+		data, err := proto.Marshal(st)
+		if err != nil {
+			return err
+		}
+
+		trailer.Set(statusDetails, string(data))
+	}
+
+	if len(trailer) > 0 {
+		err := grpc.SetTrailer(ctx, trailer)
+		if err != nil {
+			return err
+		}
+	}
+
+	if codes.Code(env.Code) != codes.OK {
+		return retryInfo(ctx, md, status.ErrorProto(st))
+	}
+
+	return nil
+}
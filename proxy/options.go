@@ -0,0 +1,131 @@
+package proxy
+
+import (
+	"context"
+	"time"
+
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+)
+
+// Options configures the proxy, nil or zero value options keep the default behavior.
+type Options struct {
+	// ContextKeys overrides the JSON keys of the context sent to the worker.
+	ContextKeys *ContextKeys
+	// MaxMetadataSize limits the size of the response metadata returned by the worker, calculated the same way
+	// as the HTTP/2 header list size: len(key) + len(value) + 32 per entry. 0 - unlimited.
+	MaxMetadataSize int
+	// MaxMetadataKeys limits the number of the response metadata (and trailers) keys returned by the worker.
+	// 0 - unlimited.
+	MaxMetadataKeys int
+	// ResponseTransforms post-process the response bodies of the methods (full method name: /package.Service/Method)
+	// before they are sent to the client.
+	ResponseTransforms map[string]BodyTransform
+	// RequestTransforms pre-process the request bodies of the methods (full method name) after the validators, before
+	// they are sent to the worker. The call fails with the InvalidArgument status when the transform returns an error.
+	RequestTransforms map[string]BodyTransform
+	// RequestValidators check the request bodies of the methods (full method name) before they are sent to the worker,
+	// the call fails with the InvalidArgument status when the validator returns an error.
+	RequestValidators map[string]RequestValidator
+	// ErrorKey is the response context key carrying the base64 encoded google.rpc.Status of the failed call,
+	// "error" by default. Metadata keys are case-insensitive, so the key should be lowercase.
+	ErrorKey string
+	// StatusKey is the response context key a worker may use to set the call status explicitly (base64 encoded
+	// google.rpc.Status, the same encoding as for the error key): not OK status fails the call, OK status with
+	// the message and details is sent to the client in the status-details-bin trailer. Disabled when empty, the key
+	// is sent to the client as the regular metadata then.
+	StatusKey string
+	// JSONErrorDetails makes the proxy expect the error details of the worker errors (code|:|message|:|details)
+	// as the JSON array of google.protobuf.Any in the JSON form instead of the serialized messages.
+	JSONErrorDetails bool
+	// ErrorMapper converts the worker errors to the call statuses instead of the code|:|message|:|details convention,
+	// JSONErrorDetails is ignored when it is set.
+	ErrorMapper ErrorMapper
+	// DecodedMethods makes the proxy decode the requests of the methods (full method name) into the dynamic messages
+	// before the interceptors and the worker responses after the worker, so the interceptors receive proto.Message
+	// instead of the raw bytes. The messages are encoded again for the worker and the client.
+	DecodedMethods map[string]protoreflect.MethodDescriptor
+	// ContextCodec encodes the context sent to the worker and decodes the response context, JSON by default.
+	ContextCodec ContextCodec
+	// ExecObserver is called with the worker execution time (pool Exec, including the wait for a free worker),
+	// separately from the total call time which includes the proxy and the transport overhead.
+	ExecObserver func(ctx context.Context, method string, elapsed time.Duration)
+	// QueueWaitObserver is called with the time the call waited for a free worker, reported by the pools calling
+	// ExecStarted. QueueWaitHeader sends it to the client in milliseconds in the x-worker-queue-ms header.
+	QueueWaitObserver func(ctx context.Context, method string, wait time.Duration)
+	QueueWaitHeader   bool
+	// ProtocolErrorObserver is called with the raw response context when it can't be decoded (malformed worker output),
+	// the call fails with the Internal status.
+	ProtocolErrorObserver func(ctx context.Context, method string, data []byte, err error)
+	// CompressMinSize sends the responses smaller than the size (bytes) uncompressed, the bigger ones are compressed
+	// with gzip when the client accepts it. 0 - the response is compressed the same way as the request.
+	CompressMinSize int
+	// ExecTimeHeader sends the worker execution time in milliseconds to the client in the x-worker-elapsed-ms header.
+	ExecTimeHeader bool
+	// InstanceID is sent to the client in the x-instance-id header of all responses when not empty.
+	InstanceID string
+	// ResponseEnvelope makes the proxy expect the versioned response envelope (status, metadata and trailers)
+	// in the response context instead of the metadata map with the error and status keys.
+	ResponseEnvelope bool
+	// HTTPCacheHeaders sends the HTTP caching keys of the envelope trailers (cache-control, expires, etag,
+	// last-modified, vary) in the headers to all clients, e.g. behind a gateway which doesn't keep the grpc-web
+	// headers. The keys are always sent in the headers to the grpc-web clients (the x-grpc-web header).
+	HTTPCacheHeaders bool
+	// ContextValues are the values stored in the call context by the interceptors (e.g. authenticated identity)
+	// forwarded to the worker in the context metadata.
+	ContextValues []*ContextValue
+	// MetadataAllowlist limits the incoming metadata keys forwarded to the worker, all keys are forwarded if empty.
+	// MetadataDenylist keys are never forwarded. Keys are lowercase, the trailing * matches any suffix (x-b3-*).
+	// Pseudo-headers (:authority) and the entries added by the proxy (:peer.address) are always forwarded.
+	MetadataAllowlist []string
+	MetadataDenylist  []string
+	// Log is used for the problems not failing the call, no logs are written if nil.
+	Log *zap.Logger
+	// PeerAddressFormat is the format of the :peer.address context entry: full (default), ip or normalized.
+	PeerAddressFormat string
+	// AffinityKey is the metadata key (lowercase) of the affinity key: the calls with the same key are sent to the same
+	// worker when the pool implements AffinityPool, the calls without the key are scheduled as usual.
+	AffinityKey string
+	// Breaker guards the pool Exec, the calls not allowed by the breaker fail with the Unavailable status.
+	Breaker Breaker
+}
+
+// Breaker is the circuit breaker around the pool Exec.
+type Breaker interface {
+	// Allow reports whether the call may be sent to the worker.
+	Allow() bool
+	// Done reports the result of the allowed call, ctx is the call context (ended by the client when ctx.Err() != nil).
+	Done(ctx context.Context, err error)
+}
+
+// ContextValue describes the context value forwarded to the worker as the context metadata entry Name. The metadata
+// sent by the client with the same name is always dropped, so the client can't spoof the value.
+type ContextValue struct {
+	// Name of the context metadata entry (lowercase, as the metadata keys), e.g. ":tenant": pseudo-header like
+	// names can't be sent by the clients.
+	Name string
+	// Key is the context key the interceptor stores the value with.
+	Key any
+	// Serialize converts the value to the metadata values, the entry is skipped when the error is returned.
+	Serialize func(v any) ([]string, error)
+}
+
+// BodyTransform receives the raw message and returns the transformed one.
+type BodyTransform func(body []byte) ([]byte, error)
+
+// ErrorMapper receives the worker error message and returns the status code, message and details of the call.
+// The details which are not google.protobuf.Any are packed into it, the OK code is replaced with Unknown.
+// DefaultErrorMapper implements the code|:|message|:|details convention.
+type ErrorMapper func(errMsg string) (codes.Code, string, []proto.Message)
+
+// RequestValidator receives the raw request message and returns an error if it should not be sent to the worker.
+type RequestValidator func(body []byte) error
+
+// ContextKeys are the JSON keys of the context sent to the worker, empty key keeps the default name.
+type ContextKeys struct {
+	Service string
+	Method  string
+	Context string
+}
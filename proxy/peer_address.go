@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"net"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// peer address formats of the :peer.address context entry
+const (
+	// PeerAddressFull is the address as reported by the connection: 192.0.2.1:5000
+	PeerAddressFull string = "full"
+	// PeerAddressIP is the normalized IP without the port: 192.0.2.1, 2001:db8::1
+	PeerAddressIP string = "ip"
+	// PeerAddressNormalized is the normalized IP with the port: 192.0.2.1:5000, [2001:db8::1]:5000
+	PeerAddressNormalized string = "normalized"
+)
+
+// ValidatePeerAddressFormat checks the peer address format, empty format is the full address.
+func ValidatePeerAddressFormat(format string) error {
+	switch format {
+	case "", PeerAddressFull, PeerAddressIP, PeerAddressNormalized:
+		return nil
+	default:
+		return errors.Errorf("unknown peer address format: %s, supported: %s, %s, %s", format, PeerAddressFull, PeerAddressIP, PeerAddressNormalized)
+	}
+}
+
+// formatPeerAddress formats the peer address, the IPv4-mapped IPv6 addresses are converted to IPv4 and the IPv6
+// addresses are written in the canonical form (RFC 5952). The addresses without the IP (unix sockets) are kept as is.
+func formatPeerAddress(addr net.Addr, format string) string {
+	if format == "" || format == PeerAddressFull {
+		return addr.String()
+	}
+
+	host, port, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return addr.String()
+	}
+
+	if format == PeerAddressIP {
+		return ip.String()
+	}
+
+	return net.JoinHostPort(ip.String(), port)
+}
@@ -3,33 +3,80 @@ package proxy
 import (
 	"encoding/base64"
 	"encoding/json"
+	stderr "errors"
 	"fmt"
 	"math"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/roadrunner-server/errors"
-	"github.com/roadrunner-server/goridge/v3/pkg/frame"
 	"github.com/roadrunner-server/grpc/v3/codec"
 	"github.com/roadrunner-server/sdk/v3/payload"
 	"github.com/roadrunner-server/sdk/v3/worker"
+	"go.uber.org/zap"
 	"golang.org/x/net/context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
 	spb "google.golang.org/genproto/googleapis/rpc/status"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
+	"google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/metadata"
 	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/encoding/protojson"
 	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/dynamicpb"
 	"google.golang.org/protobuf/types/known/anypb"
+	"google.golang.org/protobuf/types/known/durationpb"
 )
 
 const (
 	peerAddr     string = ":peer.address"
 	peerAuthType string = ":peer.auth-type"
-	delimiter    string = "|:|"
-	apiErr       string = "error"
+	// authority is the host (and port) dialed by the client, scheme is https for the TLS connections and http otherwise
+	authority string = ":authority"
+	scheme    string = ":scheme"
+	// contentSubtype is a negotiated message format (proto, json, etc.), the response is expected in the same format
+	contentSubtype string = ":content-subtype"
+	contentType    string = "content-type"
+	baseSubtype    string = "proto"
+	delimiter      string = "|:|"
+	// apiErr is the default response context key a worker uses to fail the call: the value is base64 (standard
+	// encoding, with padding) encoded serialized google.rpc.Status, the code, the message and the details are sent
+	// to the client as is. The key name can be changed with the Options.ErrorKey.
+	apiErr string = "error"
+	// statusDetails is the trailer carrying the serialized google.rpc.Status of the successful call (Options.StatusKey)
+	statusDetails string = "status-details-bin"
+	// retryAfter is the response context key a worker may set together with the error key to suggest
+	// how long the client should back off. The value is either a duration string ("1.5s") or a number
+	// of milliseconds. It is sent to the client as the google.rpc.RetryInfo error detail and as the
+	// grpc-retry-pushback-ms trailer, which is honored by gRPC clients with a retry policy.
+	retryAfter    string = "retry-after"
+	retryPushback string = "grpc-retry-pushback-ms"
+	// execTimeHeader is the worker execution time in milliseconds (pseudo-headers can't be sent by the server)
+	execTimeHeader string = "x-worker-elapsed-ms"
+	// queueWaitHeader is the time the call waited for a free worker in milliseconds (reported by the pool)
+	queueWaitHeader string = "x-worker-queue-ms"
+	// instanceHeader is the id of the server instance which handled the call
+	instanceHeader string = "x-instance-id"
+	// the call timeout in the gRPC wire format forwarded to the worker
+	grpcTimeout string = "grpc-timeout"
+	// max value of the grpc-timeout header, 8 digits
+	maxTimeoutValue int64 = 100000000 - 1
+	// protoMismatch replaces the status code in the worker error when the worker doesn't know the method or can't
+	// decode the request because its proto version differs from the client's one:
+	// proto-mismatch|:|message|:|expected (worker) version|:|actual (client) version
+	// The error is sent to the client as Unimplemented with the google.rpc.ErrorInfo detail carrying both versions.
+	protoMismatch       string = "proto-mismatch"
+	protoMismatchReason string = "PROTO_VERSION_MISMATCH"
+	protoMismatchDomain string = "grpc.roadrunner.dev"
 )
 
 type Pool interface {
@@ -46,6 +93,34 @@ type Pool interface {
 	Destroy(ctx context.Context)
 }
 
+// AffinityPool is the pool able to send the payloads with the same affinity key to the same worker. The affinity is
+// best-effort: the pool may choose another worker (e.g. the preferred one is busy or was replaced after the reset).
+type AffinityPool interface {
+	ExecWithAffinity(ctx context.Context, key string, p *payload.Payload) (*payload.Payload, error)
+}
+
+// ExecStarted is called by the pools from Exec when the worker was allocated and the payload is about to be sent to
+// it: the time from the Exec call is the queue wait reported to QueueWaitObserver and in the x-worker-queue-ms header.
+// The pool interface has no other way to tell the wait from the execution, the queue wait is not reported for the
+// pools not calling it. Only the first call is taken into account.
+func ExecStarted(ctx context.Context) {
+	if start, ok := ctx.Value(execStartKey{}).(*atomic.Int64); ok {
+		start.CompareAndSwap(0, time.Now().UnixNano())
+	}
+}
+
+// execStartKey is the context key of the exec start time (unix nanoseconds) set by ExecStarted
+type execStartKey struct{}
+
+// WithServerDeadline marks the deadline added by the server to the call without the client deadline (e.g. by
+// the max_deadline interceptor), such deadline is not forwarded to the worker in the grpc-timeout header.
+func WithServerDeadline(ctx context.Context) context.Context {
+	return context.WithValue(ctx, serverDeadlineKey{}, true)
+}
+
+// serverDeadlineKey is the context key set by WithServerDeadline
+type serverDeadlineKey struct{}
+
 // base interface for Proxy class
 type proxyService interface {
 	// RegisterMethod registers new RPC method.
@@ -69,22 +144,44 @@ type Proxy struct {
 	name     string
 	metadata string
 	methods  []string
+	opts     *Options
+	ctxCodec ContextCodec
+	log      *zap.Logger
+	// stopped proxy rejects new calls, e.g. while the pool is being reset
+	stopped atomic.Bool
 
 	pldPool sync.Pool
 }
 
 // NewProxy creates new service proxy object.
-func NewProxy(name string, metadata string, grpcPool Pool, mu *sync.RWMutex) *Proxy {
+func NewProxy(name string, metadata string, grpcPool Pool, mu *sync.RWMutex, opts *Options) *Proxy {
+	if opts == nil {
+		opts = &Options{}
+	}
+
+	ctxCodec := opts.ContextCodec
+	if ctxCodec == nil {
+		ctxCodec = jsonCodec{}
+	}
+
+	log := opts.Log
+	if log == nil {
+		log = zap.NewNop()
+	}
+
 	return &Proxy{
 		mu:       mu,
 		grpcPool: grpcPool,
 		name:     name,
 		metadata: metadata,
+		opts:     opts,
+		ctxCodec: ctxCodec,
+		log:      log,
 		methods:  make([]string, 0),
 		pldPool: sync.Pool{
 			New: func() any {
 				return &payload.Payload{
-					Codec:   frame.CodecJSON,
+					Codec:   ctxCodec.Frame(),
 					Context: make([]byte, 0, 100),
 					Body:    make([]byte, 0, 100),
 				}
@@ -98,6 +195,28 @@ func (p *Proxy) RegisterMethod(method string) {
 	p.methods = append(p.methods, method)
 }
 
+// Name returns the full service name (package.Service).
+func (p *Proxy) Name() string {
+	return p.name
+}
+
+// Methods returns the registered methods names.
+func (p *Proxy) Methods() []string {
+	methods := make([]string, len(p.methods))
+	copy(methods, p.methods)
+	return methods
+}
+
+// Stop makes the proxy reject new calls with the Unavailable status, calls in flight are not affected.
+func (p *Proxy) Stop() {
+	p.stopped.Store(true)
+}
+
+// Start resumes accepting calls after Stop.
+func (p *Proxy) Start() {
+	p.stopped.Store(false)
+}
+
 // ServiceDesc returns service description for the proxy.
 func (p *Proxy) ServiceDesc() *grpc.ServiceDesc {
 	desc := &grpc.ServiceDesc{
@@ -108,8 +227,9 @@ func (p *Proxy) ServiceDesc() *grpc.ServiceDesc {
 		Streams:     []grpc.StreamDesc{},
 	}
 
-	// Registering methods
-	for _, m := range p.methods {
+	// gRPC looks the methods up by name, the order is only for the presentation (reflection, logs): sorted
+	// to be stable regardless of the order of the methods in the proto file
+	for _, m := range sortedCopy(p.methods) {
 		desc.Methods = append(desc.Methods, grpc.MethodDesc{
 			MethodName: m,
 			Handler:    p.methodHandler(m),
@@ -119,6 +239,13 @@ func (p *Proxy) ServiceDesc() *grpc.ServiceDesc {
 	return desc
 }
 
+func sortedCopy(values []string) []string {
+	sorted := make([]string, len(values))
+	copy(sorted, values)
+	sort.Strings(sorted)
+	return sorted
+}
+
 // Generate method handler proxy.
 // returns grpc method handler
 /*
@@ -129,6 +256,10 @@ type MethodDesc struct {
 }
 */
 func (p *Proxy) methodHandler(method string) func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	if md, ok := p.opts.DecodedMethods[fullMethod(p.name, method)]; ok {
+		return p.decodedMethodHandler(method, md)
+	}
+
 	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
 		in := &codec.RawMessage{}
 		if err := dec(in); err != nil {
@@ -141,7 +272,7 @@ func (p *Proxy) methodHandler(method string) func(srv any, ctx context.Context,
 
 		info := &grpc.UnaryServerInfo{
 			Server:     srv,
-			FullMethod: fmt.Sprintf("/%s/%s", p.name, method),
+			FullMethod: fullMethod(p.name, method),
 		}
 
 		handler := func(ctx context.Context, req any) (any, error) {
@@ -152,34 +283,325 @@ func (p *Proxy) methodHandler(method string) func(srv any, ctx context.Context,
 	}
 }
 
+// decodedMethodHandler returns the handler passing the decoded messages to the interceptors, see
+// Options.DecodedMethods
+func (p *Proxy) decodedMethodHandler(method string, md protoreflect.MethodDescriptor) func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+	handler := func(ctx context.Context, req any) (any, error) {
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return nil, status.Errorf(codes.Internal, "request of the method %s is not a proto message: %T", method, req)
+		}
+
+		body, err := proto.Marshal(msg)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "request encoding failed: %v", err)
+		}
+
+		resp, err := p.invoke(ctx, method, (*codec.RawMessage)(&body))
+		if err != nil {
+			return nil, err
+		}
+
+		out := dynamicpb.NewMessage(md.Output())
+		err = proto.Unmarshal(resp.(codec.RawMessage), out)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "worker returned malformed %s response: %v", md.Output().FullName(), err)
+		}
+
+		return out, nil
+	}
+
+	return func(srv any, ctx context.Context, dec func(any) error, interceptor grpc.UnaryServerInterceptor) (any, error) {
+		in := dynamicpb.NewMessage(md.Input())
+		if err := dec(in); err != nil {
+			return nil, wrapError(err)
+		}
+
+		if interceptor == nil {
+			return handler(ctx, in)
+		}
+
+		info := &grpc.UnaryServerInfo{
+			Server:     srv,
+			FullMethod: fullMethod(p.name, method),
+		}
+
+		return interceptor(ctx, in, info, handler)
+	}
+}
+
 func (p *Proxy) invoke(ctx context.Context, method string, in *codec.RawMessage) (any, error) {
+	if p.opts.InstanceID != "" {
+		// sent with the status when the call fails, error is possible only when there is no server stream in the context
+		_ = grpc.SetHeader(ctx, metadata.Pairs(instanceHeader, p.opts.InstanceID))
+	}
+
+	if p.stopped.Load() {
+		return nil, status.Errorf(codes.Unavailable, "service %s is temporarily unavailable", p.name)
+	}
+
+	if len(p.opts.RequestValidators) > 0 {
+		if validate, ok := p.opts.RequestValidators[fullMethod(p.name, method)]; ok {
+			if err := validate(*in); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid request: %v", err)
+			}
+		}
+	}
+
+	if len(p.opts.RequestTransforms) > 0 {
+		if transform, ok := p.opts.RequestTransforms[fullMethod(p.name, method)]; ok {
+			body, err := transform(*in)
+			if err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "request transform failed: %v", err)
+			}
+
+			in = (*codec.RawMessage)(&body)
+		}
+	}
+
 	pld := p.getPld()
-	defer p.putPld(pld)
 
 	err := p.makePayload(ctx, method, in, pld)
 	if err != nil {
+		p.putPld(pld)
 		return nil, err
 	}
 
-	p.mu.RLock()
-	resp, err := p.grpcPool.Exec(ctx, pld)
-	p.mu.RUnlock()
+	if p.opts.Breaker != nil && !p.opts.Breaker.Allow() {
+		p.putPld(pld)
+		return nil, status.Errorf(codes.Unavailable, "service %s is temporarily unavailable: workers are failing", p.name)
+	}
 
-	if err != nil {
-		return nil, wrapError(err)
+	var execStart *atomic.Int64
+	if p.opts.QueueWaitObserver != nil || p.opts.QueueWaitHeader {
+		execStart = &atomic.Int64{}
+		ctx = context.WithValue(ctx, execStartKey{}, execStart)
 	}
 
-	md, err := p.responseMetadata(resp)
+	start := time.Now()
+	resp, err := p.exec(ctx, pld)
+	p.observeExec(ctx, method, time.Since(start))
+	if execStart != nil {
+		p.observeQueueWait(ctx, method, start, execStart.Load())
+	}
+	if p.opts.Breaker != nil {
+		p.opts.Breaker.Done(ctx, err)
+	}
 	if err != nil {
 		return nil, err
 	}
-	ctx = metadata.NewIncomingContext(ctx, md)
-	err = grpc.SetHeader(ctx, md)
+
+	if p.opts.ResponseEnvelope {
+		err = p.setEnvelope(ctx, resp)
+	} else {
+		err = p.setResponseMetadata(ctx, resp)
+	}
+
 	if err != nil {
+		var mce *malformedContextError
+		if stderr.As(err, &mce) {
+			if p.opts.ProtocolErrorObserver != nil {
+				p.opts.ProtocolErrorObserver(ctx, fullMethod(p.name, method), mce.data, mce.err)
+			}
+
+			return nil, status.Error(codes.Internal, mce.Error())
+		}
+
 		return nil, err
 	}
 
-	return codec.RawMessage(resp.Body), nil
+	body := resp.Body
+	if len(p.opts.ResponseTransforms) > 0 {
+		if transform, ok := p.opts.ResponseTransforms[fullMethod(p.name, method)]; ok {
+			body, err = transform(resp.Body)
+			if err != nil {
+				return nil, status.Errorf(codes.Internal, "response transform failed: %v", err)
+			}
+		}
+	}
+
+	// e.g. google.protobuf.Empty or the write operations returning the metadata only: the zero-length body is
+	// the valid empty message, nil is not a message
+	if body == nil {
+		body = []byte{}
+	}
+
+	if p.opts.CompressMinSize > 0 {
+		p.setCompressor(ctx, len(body))
+	}
+
+	return codec.RawMessage(body), nil
+}
+
+// setCompressor sends the responses smaller than CompressMinSize uncompressed and compresses the bigger ones with gzip
+// when the client accepts it (regardless of the request compression)
+func (p *Proxy) setCompressor(ctx context.Context, size int) {
+	name := encoding.Identity
+	if size >= p.opts.CompressMinSize {
+		accepted, err := grpc.ClientSupportedCompressors(ctx)
+		if err != nil {
+			return
+		}
+
+		for i := 0; i < len(accepted); i++ {
+			if strings.TrimSpace(accepted[i]) == gzip.Name {
+				name = gzip.Name
+				break
+			}
+		}
+
+		// keep the compressor chosen by gRPC (the one the request was compressed with)
+		if name != gzip.Name {
+			return
+		}
+	}
+
+	// error is possible only when there is no server stream in the context
+	_ = grpc.SetSendCompressor(ctx, name)
+}
+
+// setResponseMetadata sends the response metadata returned by the worker in the context to the client, the error
+// and the status keys of the metadata fail the call (legacy response format)
+func (p *Proxy) setResponseMetadata(ctx context.Context, resp *payload.Payload) error {
+	md, err := p.responseMetadata(resp)
+	if err != nil {
+		return retryInfo(ctx, md, err)
+	}
+
+	trailer, err := statusTrailer(md, p.opts.StatusKey)
+	if err != nil {
+		return err
+	}
+
+	p.setHeader(ctx, md)
+
+	if trailer != nil {
+		err = grpc.SetTrailer(ctx, trailer)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setHeader sets the response headers returned by the worker. The headers can't be set once they were sent
+// (e.g. by an interceptor calling grpc.SendHeader), the call still succeeds then: the worker's response is more
+// important than its headers.
+func (p *Proxy) setHeader(ctx context.Context, md metadata.MD) {
+	if len(md) == 0 {
+		return
+	}
+
+	err := grpc.SetHeader(ctx, md)
+	if err != nil {
+		method, _ := grpc.Method(ctx)
+		p.log.Warn("response headers returned by the worker were not sent", zap.String("method", method), zap.Error(err))
+	}
+}
+
+// poolExec sends the payload to the worker preferred for the call's affinity key when the pool supports it, the calls
+// without the key are scheduled as usual
+func (p *Proxy) poolExec(ctx context.Context, pld *payload.Payload) (*payload.Payload, error) {
+	if p.opts.AffinityKey != "" {
+		if ap, ok := p.grpcPool.(AffinityPool); ok {
+			if key := affinityKey(ctx, p.opts.AffinityKey); key != "" {
+				return ap.ExecWithAffinity(ctx, key, pld)
+			}
+		}
+	}
+
+	return p.grpcPool.Exec(ctx, pld)
+}
+
+// affinityKey returns the first non-empty value of the metadata key
+func affinityKey(ctx context.Context, key string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+
+	values := md.Get(key)
+	for i := 0; i < len(values); i++ {
+		if values[i] != "" {
+			return values[i]
+		}
+	}
+
+	return ""
+}
+
+// observeExec reports the worker execution time
+func (p *Proxy) observeExec(ctx context.Context, method string, elapsed time.Duration) {
+	if p.opts.ExecObserver != nil {
+		p.opts.ExecObserver(ctx, fullMethod(p.name, method), elapsed)
+	}
+
+	if p.opts.ExecTimeHeader {
+		// error is possible only when there is no server stream in the context
+		_ = grpc.SetHeader(ctx, metadata.Pairs(execTimeHeader, strconv.FormatFloat(float64(elapsed)/float64(time.Millisecond), 'f', 3, 64)))
+	}
+}
+
+// observeQueueWait reports the time from the pool Exec call to the worker allocation reported by the pool, nothing is
+// reported when the pool doesn't report it or the call was canceled before
+func (p *Proxy) observeQueueWait(ctx context.Context, method string, start time.Time, execStart int64) {
+	if execStart == 0 {
+		return
+	}
+
+	wait := time.Unix(0, execStart).Sub(start)
+	if wait < 0 {
+		wait = 0
+	}
+
+	if p.opts.QueueWaitObserver != nil {
+		p.opts.QueueWaitObserver(ctx, fullMethod(p.name, method), wait)
+	}
+
+	if p.opts.QueueWaitHeader {
+		// error is possible only when there is no server stream in the context
+		_ = grpc.SetHeader(ctx, metadata.Pairs(queueWaitHeader, strconv.FormatFloat(float64(wait)/float64(time.Millisecond), 'f', 3, 64)))
+	}
+}
+
+// fullMethod returns the full method name: /package.Service/Method
+func fullMethod(service, method string) string {
+	return "/" + service + "/" + method
+}
+
+// exec sends the payload to the worker. The pool observes the context: the wait for a free worker is aborted and
+// the busy worker is killed (and replaced) on cancellation when the supervisor's exec_ttl is set, otherwise the worker
+// can't be interrupted. The canceled call is not returned before its worker is released, so the canceled calls keep
+// occupying their streams (max_concurrent_streams) instead of piling more load onto the busy workers.
+func (p *Proxy) exec(ctx context.Context, pld *payload.Payload) (*payload.Payload, error) {
+	execCtx, span := p.startExecSpan(ctx)
+
+	p.mu.RLock()
+	resp, err := p.poolExec(execCtx, pld)
+	p.mu.RUnlock()
+
+	endExecSpan(span, err)
+	p.putPld(pld)
+
+	// e.g. the error of the killed worker, the client receives the status of its canceled call
+	if ctx.Err() != nil {
+		return nil, status.FromContextError(ctx.Err()).Err()
+	}
+
+	if err != nil {
+		if p.opts.ErrorMapper != nil {
+			return nil, mapError(p.opts.ErrorMapper, err)
+		}
+
+		if p.opts.JSONErrorDetails {
+			return nil, wrapErrorDetails(err, jsonDetails)
+		}
+
+		return nil, wrapError(err)
+	}
+
+	return resp, nil
 }
 
 // responseMetadata extracts metadata from roadrunner response Payload.Context and converts it to metadata.MD
@@ -190,12 +612,24 @@ func (p *Proxy) responseMetadata(resp *payload.Payload) (metadata.MD, error) {
 	}
 
 	var rpcMetadata map[string]string
-	err := json.Unmarshal(resp.Context, &rpcMetadata)
+	err := p.ctxCodec.Unmarshal(resp.Context, &rpcMetadata)
 	if err != nil {
-		return md, err
+		return md, &malformedContextError{what: "response context", data: resp.Context, err: err}
 	}
 
 	if len(rpcMetadata) > 0 {
+		// the count is checked first, the size check sorts the entries
+		if p.opts.MaxMetadataKeys > 0 && len(rpcMetadata) > p.opts.MaxMetadataKeys {
+			return nil, metadataKeysError(len(rpcMetadata), p.opts.MaxMetadataKeys)
+		}
+
+		if p.opts.MaxMetadataSize > 0 {
+			err = checkMetadataSize(rpcMetadata, p.opts.MaxMetadataSize)
+			if err != nil {
+				return nil, err
+			}
+		}
+
 		md = metadata.New(rpcMetadata)
 
 		/*
@@ -206,46 +640,227 @@ func (p *Proxy) responseMetadata(resp *payload.Payload) (metadata.MD, error) {
 			but, we use this only in case of PHP exception happened
 
 		*/
-		if len(md.Get(apiErr)) > 0 {
-			st := &spb.Status{}
-
+		if errKey := keyOrDefault(p.opts.ErrorKey, apiErr); len(md.Get(errKey)) > 0 {
 			// get an error
-			data, err := base64.StdEncoding.DecodeString(md.Get(apiErr)[0])
+			st, err := decodeStatus(errKey, md.Get(errKey)[0])
 			if err != nil {
 				return nil, err
 			}
 
-			err = proto.Unmarshal(data, st)
+			return md, status.ErrorProto(st)
+		}
+
+		// status explicitly set by the worker, not OK status is handled the same way as the error
+		if statusKey := p.opts.StatusKey; statusKey != "" && len(md.Get(statusKey)) > 0 {
+			st, err := decodeStatus(statusKey, md.Get(statusKey)[0])
 			if err != nil {
 				return nil, err
 			}
 
-			return md, status.ErrorProto(st)
+			if codes.Code(st.GetCode()) != codes.OK {
+				return md, status.ErrorProto(st)
+			}
 		}
 	}
 
 	return md, nil
 }
 
+// malformedContextError is returned when the response context can't be decoded: the worker (or the worker SDK) violates
+// the protocol, unlike the errors returned by the handler
+type malformedContextError struct {
+	what string
+	data []byte
+	err  error
+}
+
+func (e *malformedContextError) Error() string {
+	return "worker returned malformed " + e.what + ": " + e.err.Error()
+}
+
+func (e *malformedContextError) Unwrap() error {
+	return e.err
+}
+
+// checkMetadataSize returns the Internal error naming the largest entries when the metadata size exceeds the limit
+func checkMetadataSize(md map[string]string, limit int) error {
+	type entry struct {
+		key  string
+		size int
+	}
+
+	total := 0
+	entries := make([]entry, 0, len(md))
+	for k, v := range md {
+		// HTTP/2 header list size accounting (RFC 7540, 6.5.2)
+		size := len(k) + len(v) + 32
+		total += size
+		entries = append(entries, entry{key: k, size: size})
+	}
+
+	if total <= limit {
+		return nil
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].size > entries[j].size
+	})
+
+	largest := make([]string, 0, 3)
+	for i := 0; i < len(entries) && i < 3; i++ {
+		largest = append(largest, fmt.Sprintf("%s (%d)", entries[i].key, entries[i].size))
+	}
+
+	return status.Errorf(codes.Internal, "worker response metadata size (%d) exceeds the limit (%d), largest keys: %s", total, limit, strings.Join(largest, ", "))
+}
+
+// metadataKeysError returns the Internal error for the response metadata with too many keys
+func metadataKeysError(count, limit int) error {
+	return status.Errorf(codes.Internal, "worker response metadata has %d keys, exceeds the limit (%d)", count, limit)
+}
+
+// statusTrailer moves the OK status provided by the worker from the headers to the trailer.
+// gRPC sends status details only for the errors, so the status is sent in the status-details-bin trailer
+// (serialized google.rpc.Status) for the clients interested in the details of the successful call.
+func statusTrailer(md metadata.MD, key string) (metadata.MD, error) {
+	if key == "" || len(md.Get(key)) == 0 {
+		return nil, nil
+	}
+
+	st, err := decodeStatus(key, md.Get(key)[0])
+	if err != nil {
+		return nil, err
+	}
+
+	md.Delete(key)
+
+	data, err := proto.Marshal(st)
+	if err != nil {
+		return nil, err
+	}
+
+	return metadata.Pairs(statusDetails, string(data)), nil
+}
+
+// decodeStatus decodes base64 encoded google.rpc.Status of the metadata key. The value which can't be fully decoded
+// fails the call with the Internal status naming the failure instead of sending a malformed status to the client.
+func decodeStatus(key, val string) (*spb.Status, error) {
+	data, err := base64.StdEncoding.DecodeString(val)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "worker returned malformed %s metadata: invalid base64: %v", key, err)
+	}
+
+	st := &spb.Status{}
+	err = proto.Unmarshal(data, st)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "worker returned malformed %s metadata: invalid google.rpc.Status proto: %v", key, err)
+	}
+
+	return st, nil
+}
+
+// retryInfo attaches the worker suggested retry delay (if any) to the error status
+func retryInfo(ctx context.Context, md metadata.MD, err error) error {
+	if len(md.Get(retryAfter)) == 0 {
+		return err
+	}
+
+	delay, errP := parseRetryDelay(md.Get(retryAfter)[0])
+	if errP != nil {
+		return err
+	}
+
+	st, ok := status.FromError(err)
+	if !ok {
+		return err
+	}
+
+	st, errD := st.WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(delay)})
+	if errD != nil {
+		return err
+	}
+
+	// error is possible only when there is no server stream in the context
+	_ = grpc.SetTrailer(ctx, metadata.Pairs(retryPushback, strconv.FormatInt(delay.Milliseconds(), 10)))
+
+	return st.Err()
+}
+
+// parseRetryDelay accepts either a duration string or a number of milliseconds
+func parseRetryDelay(val string) (time.Duration, error) {
+	if ms, err := strconv.ParseUint(val, 10, 63); err == nil {
+		return time.Duration(ms) * time.Millisecond, nil
+	}
+
+	delay, err := time.ParseDuration(val)
+	if err != nil {
+		return 0, err
+	}
+
+	if delay < 0 {
+		return 0, errors.Errorf("negative retry delay: %s", val)
+	}
+
+	return delay, nil
+}
+
 // makePayload generates RoadRunner compatible payload based on GRPC message.
 func (p *Proxy) makePayload(ctx context.Context, method string, body *codec.RawMessage, pld *payload.Payload) error {
 	ctxMD := make(map[string][]string)
 
 	if md, ok := metadata.FromIncomingContext(ctx); ok {
 		for k, v := range md {
+			if !p.forwardMetadata(k) {
+				continue
+			}
+
 			ctxMD[k] = v
 		}
 	}
 
+	ctxMD[contentSubtype] = []string{ContentSubtype(ctx)}
+
+	for _, cv := range p.opts.ContextValues {
+		delete(ctxMD, cv.Name)
+
+		v := ctx.Value(cv.Key)
+		if v == nil {
+			continue
+		}
+
+		values, err := cv.Serialize(v)
+		if err != nil {
+			continue
+		}
+
+		ctxMD[cv.Name] = values
+	}
+
+	// grpc-go consumes the grpc-timeout header into the context deadline, the header is restored from the remaining
+	// time, so it is forwarded only when the client sent the deadline (possibly capped by the server)
+	_, serverDeadline := ctx.Value(serverDeadlineKey{}).(bool)
+	if deadline, ok := ctx.Deadline(); ok && !serverDeadline && p.forwardMetadata(grpcTimeout) {
+		ctxMD[grpcTimeout] = []string{encodeTimeout(time.Until(deadline))}
+	}
+
+	// the host header is renamed to :authority by gRPC when the pseudo-header is missing, only one value is allowed
+	if len(ctxMD[authority]) > 0 {
+		ctxMD[authority] = ctxMD[authority][:1]
+	}
+
+	ctxMD[scheme] = []string{"http"}
 	if pr, ok := peer.FromContext(ctx); ok {
-		ctxMD[peerAddr] = []string{pr.Addr.String()}
+		ctxMD[peerAddr] = []string{formatPeerAddress(pr.Addr, p.opts.PeerAddressFormat)}
 		if pr.AuthInfo != nil {
 			ctxMD[peerAuthType] = []string{pr.AuthInfo.AuthType()}
 		}
-	}
 
-	ctxData, err := json.Marshal(rpcContext{Service: p.name, Method: method, Context: ctxMD})
+		if _, isTLS := pr.AuthInfo.(credentials.TLSInfo); isTLS {
+			ctxMD[scheme] = []string{"https"}
+		}
+	}
 
+	ctxData, err := p.marshalContext(method, ctxMD)
 	if err != nil {
 		return err
 	}
@@ -256,6 +871,119 @@ func (p *Proxy) makePayload(ctx context.Context, method string, body *codec.RawM
 	return nil
 }
 
+// encodeTimeout encodes the duration in the grpc-timeout header format: the smallest unit keeping the value in 8 digits,
+// rounded up
+func encodeTimeout(t time.Duration) string {
+	if t <= 0 {
+		return "0n"
+	}
+
+	units := []struct {
+		d    time.Duration
+		unit string
+	}{
+		{time.Nanosecond, "n"},
+		{time.Microsecond, "u"},
+		{time.Millisecond, "m"},
+		{time.Second, "S"},
+		{time.Minute, "M"},
+	}
+
+	for _, u := range units {
+		if v := divCeil(t, u.d); v <= maxTimeoutValue {
+			return strconv.FormatInt(v, 10) + u.unit
+		}
+	}
+
+	return strconv.FormatInt(divCeil(t, time.Hour), 10) + "H"
+}
+
+func divCeil(d, r time.Duration) int64 {
+	if d%r > 0 {
+		return int64(d/r + 1)
+	}
+
+	return int64(d / r)
+}
+
+// forwardMetadata reports whether the incoming metadata key is forwarded to the worker
+func (p *Proxy) forwardMetadata(key string) bool {
+	if strings.HasPrefix(key, ":") {
+		return true
+	}
+
+	if matchKey(p.opts.MetadataDenylist, key) {
+		return false
+	}
+
+	return len(p.opts.MetadataAllowlist) == 0 || matchKey(p.opts.MetadataAllowlist, key)
+}
+
+// matchKey reports whether the key matches any of the patterns: exact key or prefix with the trailing *
+func matchKey(patterns []string, key string) bool {
+	for _, pattern := range patterns {
+		if strings.HasSuffix(pattern, "*") {
+			if strings.HasPrefix(key, strings.TrimSuffix(pattern, "*")) {
+				return true
+			}
+
+			continue
+		}
+
+		if pattern == key {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ContentSubtype returns the content subtype of the incoming call, e.g. json for application/grpc+json.
+// The gRPC server encodes the response with the same subtype, proto is used when the subtype is not set.
+func ContentSubtype(ctx context.Context) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok || len(md.Get(contentType)) == 0 {
+		return baseSubtype
+	}
+
+	ct := md.Get(contentType)[0]
+	if i := strings.IndexAny(ct, "+;"); i != -1 && ct[i] == '+' {
+		sub := ct[i+1:]
+		if j := strings.IndexByte(sub, ';'); j != -1 {
+			sub = sub[:j]
+		}
+
+		if sub != "" {
+			return strings.ToLower(sub)
+		}
+	}
+
+	return baseSubtype
+}
+
+// marshalContext encodes the context sent to the worker, the keys could be renamed for the workers expecting
+// a different schema
+func (p *Proxy) marshalContext(method string, ctxMD map[string][]string) ([]byte, error) {
+	keys := p.opts.ContextKeys
+	if keys == nil {
+		return p.ctxCodec.Marshal(rpcContext{Service: p.name, Method: method, Context: ctxMD})
+	}
+
+	return p.ctxCodec.Marshal(map[string]any{
+		keyOrDefault(keys.Service, "service"): p.name,
+		keyOrDefault(keys.Method, "method"):   method,
+		keyOrDefault(keys.Context, "context"): ctxMD,
+	})
+}
+
+func keyOrDefault(key, def string) string {
+	if key == "" {
+		return def
+	}
+
+	return key
+}
+
 func (p *Proxy) putPld(pld *payload.Payload) {
 	pld.Body = nil
 	pld.Context = nil
@@ -264,7 +992,7 @@ func (p *Proxy) putPld(pld *payload.Payload) {
 
 func (p *Proxy) getPld() *payload.Payload {
 	pld := p.pldPool.Get().(*payload.Payload)
-	pld.Codec = frame.CodecJSON
+	pld.Codec = p.ctxCodec.Frame()
 	return pld
 }
 
@@ -283,6 +1011,12 @@ func GetOriginalErr(err error) string {
 
 // mounts proper error code for the error
 func wrapError(err error) error {
+	return wrapErrorDetails(err, binaryDetails)
+}
+
+// wrapErrorDetails converts the worker error (code|:|message|:|details) to the status, the details chunks are
+// decoded with the provided function
+func wrapErrorDetails(err error, details func(chunks []string) []*anypb.Any) error {
 	// internal agreement
 	errMsg := GetOriginalErr(err)
 	if strings.Contains(errMsg, delimiter) {
@@ -294,6 +1028,10 @@ func wrapError(err error) error {
 			return err
 		}
 
+		if chunks[0] == protoMismatch {
+			return versionMismatchError(chunks[1:])
+		}
+
 		phpCode, errConv := strconv.ParseUint(chunks[0], 10, 32)
 		if errConv != nil {
 			return err
@@ -304,17 +1042,142 @@ func wrapError(err error) error {
 		}
 
 		st := status.New(code, chunks[1]).Proto()
+		st.Details = details(chunks[2:])
+
+		return status.ErrorProto(st)
+	}
+
+	return status.Error(codes.Internal, err.Error())
+}
+
+// DefaultErrorMapper converts the worker error message (code|:|message|:|details) the same way as it is done
+// without the ErrorMapper, the custom mappers may use it for the errors they don't handle.
+func DefaultErrorMapper(errMsg string) (codes.Code, string, []proto.Message) {
+	st := status.Convert(wrapError(errors.Str(errMsg)))
+	return st.Code(), st.Message(), anyMessages(st.Proto().GetDetails())
+}
+
+// mapError converts the worker error to the status with the mapper
+func mapError(mapper ErrorMapper, err error) error {
+	code, msg, details := mapper(GetOriginalErr(err))
+	// the call can't fail with OK
+	if code == codes.OK {
+		code = codes.Unknown
+	}
+
+	st := status.New(code, msg).Proto()
+	for i := 0; i < len(details); i++ {
+		if detail, ok := details[i].(*anypb.Any); ok {
+			st.Details = append(st.Details, detail)
+			continue
+		}
+
+		detail, errA := anypb.New(details[i])
+		if errA != nil {
+			continue
+		}
 
-		for _, detailsMessage := range chunks[2:] {
-			anyDetailsMessage := anypb.Any{}
-			errP := proto.Unmarshal([]byte(detailsMessage), &anyDetailsMessage)
+		st.Details = append(st.Details, detail)
+	}
+
+	return status.ErrorProto(st)
+}
+
+func anyMessages(details []*anypb.Any) []proto.Message {
+	if len(details) == 0 {
+		return nil
+	}
+
+	messages := make([]proto.Message, 0, len(details))
+	for i := 0; i < len(details); i++ {
+		messages = append(messages, details[i])
+	}
+
+	return messages
+}
+
+// binaryDetails decodes the serialized google.protobuf.Any messages, one per chunk, malformed messages are skipped.
+// The delimiter may be a part of the serialized message (e.g. the ResourceInfo resource name), the chunk which
+// can't be decoded is joined with the next ones until the message is decoded: the truncated message is never
+// valid, the delimiter can't start the next field of Any.
+//
+// The worker returns the NotFound with the resource info as:
+//
+//	5|:|user was not found|:|<serialized Any of google.rpc.ResourceInfo>
+func binaryDetails(chunks []string) []*anypb.Any {
+	var details []*anypb.Any
+	for i := 0; i < len(chunks); i++ {
+		detailsMessage := chunks[i]
+		for j := i; ; j++ {
+			anyDetailsMessage := &anypb.Any{}
+			errP := proto.Unmarshal([]byte(detailsMessage), anyDetailsMessage)
 			if errP == nil {
-				st.Details = append(st.Details, &anyDetailsMessage)
+				details = append(details, anyDetailsMessage)
+				i = j
+				break
 			}
+
+			// the malformed chunk is skipped
+			if j+1 == len(chunks) {
+				break
+			}
+
+			detailsMessage += delimiter + chunks[j+1]
 		}
+	}
 
-		return status.ErrorProto(st)
+	return details
+}
+
+// jsonDetails decodes the JSON array of the details in the google.protobuf.Any JSON form:
+//
+//	[{"@type": "type.googleapis.com/google.rpc.ErrorInfo", "reason": "USER_BLOCKED", "domain": "app"}]
+//
+// The types are resolved from the types linked into the server (e.g. google.rpc error details), the details with
+// the unknown types and the malformed details are skipped.
+func jsonDetails(chunks []string) []*anypb.Any {
+	if len(chunks) == 0 {
+		return nil
 	}
 
-	return status.Error(codes.Internal, err.Error())
+	var raw []json.RawMessage
+	// the delimiter can't separate the array elements, but may be a part of the string
+	err := json.Unmarshal([]byte(strings.Join(chunks, delimiter)), &raw)
+	if err != nil {
+		return nil
+	}
+
+	details := make([]*anypb.Any, 0, len(raw))
+	for i := 0; i < len(raw); i++ {
+		detail := &anypb.Any{}
+		if protojson.Unmarshal(raw[i], detail) == nil {
+			details = append(details, detail)
+		}
+	}
+
+	return details
+}
+
+// versionMismatchError returns the Unimplemented status for the worker reported proto version mismatch:
+// message|:|expected version|:|actual version, versions are optional
+func versionMismatchError(chunks []string) error {
+	md := make(map[string]string, 2)
+	if len(chunks) > 1 && chunks[1] != "" {
+		md["expected_version"] = chunks[1]
+	}
+
+	if len(chunks) > 2 && chunks[2] != "" {
+		md["actual_version"] = chunks[2]
+	}
+
+	st, err := status.New(codes.Unimplemented, chunks[0]).WithDetails(&errdetails.ErrorInfo{
+		Reason:   protoMismatchReason,
+		Domain:   protoMismatchDomain,
+		Metadata: md,
+	})
+	if err != nil {
+		return status.Error(codes.Unimplemented, chunks[0])
+	}
+
+	return st.Err()
 }
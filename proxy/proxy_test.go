@@ -1,11 +1,41 @@
 package proxy
 
 import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
 	stderr "errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/goridge/v3/pkg/frame"
+	"github.com/roadrunner-server/grpc/v3/codec"
+	"github.com/roadrunner-server/grpc/v3/proxy/proxytest"
+	"github.com/roadrunner-server/sdk/v3/payload"
+	"github.com/roadrunner-server/sdk/v3/worker"
 	"github.com/stretchr/testify/require"
+	"github.com/vmihailenco/msgpack/v5"
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	spb "google.golang.org/genproto/googleapis/rpc/status"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/types/known/anypb"
 )
 
 func TestWrapError(t *testing.T) {
@@ -15,6 +45,26 @@ func TestWrapError(t *testing.T) {
 	require.Equal(t, "rpc error: code = PermissionDenied desc = Unauthorized access `index`", newErr.Error())
 }
 
+func TestWrapErrorVersionMismatch(t *testing.T) {
+	err := wrapError(stderr.New("proto-mismatch|:|unknown field 5 in app.Request|:|v2|:|v3"))
+
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.Unimplemented, st.Code())
+	require.Equal(t, "unknown field 5 in app.Request", st.Message())
+	require.Len(t, st.Details(), 1)
+
+	info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	require.True(t, ok)
+	require.Equal(t, protoMismatchReason, info.GetReason())
+	require.Equal(t, map[string]string{"expected_version": "v2", "actual_version": "v3"}, info.GetMetadata())
+
+	// versions are optional
+	st = status.Convert(wrapError(stderr.New("proto-mismatch|:|unknown method")))
+	require.Equal(t, codes.Unimplemented, st.Code())
+	require.Empty(t, st.Details()[0].(*errdetails.ErrorInfo).GetMetadata())
+}
+
 func TestRRErrorPackage(t *testing.T) {
 	msg := "7|:|Unauthorized access `index`|:|\n(type.googleapis.com/google.rpc.ErrorInfo\u0012_\n\u0010PermissionDenied\u0012#app.ServiceName\u001a&\n\u0007message\u0012\u001bUnauthorized access `index`"
 	const op1 = errors.Op("foo_op")
@@ -26,3 +76,1117 @@ func TestRRErrorPackage(t *testing.T) {
 	retErr := wrapError(err)
 	require.Equal(t, "rpc error: code = PermissionDenied desc = Unauthorized access `index`", retErr.Error())
 }
+
+func TestRetryInfo(t *testing.T) {
+	md := metadata.Pairs(retryAfter, "1500")
+	err := retryInfo(context.Background(), md, status.Error(codes.Unavailable, "overloaded"))
+
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.Unavailable, st.Code())
+	require.Len(t, st.Details(), 1)
+
+	ri, ok := st.Details()[0].(*errdetails.RetryInfo)
+	require.True(t, ok)
+	require.Equal(t, time.Millisecond*1500, ri.GetRetryDelay().AsDuration())
+
+	// malformed delay should not change the error
+	md = metadata.Pairs(retryAfter, "soon")
+	err = retryInfo(context.Background(), md, status.Error(codes.Unavailable, "overloaded"))
+	st, _ = status.FromError(err)
+	require.Len(t, st.Details(), 0)
+}
+
+func TestParseRetryDelay(t *testing.T) {
+	d, err := parseRetryDelay("2s")
+	require.NoError(t, err)
+	require.Equal(t, time.Second*2, d)
+
+	d, err = parseRetryDelay("250")
+	require.NoError(t, err)
+	require.Equal(t, time.Millisecond*250, d)
+
+	_, err = parseRetryDelay("-1s")
+	require.Error(t, err)
+}
+
+// slowPool emulates a busy worker which can't be interrupted (the pool without the supervisor's exec_ttl)
+type slowPool struct {
+	release chan struct{}
+	done    chan struct{}
+}
+
+func (s *slowPool) Workers() []*worker.Process {
+	return nil
+}
+
+func (s *slowPool) Exec(_ context.Context, _ *payload.Payload) (*payload.Payload, error) {
+	<-s.release
+	close(s.done)
+	return &payload.Payload{}, nil
+}
+
+func (s *slowPool) Reset(context.Context) error {
+	return nil
+}
+
+func (s *slowPool) Destroy(context.Context) {}
+
+func TestInvokeCanceled(t *testing.T) {
+	pool := &slowPool{
+		release: make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+
+	mu := &sync.RWMutex{}
+	px := NewProxy("app.Service", "", pool, mu, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+		// the worker is still busy
+		time.Sleep(time.Millisecond * 200)
+		close(pool.release)
+	}()
+
+	_, err := px.invoke(ctx, "Method", &codec.RawMessage{})
+
+	// the canceled call is returned only after the worker was released
+	select {
+	case <-pool.done:
+	default:
+		t.Fatal("canceled call was returned before the worker was released")
+	}
+
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.Canceled, st.Code())
+	require.True(t, mu.TryLock(), "pool lock was not released after the worker finished")
+	mu.Unlock()
+}
+
+// ttlPool emulates the pool with the supervisor's exec_ttl: the busy worker is killed when the context is canceled
+type ttlPool struct {
+	killed atomic.Bool
+}
+
+func (s *ttlPool) Workers() []*worker.Process {
+	return nil
+}
+
+func (s *ttlPool) Exec(ctx context.Context, _ *payload.Payload) (*payload.Payload, error) {
+	select {
+	case <-ctx.Done():
+		s.killed.Store(true)
+		return nil, errors.E(errors.ExecTTL, ctx.Err())
+	case <-time.After(time.Minute):
+		return &payload.Payload{}, nil
+	}
+}
+
+func (s *ttlPool) Reset(context.Context) error {
+	return nil
+}
+
+func (s *ttlPool) Destroy(context.Context) {}
+
+func TestInvokeCanceledWorkerKilled(t *testing.T) {
+	pool := &ttlPool{}
+	mu := &sync.RWMutex{}
+	px := NewProxy("app.Service", "", pool, mu, nil)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		time.Sleep(time.Millisecond * 100)
+		cancel()
+	}()
+
+	start := time.Now()
+	_, err := px.invoke(ctx, "Method", &codec.RawMessage{})
+	require.Less(t, time.Since(start), time.Second)
+	require.True(t, pool.killed.Load())
+
+	// the context status instead of the pool's error
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.Canceled, st.Code())
+	require.True(t, mu.TryLock(), "pool lock was not released after the worker was killed")
+	mu.Unlock()
+}
+
+func TestContentSubtype(t *testing.T) {
+	tests := map[string]string{
+		"application/grpc":                   "proto",
+		"application/grpc+json":              "json",
+		"application/grpc+JSON;charset=utf8": "json",
+		"application/grpc;charset=utf8":      "proto",
+		"application/grpc+":                  "proto",
+	}
+
+	for ct, expected := range tests {
+		ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("content-type", ct))
+		require.Equal(t, expected, ContentSubtype(ctx), ct)
+	}
+
+	require.Equal(t, "proto", ContentSubtype(context.Background()))
+}
+
+func TestProxyStop(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, nil)
+	px.Stop()
+
+	_, err := px.invoke(context.Background(), "Method", &codec.RawMessage{})
+	st, ok := status.FromError(err)
+	require.True(t, ok)
+	require.Equal(t, codes.Unavailable, st.Code())
+}
+
+func TestResponseMetadataStatus(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, &Options{StatusKey: "status"})
+
+	details, err := anypb.New(&errdetails.ErrorInfo{Reason: "PARTIAL"})
+	require.NoError(t, err)
+	data, err := proto.Marshal(&spb.Status{Code: int32(codes.OK), Message: "partial success", Details: []*anypb.Any{details}})
+	require.NoError(t, err)
+
+	md, err := px.responseMetadata(&payload.Payload{Context: []byte(`{"status":"` + base64.StdEncoding.EncodeToString(data) + `","foo":"bar"}`)})
+	require.NoError(t, err)
+
+	trailer, err := statusTrailer(md, "status")
+	require.NoError(t, err)
+	require.Len(t, md.Get("status"), 0)
+	require.Equal(t, []string{"bar"}, md.Get("foo"))
+	require.Equal(t, []string{string(data)}, trailer.Get(statusDetails))
+
+	failed, err := proto.Marshal(status.New(codes.NotFound, "not found").Proto())
+	require.NoError(t, err)
+
+	_, err = px.responseMetadata(&payload.Payload{Context: []byte(`{"status":"` + base64.StdEncoding.EncodeToString(failed) + `"}`)})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestResponseMetadataStatusDisabled(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, nil)
+
+	failed, err := proto.Marshal(status.New(codes.NotFound, "not found").Proto())
+	require.NoError(t, err)
+
+	// the status key is the regular metadata by default
+	md, err := px.responseMetadata(&payload.Payload{Context: []byte(`{"status":"active"}`)})
+	require.NoError(t, err)
+	require.Equal(t, []string{"active"}, md.Get("status"))
+
+	md, err = px.responseMetadata(&payload.Payload{Context: []byte(`{"status":"` + base64.StdEncoding.EncodeToString(failed) + `"}`)})
+	require.NoError(t, err)
+
+	trailer, err := statusTrailer(md, "")
+	require.NoError(t, err)
+	require.Nil(t, trailer)
+	require.Len(t, md.Get("status"), 1)
+
+	px = NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, &Options{StatusKey: "x-grpc-status"})
+	_, err = px.responseMetadata(&payload.Payload{Context: []byte(`{"x-grpc-status":"` + base64.StdEncoding.EncodeToString(failed) + `","status":"active"}`)})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+func TestMarshalContextKeys(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, nil)
+	data, err := px.marshalContext("Method", map[string][]string{"foo": {"bar"}})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"service":"app.Service","method":"Method","context":{"foo":["bar"]}}`, string(data))
+
+	px = NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, &Options{ContextKeys: &ContextKeys{Service: "svc", Context: "meta"}})
+	data, err = px.marshalContext("Method", map[string][]string{"foo": {"bar"}})
+	require.NoError(t, err)
+	require.JSONEq(t, `{"svc":"app.Service","method":"Method","meta":{"foo":["bar"]}}`, string(data))
+}
+
+func TestResponseMetadataSize(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, &Options{MaxMetadataSize: 100})
+
+	_, err := px.responseMetadata(&payload.Payload{Context: []byte(`{"foo":"bar"}`)})
+	require.NoError(t, err)
+
+	_, err = px.responseMetadata(&payload.Payload{Context: []byte(`{"foo":"bar","big":"` + strings.Repeat("a", 100) + `"}`)})
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.Contains(t, err.Error(), "big (135)")
+	require.Contains(t, err.Error(), "(173) exceeds the limit (100)")
+}
+
+func TestResponseMetadataKeys(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, &Options{MaxMetadataKeys: 2})
+
+	_, err := px.responseMetadata(&payload.Payload{Context: []byte(`{"foo":"bar","baz":"qux"}`)})
+	require.NoError(t, err)
+
+	_, err = px.responseMetadata(&payload.Payload{Context: []byte(`{"a":"1","b":"2","c":"3"}`)})
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.Contains(t, err.Error(), "has 3 keys, exceeds the limit (2)")
+}
+
+func TestResponseTransform(t *testing.T) {
+	pool := &slowPool{release: make(chan struct{}), done: make(chan struct{})}
+	close(pool.release)
+
+	px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, &Options{
+		ResponseTransforms: map[string]BodyTransform{
+			"/app.Service/Method": func(body []byte) ([]byte, error) {
+				return append(body, []byte("transformed")...), nil
+			},
+		},
+	})
+
+	resp, err := px.invoke(context.Background(), "Method", &codec.RawMessage{})
+	require.NoError(t, err)
+	require.Equal(t, codec.RawMessage("transformed"), resp)
+}
+
+func TestProxyMethods(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, nil)
+	px.RegisterMethod("Ping")
+	px.RegisterMethod("Echo")
+
+	require.Equal(t, "app.Service", px.Name())
+	require.Equal(t, []string{"Ping", "Echo"}, px.Methods())
+
+	// returned slice is a copy
+	px.Methods()[0] = "Changed"
+	require.Equal(t, []string{"Ping", "Echo"}, px.Methods())
+}
+
+func TestResponseMetadataErrorKey(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, &Options{ErrorKey: "x-grpc-error"})
+
+	failed, err := proto.Marshal(status.New(codes.NotFound, "not found").Proto())
+	require.NoError(t, err)
+
+	// the default key is a regular metadata now
+	md, err := px.responseMetadata(&payload.Payload{Context: []byte(`{"error":"validation"}`)})
+	require.NoError(t, err)
+	require.Equal(t, []string{"validation"}, md.Get("error"))
+
+	_, err = px.responseMetadata(&payload.Payload{Context: []byte(`{"x-grpc-error":"` + base64.StdEncoding.EncodeToString(failed) + `"}`)})
+	require.Equal(t, codes.NotFound, status.Code(err))
+}
+
+// affinityPool records the affinity keys of the calls
+type affinityPool struct {
+	*proxytest.Pool
+	keys []string
+}
+
+func (a *affinityPool) ExecWithAffinity(ctx context.Context, key string, pld *payload.Payload) (*payload.Payload, error) {
+	a.keys = append(a.keys, key)
+	return a.Pool.Exec(ctx, pld)
+}
+
+func TestExecAffinity(t *testing.T) {
+	pool := &affinityPool{Pool: proxytest.NewPool()}
+	px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, &Options{AffinityKey: "x-session-id"})
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-session-id", "", "x-session-id", "s1"))
+	_, err := px.exec(ctx, &payload.Payload{})
+	require.NoError(t, err)
+
+	// calls without the key are scheduled as usual
+	_, err = px.exec(context.Background(), &payload.Payload{})
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"s1"}, pool.keys)
+	require.Len(t, pool.Received(), 2)
+}
+
+// strAddr is the address reported by the connection wrappers as is
+type strAddr string
+
+func (a strAddr) Network() string { return "tcp" }
+func (a strAddr) String() string  { return string(a) }
+
+func TestFormatPeerAddress(t *testing.T) {
+	tests := []struct {
+		addr   net.Addr
+		format string
+		want   string
+	}{
+		{addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, format: "", want: "192.0.2.1:5000"},
+		{addr: &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 5000}, format: PeerAddressIP, want: "192.0.2.1"},
+		{addr: strAddr("[::FFFF:192.0.2.1]:5000"), format: PeerAddressFull, want: "[::FFFF:192.0.2.1]:5000"},
+		{addr: strAddr("[::FFFF:192.0.2.1]:5000"), format: PeerAddressNormalized, want: "192.0.2.1:5000"},
+		{addr: strAddr("[2001:DB8:0:0::1]:5000"), format: PeerAddressNormalized, want: "[2001:db8::1]:5000"},
+		{addr: strAddr("[2001:DB8:0:0::1]:5000"), format: PeerAddressIP, want: "2001:db8::1"},
+		{addr: &net.UnixAddr{Name: "/run/grpc.sock", Net: "unix"}, format: PeerAddressIP, want: "/run/grpc.sock"},
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.want, formatPeerAddress(tt.addr, tt.format))
+	}
+
+	require.Error(t, ValidatePeerAddressFormat("port"))
+}
+
+func TestMakePayloadAuthority(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, nil)
+	addr := &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 9001}
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(":authority", "tenant.example.com"))
+	ctx = peer.NewContext(ctx, &peer.Peer{Addr: addr, AuthInfo: credentials.TLSInfo{}})
+
+	pld := &payload.Payload{}
+	require.NoError(t, px.makePayload(ctx, "Method", &codec.RawMessage{}, pld))
+
+	rc := &rpcContext{}
+	require.NoError(t, json.Unmarshal(pld.Context, rc))
+	require.Equal(t, []string{"tenant.example.com"}, rc.Context[authority])
+	require.Equal(t, []string{"https"}, rc.Context[scheme])
+
+	ctx = peer.NewContext(context.Background(), &peer.Peer{Addr: addr})
+	require.NoError(t, px.makePayload(ctx, "Method", &codec.RawMessage{}, pld))
+
+	rc = &rpcContext{}
+	require.NoError(t, json.Unmarshal(pld.Context, rc))
+	require.Equal(t, []string{"http"}, rc.Context[scheme])
+}
+
+func TestMsgpackContextCodec(t *testing.T) {
+	cc, err := NewContextCodec(MsgpackContext)
+	require.NoError(t, err)
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, &Options{ContextCodec: cc})
+	require.Equal(t, frame.CodecMsgpack, px.getPld().Codec)
+
+	data, err := px.marshalContext("Method", map[string][]string{"foo": {"bar"}})
+	require.NoError(t, err)
+
+	rc := map[string]any{}
+	require.NoError(t, msgpack.Unmarshal(data, &rc))
+	require.Equal(t, "app.Service", rc["service"])
+	require.Equal(t, "Method", rc["method"])
+
+	resp, err := msgpack.Marshal(map[string]string{"foo": "bar"})
+	require.NoError(t, err)
+	md, err := px.responseMetadata(&payload.Payload{Context: resp})
+	require.NoError(t, err)
+	require.Equal(t, []string{"bar"}, md.Get("foo"))
+
+	_, err = NewContextCodec("gob")
+	require.Error(t, err)
+}
+
+func TestInvokeRoundTrip(t *testing.T) {
+	notFound, err := proto.Marshal(status.New(codes.NotFound, "not found").Proto())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		resp   proxytest.Response
+		code   codes.Code
+		header metadata.MD
+	}{
+		{
+			name:   "metadata",
+			resp:   proxytest.Reply([]byte("body"), map[string]string{"foo": "bar"}),
+			code:   codes.OK,
+			header: metadata.Pairs("foo", "bar"),
+		},
+		{
+			name: "error key",
+			resp: proxytest.Reply(nil, map[string]string{"error": base64.StdEncoding.EncodeToString(notFound)}),
+			code: codes.NotFound,
+		},
+		{
+			name: "worker error",
+			resp: proxytest.Fail(stderr.New("7|:|denied")),
+			code: codes.PermissionDenied,
+		},
+		{
+			name: "pool error",
+			resp: proxytest.Fail(stderr.New("no free workers")),
+			code: codes.Internal,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := proxytest.NewPool(tt.resp)
+			px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, nil)
+			ctx, stream := proxytest.NewContext(context.Background(), "/app.Service/Method")
+
+			in := codec.RawMessage("request")
+			_, err := px.invoke(ctx, "Method", &in)
+			require.Equal(t, tt.code, status.Code(err))
+			require.Equal(t, []byte("request"), pool.Last().Body)
+
+			if tt.header != nil {
+				require.Equal(t, tt.header, stream.Header())
+			}
+		})
+	}
+}
+
+func TestResponseMetadataMalformedStatus(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, &Options{StatusKey: "status"})
+
+	data, err := proto.Marshal(status.New(codes.NotFound, "resource was not found").Proto())
+	require.NoError(t, err)
+
+	tests := []struct {
+		name  string
+		value string
+		cause string
+	}{
+		{name: "non-base64", value: "not base64!", cause: "invalid base64"},
+		{name: "truncated", value: base64.StdEncoding.EncodeToString(data[:len(data)-3]), cause: "invalid google.rpc.Status proto"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, key := range []string{apiErr, "status"} {
+				_, err := px.responseMetadata(&payload.Payload{Context: []byte(`{"` + key + `":"` + tt.value + `"}`)})
+				st, ok := status.FromError(err)
+				require.True(t, ok)
+				require.Equal(t, codes.Internal, st.Code())
+				require.Contains(t, st.Message(), "malformed "+key)
+				require.Contains(t, st.Message(), tt.cause)
+			}
+		})
+	}
+}
+
+func TestExecObserver(t *testing.T) {
+	var observed string
+	px := NewProxy("app.Service", "", proxytest.NewPool(), &sync.RWMutex{}, &Options{
+		ExecObserver: func(_ context.Context, method string, elapsed time.Duration) {
+			observed = method
+			require.Greater(t, elapsed, time.Duration(0))
+		},
+		ExecTimeHeader: true,
+	})
+
+	ctx, stream := proxytest.NewContext(context.Background(), "/app.Service/Method")
+	_, err := px.invoke(ctx, "Method", &codec.RawMessage{})
+	require.NoError(t, err)
+	require.Equal(t, "/app.Service/Method", observed)
+	require.Len(t, stream.Header().Get(execTimeHeader), 1)
+
+	_, err = strconv.ParseFloat(stream.Header().Get(execTimeHeader)[0], 64)
+	require.NoError(t, err)
+}
+
+func TestResponseEnvelope(t *testing.T) {
+	detail, err := anypb.New(&errdetails.ErrorInfo{Reason: "NOT_FOUND"})
+	require.NoError(t, err)
+	data, err := proto.Marshal(detail)
+	require.NoError(t, err)
+
+	reply := func(ctx string) proxytest.Response {
+		return func(*payload.Payload) (*payload.Payload, error) {
+			return &payload.Payload{Body: []byte("body"), Context: []byte(ctx)}, nil
+		}
+	}
+
+	pool := proxytest.NewPool(
+		reply(`{"version":1,"metadata":{"error":"not a status"},"trailers":{"x-total":"5"}}`),
+		reply(`{"version":1,"code":5,"message":"not found","details":["`+base64.StdEncoding.EncodeToString(data)+`"]}`),
+		reply(`{"version":2}`),
+	)
+	px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, &Options{ResponseEnvelope: true})
+
+	ctx, stream := proxytest.NewContext(context.Background(), "/app.Service/Method")
+	resp, err := px.invoke(ctx, "Method", &codec.RawMessage{})
+	require.NoError(t, err)
+	require.Equal(t, codec.RawMessage("body"), resp)
+	require.Equal(t, []string{"not a status"}, stream.Header().Get("error"))
+	require.Equal(t, []string{"5"}, stream.Trailer().Get("x-total"))
+
+	ctx, _ = proxytest.NewContext(context.Background(), "/app.Service/Method")
+	_, err = px.invoke(ctx, "Method", &codec.RawMessage{})
+	st := status.Convert(err)
+	require.Equal(t, codes.NotFound, st.Code())
+	require.Equal(t, "not found", st.Message())
+	require.Len(t, st.Details(), 1)
+
+	ctx, _ = proxytest.NewContext(context.Background(), "/app.Service/Method")
+	_, err = px.invoke(ctx, "Method", &codec.RawMessage{})
+	require.Equal(t, codes.Internal, status.Code(err))
+}
+
+type tenantKey struct{}
+
+func TestMakePayloadContextValues(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, &Options{
+		ContextValues: []*ContextValue{{
+			Name: "x-tenant",
+			Key:  tenantKey{},
+			Serialize: func(v any) ([]string, error) {
+				return []string{v.(string)}, nil
+			},
+		}},
+	})
+
+	// the value sent by the client is dropped
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs("x-tenant", "spoofed"))
+
+	pld := &payload.Payload{}
+	require.NoError(t, px.makePayload(ctx, "Method", &codec.RawMessage{}, pld))
+	rc := &rpcContext{}
+	require.NoError(t, json.Unmarshal(pld.Context, rc))
+	require.NotContains(t, rc.Context, "x-tenant")
+
+	require.NoError(t, px.makePayload(context.WithValue(ctx, tenantKey{}, "acme"), "Method", &codec.RawMessage{}, pld))
+	rc = &rpcContext{}
+	require.NoError(t, json.Unmarshal(pld.Context, rc))
+	require.Equal(t, []string{"acme"}, rc.Context["x-tenant"])
+}
+
+type fakeBreaker struct {
+	allow bool
+	done  []error
+}
+
+func (b *fakeBreaker) Allow() bool {
+	return b.allow
+}
+
+func (b *fakeBreaker) Done(_ context.Context, err error) {
+	b.done = append(b.done, err)
+}
+
+func TestInvokeBreaker(t *testing.T) {
+	breaker := &fakeBreaker{}
+	pool := proxytest.NewPool(proxytest.Fail(stderr.New("worker crashed")))
+	px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, &Options{Breaker: breaker})
+
+	_, err := px.invoke(context.Background(), "Method", &codec.RawMessage{})
+	require.Equal(t, codes.Unavailable, status.Code(err))
+	require.Empty(t, pool.Received())
+
+	breaker.allow = true
+	_, err = px.invoke(context.Background(), "Method", &codec.RawMessage{})
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.Len(t, breaker.done, 1)
+	require.Equal(t, codes.Internal, status.Code(breaker.done[0]))
+}
+
+func TestMakePayloadMetadataFilter(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, &Options{
+		MetadataAllowlist: []string{"x-b3-*", "authorization", "x-secret"},
+		MetadataDenylist:  []string{"x-secret"},
+	})
+
+	ctx := metadata.NewIncomingContext(context.Background(), metadata.Pairs(
+		":authority", "example.com",
+		"x-b3-traceid", "1",
+		"authorization", "token",
+		"x-secret", "secret",
+		"baggage", "large",
+	))
+
+	pld := &payload.Payload{}
+	require.NoError(t, px.makePayload(ctx, "Method", &codec.RawMessage{}, pld))
+
+	rc := &rpcContext{}
+	require.NoError(t, json.Unmarshal(pld.Context, rc))
+	require.Contains(t, rc.Context, ":authority")
+	require.Contains(t, rc.Context, "x-b3-traceid")
+	require.Contains(t, rc.Context, "authorization")
+	require.Contains(t, rc.Context, contentSubtype)
+	require.NotContains(t, rc.Context, "x-secret")
+	require.NotContains(t, rc.Context, "baggage")
+}
+
+func TestInvokeMalformedContext(t *testing.T) {
+	pool := proxytest.NewPool(func(*payload.Payload) (*payload.Payload, error) {
+		return &payload.Payload{Body: []byte("body"), Context: []byte(`{"foo":`)}, nil
+	})
+
+	var observed []byte
+	px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, &Options{
+		ProtocolErrorObserver: func(_ context.Context, method string, data []byte, err error) {
+			require.Equal(t, "/app.Service/Method", method)
+			require.Error(t, err)
+			observed = data
+		},
+	})
+
+	ctx, _ := proxytest.NewContext(context.Background(), "/app.Service/Method")
+	_, err := px.invoke(ctx, "Method", &codec.RawMessage{})
+	require.Equal(t, codes.Internal, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "malformed response context")
+	require.Equal(t, []byte(`{"foo":`), observed)
+}
+
+func TestInvokeHeaderAlreadySent(t *testing.T) {
+	pool := proxytest.NewPool(
+		proxytest.Reply([]byte("body"), map[string]string{"x-key": "value"}),
+		func(*payload.Payload) (*payload.Payload, error) {
+			return &payload.Payload{Body: []byte("body"), Context: []byte(`{"version":1,"metadata":{"x-key":"value"}}`)}, nil
+		},
+	)
+	px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, nil)
+
+	// headers are sent before the worker returns its headers
+	ctx, stream := proxytest.NewContext(context.Background(), "/app.Service/Method")
+	require.NoError(t, grpc.SendHeader(ctx, metadata.Pairs("x-sent", "1")))
+
+	resp, err := px.invoke(ctx, "Method", &codec.RawMessage{})
+	require.NoError(t, err)
+	require.Equal(t, codec.RawMessage("body"), resp)
+	require.Equal(t, []string{"1"}, stream.Header().Get("x-sent"))
+	require.Empty(t, stream.Header().Get("x-key"))
+
+	px = NewProxy("app.Service", "", pool, &sync.RWMutex{}, &Options{ResponseEnvelope: true})
+	resp, err = px.invoke(ctx, "Method", &codec.RawMessage{})
+	require.NoError(t, err)
+	require.Equal(t, codec.RawMessage("body"), resp)
+	require.Empty(t, stream.Header().Get("x-key"))
+}
+
+func TestInvokeRequestValidator(t *testing.T) {
+	pool := proxytest.NewPool()
+	px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, &Options{
+		RequestValidators: map[string]RequestValidator{
+			"/app.Service/Method": func(body []byte) error {
+				if len(body) == 0 {
+					return errors.Str("empty body")
+				}
+
+				return nil
+			},
+		},
+	})
+
+	ctx, _ := proxytest.NewContext(context.Background(), "/app.Service/Method")
+	_, err := px.invoke(ctx, "Method", &codec.RawMessage{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "empty body")
+	require.Empty(t, pool.Received())
+
+	resp, err := px.invoke(ctx, "Method", &codec.RawMessage{0x0a, 0x01, 0x61})
+	require.NoError(t, err)
+	require.Equal(t, codec.RawMessage{0x0a, 0x01, 0x61}, resp)
+
+	// methods without the validator are not checked
+	ctx, _ = proxytest.NewContext(context.Background(), "/app.Service/Other")
+	_, err = px.invoke(ctx, "Other", &codec.RawMessage{})
+	require.NoError(t, err)
+}
+
+func TestInvokeRequestTransform(t *testing.T) {
+	pool := proxytest.NewPool()
+	px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, &Options{
+		RequestTransforms: map[string]BodyTransform{
+			"/app.Service/Method": func(body []byte) ([]byte, error) {
+				if len(body) == 0 {
+					return nil, errors.Str("empty body")
+				}
+
+				return body[:1], nil
+			},
+		},
+	})
+
+	ctx, _ := proxytest.NewContext(context.Background(), "/app.Service/Method")
+	_, err := px.invoke(ctx, "Method", &codec.RawMessage{})
+	require.Equal(t, codes.InvalidArgument, status.Code(err))
+	require.Contains(t, status.Convert(err).Message(), "empty body")
+	require.Empty(t, pool.Received())
+
+	_, err = px.invoke(ctx, "Method", &codec.RawMessage{0x0a, 0x01, 0x61})
+	require.NoError(t, err)
+	require.Len(t, pool.Received(), 1)
+	require.Equal(t, []byte{0x0a}, pool.Received()[0].Body)
+}
+
+func TestResponseEnvelopeHTTPCacheKeys(t *testing.T) {
+	tests := []struct {
+		name   string
+		opts   *Options
+		md     metadata.MD
+		header bool
+	}{
+		{name: "grpc client", opts: &Options{ResponseEnvelope: true}, md: metadata.Pairs("content-type", "application/grpc")},
+		{name: "grpc-web header", opts: &Options{ResponseEnvelope: true}, md: metadata.Pairs("content-type", "application/grpc", "x-grpc-web", "1"), header: true},
+		{name: "all clients", opts: &Options{ResponseEnvelope: true, HTTPCacheHeaders: true}, md: metadata.Pairs("content-type", "application/grpc"), header: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			pool := proxytest.NewPool(func(*payload.Payload) (*payload.Payload, error) {
+				return &payload.Payload{Body: []byte("body"), Context: []byte(`{"version":1,"metadata":{"etag":"v1"},"trailers":{"cache-control":"max-age=60","x-total":"5"}}`)}, nil
+			})
+			px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, tt.opts)
+
+			ctx, stream := proxytest.NewContext(metadata.NewIncomingContext(context.Background(), tt.md), "/app.Service/Method")
+			_, err := px.invoke(ctx, "Method", &codec.RawMessage{})
+			require.NoError(t, err)
+			require.Equal(t, []string{"v1"}, stream.Header().Get("etag"))
+			require.Equal(t, []string{"5"}, stream.Trailer().Get("x-total"))
+
+			if tt.header {
+				require.Equal(t, []string{"max-age=60"}, stream.Header().Get("cache-control"))
+				require.Empty(t, stream.Trailer().Get("cache-control"))
+				return
+			}
+
+			require.Empty(t, stream.Header().Get("cache-control"))
+			require.Equal(t, []string{"max-age=60"}, stream.Trailer().Get("cache-control"))
+		})
+	}
+}
+
+func TestServiceDescSortedMethods(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, nil)
+	px.RegisterMethod("Ping")
+	px.RegisterMethod("Echo")
+	px.RegisterMethod("Call")
+
+	desc := px.ServiceDesc()
+	require.Len(t, desc.Methods, 3)
+	require.Equal(t, "Call", desc.Methods[0].MethodName)
+	require.Equal(t, "Echo", desc.Methods[1].MethodName)
+	require.Equal(t, "Ping", desc.Methods[2].MethodName)
+
+	// registration order is kept
+	require.Equal(t, []string{"Ping", "Echo", "Call"}, px.Methods())
+}
+
+func TestInvokeErrorMapper(t *testing.T) {
+	pool := proxytest.NewPool(func(*payload.Payload) (*payload.Payload, error) {
+		return nil, errors.Str("App\\NotFoundException: user 1")
+	}, func(*payload.Payload) (*payload.Payload, error) {
+		return nil, errors.Str("5|:|not found")
+	})
+
+	px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, &Options{
+		ErrorMapper: func(errMsg string) (codes.Code, string, []proto.Message) {
+			if strings.HasPrefix(errMsg, "App\\NotFoundException: ") {
+				return codes.NotFound, strings.TrimPrefix(errMsg, "App\\NotFoundException: "), []proto.Message{&errdetails.ErrorInfo{Reason: "NOT_FOUND"}}
+			}
+
+			return DefaultErrorMapper(errMsg)
+		},
+	})
+
+	ctx, _ := proxytest.NewContext(context.Background(), "/app.Service/Method")
+	_, err := px.invoke(ctx, "Method", &codec.RawMessage{})
+	st := status.Convert(err)
+	require.Equal(t, codes.NotFound, st.Code())
+	require.Equal(t, "user 1", st.Message())
+	require.Len(t, st.Details(), 1)
+	require.Equal(t, "NOT_FOUND", st.Details()[0].(*errdetails.ErrorInfo).GetReason())
+
+	_, err = px.invoke(ctx, "Method", &codec.RawMessage{})
+	st = status.Convert(err)
+	require.Equal(t, codes.NotFound, st.Code())
+	require.Equal(t, "not found", st.Message())
+}
+
+func TestWrapErrorJSONDetails(t *testing.T) {
+	err := wrapErrorDetails(stderr.New(`5|:|user was not found|:|[{"@type":"type.googleapis.com/google.rpc.ErrorInfo","reason":"NOT_FOUND","domain":"a|:|b"},{"@type":"type.googleapis.com/app.Unknown"}]`), jsonDetails)
+
+	st := status.Convert(err)
+	require.Equal(t, codes.NotFound, st.Code())
+	require.Equal(t, "user was not found", st.Message())
+	require.Len(t, st.Details(), 1)
+
+	info, ok := st.Details()[0].(*errdetails.ErrorInfo)
+	require.True(t, ok)
+	require.Equal(t, "NOT_FOUND", info.GetReason())
+	require.Equal(t, "a|:|b", info.GetDomain())
+
+	// malformed details are skipped, the status is kept
+	st = status.Convert(wrapErrorDetails(stderr.New(`3|:|invalid|:|{not json`), jsonDetails))
+	require.Equal(t, codes.InvalidArgument, st.Code())
+	require.Empty(t, st.Details())
+}
+
+func TestWrapErrorResourceInfo(t *testing.T) {
+	resource, err := anypb.New(&errdetails.ResourceInfo{
+		ResourceType: "type.googleapis.com/app.User",
+		// the delimiter in the serialized detail
+		ResourceName: "users/a|:|b",
+		Owner:        "app",
+		Description:  "user was not found",
+	})
+	require.NoError(t, err)
+
+	info, err := anypb.New(&errdetails.ErrorInfo{Reason: "NOT_FOUND", Domain: "app"})
+	require.NoError(t, err)
+
+	chunks := []string{"5", "user was not found"}
+	for _, detail := range []*anypb.Any{resource, info} {
+		data, errM := proto.Marshal(detail)
+		require.NoError(t, errM)
+		chunks = append(chunks, string(data))
+	}
+	// malformed details are skipped
+	chunks = append(chunks, "malformed")
+
+	st := status.Convert(wrapError(errors.E(errors.Str(strings.Join(chunks, delimiter)))))
+	require.Equal(t, codes.NotFound, st.Code())
+	require.Equal(t, "user was not found", st.Message())
+	require.Len(t, st.Details(), 2)
+
+	ri, ok := st.Details()[0].(*errdetails.ResourceInfo)
+	require.True(t, ok)
+	require.Equal(t, "type.googleapis.com/app.User", ri.GetResourceType())
+	require.Equal(t, "users/a|:|b", ri.GetResourceName())
+	require.Equal(t, "app", ri.GetOwner())
+	require.Equal(t, "user was not found", ri.GetDescription())
+
+	ei, ok := st.Details()[1].(*errdetails.ErrorInfo)
+	require.True(t, ok)
+	require.Equal(t, "NOT_FOUND", ei.GetReason())
+}
+
+func TestInvokeInstanceID(t *testing.T) {
+	for _, resp := range []proxytest.Response{
+		proxytest.Reply([]byte("body"), map[string]string{"foo": "bar"}),
+		proxytest.Fail(stderr.New("5|:|not found")),
+	} {
+		px := NewProxy("app.Service", "", proxytest.NewPool(resp), &sync.RWMutex{}, &Options{InstanceID: "pod-1"})
+		ctx, stream := proxytest.NewContext(context.Background(), "/app.Service/Method")
+
+		in := codec.RawMessage("request")
+		_, _ = px.invoke(ctx, "Method", &in)
+		require.Equal(t, []string{"pod-1"}, stream.Header().Get(instanceHeader))
+	}
+
+	// disabled by default
+	px := NewProxy("app.Service", "", proxytest.NewPool(proxytest.Reply([]byte("body"), nil)), &sync.RWMutex{}, nil)
+	ctx, stream := proxytest.NewContext(context.Background(), "/app.Service/Method")
+	in := codec.RawMessage("request")
+	_, err := px.invoke(ctx, "Method", &in)
+	require.NoError(t, err)
+	require.Empty(t, stream.Header().Get(instanceHeader))
+}
+
+// queuePool reports the worker allocation after the wait
+type queuePool struct {
+	*proxytest.Pool
+	wait time.Duration
+}
+
+func (q *queuePool) Exec(ctx context.Context, pld *payload.Payload) (*payload.Payload, error) {
+	time.Sleep(q.wait)
+	ExecStarted(ctx)
+	return q.Pool.Exec(ctx, pld)
+}
+
+func TestInvokeQueueWait(t *testing.T) {
+	var observed time.Duration
+	px := NewProxy("app.Service", "", &queuePool{Pool: proxytest.NewPool(), wait: 20 * time.Millisecond}, &sync.RWMutex{}, &Options{
+		QueueWaitObserver: func(_ context.Context, method string, wait time.Duration) {
+			require.Equal(t, "/app.Service/Method", method)
+			observed = wait
+		},
+		QueueWaitHeader: true,
+	})
+	ctx, stream := proxytest.NewContext(context.Background(), "/app.Service/Method")
+
+	in := codec.RawMessage("request")
+	_, err := px.invoke(ctx, "Method", &in)
+	require.NoError(t, err)
+	require.GreaterOrEqual(t, observed, 20*time.Millisecond)
+	require.Len(t, stream.Header().Get(queueWaitHeader), 1)
+
+	// not reported by the pool
+	observed = 0
+	px = NewProxy("app.Service", "", proxytest.NewPool(), &sync.RWMutex{}, &Options{
+		QueueWaitObserver: func(_ context.Context, _ string, wait time.Duration) {
+			observed = wait
+		},
+		QueueWaitHeader: true,
+	})
+	ctx, stream = proxytest.NewContext(context.Background(), "/app.Service/Method")
+	_, err = px.invoke(ctx, "Method", &in)
+	require.NoError(t, err)
+	require.Zero(t, observed)
+	require.Empty(t, stream.Header().Get(queueWaitHeader))
+}
+
+// testSpan records the exec span, the call span is recording so the exec span is started
+type testSpan struct {
+	trace.Span
+	provider *testTracerProvider
+	name     string
+	attrs    []attribute.KeyValue
+	errs     []error
+	code     otelcodes.Code
+	ended    bool
+}
+
+func (s *testSpan) IsRecording() bool                             { return true }
+func (s *testSpan) TracerProvider() trace.TracerProvider          { return s.provider }
+func (s *testSpan) RecordError(err error, _ ...trace.EventOption) { s.errs = append(s.errs, err) }
+func (s *testSpan) SetStatus(code otelcodes.Code, _ string)       { s.code = code }
+func (s *testSpan) End(...trace.SpanEndOption)                    { s.ended = true }
+
+type testTracerProvider struct {
+	trace.TracerProvider
+	spans []*testSpan
+}
+
+func (p *testTracerProvider) Tracer(string, ...trace.TracerOption) trace.Tracer {
+	return &testTracer{provider: p}
+}
+
+type testTracer struct {
+	trace.Tracer
+	provider *testTracerProvider
+}
+
+func (t *testTracer) Start(ctx context.Context, name string, opts ...trace.SpanStartOption) (context.Context, trace.Span) {
+	cfg := trace.NewSpanStartConfig(opts...)
+	span := &testSpan{provider: t.provider, name: name, attrs: cfg.Attributes()}
+	t.provider.spans = append(t.provider.spans, span)
+	return trace.ContextWithSpan(ctx, span), span
+}
+
+func TestExecSpan(t *testing.T) {
+	provider := &testTracerProvider{}
+
+	pool := proxytest.NewPool(proxytest.Reply([]byte("body"), nil), proxytest.Fail(stderr.New("7|:|denied")))
+	px := NewProxy("app.Service", "", pool, &sync.RWMutex{}, nil)
+
+	for _, code := range []codes.Code{codes.OK, codes.PermissionDenied} {
+		ctx, _ := proxytest.NewContext(context.Background(), "/app.Service/Method")
+		ctx = trace.ContextWithSpan(ctx, &testSpan{provider: provider})
+
+		in := codec.RawMessage("request")
+		_, err := px.invoke(ctx, "Method", &in)
+		require.Equal(t, code, status.Code(err))
+	}
+
+	require.Len(t, provider.spans, 2)
+	for _, span := range provider.spans {
+		require.Equal(t, execSpanName, span.name)
+		require.True(t, span.ended)
+		require.Contains(t, span.attrs, attribute.String("rpc.method", "Method"))
+	}
+
+	require.Empty(t, provider.spans[0].errs)
+	require.Equal(t, otelcodes.Unset, provider.spans[0].code)
+	require.Len(t, provider.spans[1].errs, 1)
+	require.Equal(t, otelcodes.Error, provider.spans[1].code)
+
+	// not traced
+	ctx, _ := proxytest.NewContext(context.Background(), "/app.Service/Method")
+	in := codec.RawMessage("request")
+	_, err := px.invoke(ctx, "Method", &in)
+	require.NoError(t, err)
+	require.Len(t, provider.spans, 2)
+}
+
+func TestInvokeEmptyBody(t *testing.T) {
+	transform := func([]byte) ([]byte, error) {
+		return nil, nil
+	}
+
+	for _, opts := range []*Options{nil, {ResponseTransforms: map[string]BodyTransform{"/app.Service/Method": transform}}} {
+		px := NewProxy("app.Service", "", proxytest.NewPool(proxytest.Reply(nil, map[string]string{"x-id": "1"})), &sync.RWMutex{}, opts)
+		ctx, stream := proxytest.NewContext(context.Background(), "/app.Service/Method")
+
+		in := codec.RawMessage("request")
+		resp, err := px.invoke(ctx, "Method", &in)
+		require.NoError(t, err)
+		require.Equal(t, metadata.Pairs("x-id", "1"), stream.Header())
+
+		raw, ok := resp.(codec.RawMessage)
+		require.True(t, ok)
+		require.NotNil(t, raw)
+		require.Empty(t, raw)
+
+		data, err := (&codec.Codec{}).Marshal(resp)
+		require.NoError(t, err)
+		require.NotNil(t, data)
+		require.Empty(t, data)
+	}
+}
+
+func TestMakePayloadGrpcTimeout(t *testing.T) {
+	px := NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, nil)
+
+	pld := &payload.Payload{}
+	require.NoError(t, px.makePayload(context.Background(), "Method", &codec.RawMessage{}, pld))
+
+	rc := &rpcContext{}
+	require.NoError(t, json.Unmarshal(pld.Context, rc))
+	require.NotContains(t, rc.Context, grpcTimeout)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, px.makePayload(ctx, "Method", &codec.RawMessage{}, pld))
+
+	rc = &rpcContext{}
+	require.NoError(t, json.Unmarshal(pld.Context, rc))
+	require.Len(t, rc.Context[grpcTimeout], 1)
+	require.Regexp(t, `^\d{1,8}[num]$`, rc.Context[grpcTimeout][0])
+
+	// the deadline set by the server
+	require.NoError(t, px.makePayload(WithServerDeadline(ctx), "Method", &codec.RawMessage{}, pld))
+
+	rc = &rpcContext{}
+	require.NoError(t, json.Unmarshal(pld.Context, rc))
+	require.NotContains(t, rc.Context, grpcTimeout)
+
+	px = NewProxy("app.Service", "", &slowPool{}, &sync.RWMutex{}, &Options{MetadataDenylist: []string{"grpc-*"}})
+	require.NoError(t, px.makePayload(ctx, "Method", &codec.RawMessage{}, pld))
+
+	rc = &rpcContext{}
+	require.NoError(t, json.Unmarshal(pld.Context, rc))
+	require.NotContains(t, rc.Context, grpcTimeout)
+}
+
+func TestEncodeTimeout(t *testing.T) {
+	require.Equal(t, "0n", encodeTimeout(-time.Second))
+	require.Equal(t, "1500n", encodeTimeout(1500*time.Nanosecond))
+	require.Equal(t, "100000u", encodeTimeout(100*time.Millisecond))
+	require.Equal(t, "100000m", encodeTimeout(100*time.Second))
+	require.Equal(t, "1000000S", encodeTimeout(1000000*time.Second))
+	require.Equal(t, "2000000H", encodeTimeout(2000000*time.Hour))
+}
+
+func TestDecodedMethodHandler(t *testing.T) {
+	md := grpc_health_v1.File_grpc_health_v1_health_proto.Services().Get(0).Methods().ByName("Check")
+	resp, err := proto.Marshal(&grpc_health_v1.HealthCheckResponse{Status: grpc_health_v1.HealthCheckResponse_SERVING})
+	require.NoError(t, err)
+	req, err := proto.Marshal(&grpc_health_v1.HealthCheckRequest{Service: "app"})
+	require.NoError(t, err)
+
+	pool := proxytest.NewPool(proxytest.Reply(resp, nil))
+	px := NewProxy("grpc.health.v1.Health", "", pool, &sync.RWMutex{}, &Options{
+		DecodedMethods: map[string]protoreflect.MethodDescriptor{"/grpc.health.v1.Health/Check": md},
+	})
+	ctx, _ := proxytest.NewContext(context.Background(), "/grpc.health.v1.Health/Check")
+
+	dec := func(v any) error {
+		return proto.Unmarshal(req, v.(proto.Message))
+	}
+
+	interceptor := func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		in, ok := req.(proto.Message)
+		require.True(t, ok)
+		require.Equal(t, "app", in.ProtoReflect().Get(md.Input().Fields().ByName("service")).String())
+
+		return handler(ctx, req)
+	}
+
+	out, err := px.methodHandler("Check")(nil, ctx, dec, interceptor)
+	require.NoError(t, err)
+
+	msg, ok := out.(proto.Message)
+	require.True(t, ok)
+	require.Equal(t, protoreflect.EnumNumber(grpc_health_v1.HealthCheckResponse_SERVING), msg.ProtoReflect().Get(md.Output().Fields().ByName("status")).Enum())
+	require.Equal(t, req, pool.Last().Body)
+
+	// the raw messages are passed to the other methods
+	pool.Respond(proxytest.Reply(resp, nil))
+	px.RegisterMethod("Watch")
+	out, err = px.methodHandler("Watch")(nil, ctx, func(v any) error {
+		*v.(*codec.RawMessage) = req
+		return nil
+	}, nil)
+	require.NoError(t, err)
+	require.Equal(t, codec.RawMessage(resp), out)
+}
@@ -0,0 +1,119 @@
+// Package proxytest provides the in-memory fakes to test the proxy without a RoadRunner workers pool.
+package proxytest
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/roadrunner-server/sdk/v3/payload"
+	"github.com/roadrunner-server/sdk/v3/worker"
+)
+
+// Response is the scripted worker response to the received payload.
+type Response func(pld *payload.Payload) (*payload.Payload, error)
+
+// Pool implements the proxy Pool, Exec returns the scripted responses in order and echoes the request body
+// (without the response context) when the responses are exhausted. Received payloads are recorded.
+type Pool struct {
+	mu        sync.Mutex
+	responses []Response
+	received  []*payload.Payload
+}
+
+// NewPool returns the pool responding with the provided responses in order.
+func NewPool(responses ...Response) *Pool {
+	return &Pool{
+		responses: responses,
+	}
+}
+
+// Respond appends the scripted response.
+func (p *Pool) Respond(r Response) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.responses = append(p.responses, r)
+}
+
+// Received returns the payloads received by Exec.
+func (p *Pool) Received() []*payload.Payload {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	received := make([]*payload.Payload, len(p.received))
+	copy(received, p.received)
+	return received
+}
+
+// Last returns the last received payload or nil.
+func (p *Pool) Last() *payload.Payload {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.received) == 0 {
+		return nil
+	}
+
+	return p.received[len(p.received)-1]
+}
+
+func (p *Pool) Workers() []*worker.Process {
+	return nil
+}
+
+// Exec records a copy of the payload, the proxy reuses the payloads after the call.
+func (p *Pool) Exec(_ context.Context, pld *payload.Payload) (*payload.Payload, error) {
+	received := &payload.Payload{
+		Codec:   pld.Codec,
+		Context: append([]byte(nil), pld.Context...),
+		Body:    append([]byte(nil), pld.Body...),
+	}
+
+	p.mu.Lock()
+	p.received = append(p.received, received)
+
+	var r Response
+	if len(p.responses) > 0 {
+		r = p.responses[0]
+		p.responses = p.responses[1:]
+	}
+	p.mu.Unlock()
+
+	if r == nil {
+		return &payload.Payload{Body: received.Body}, nil
+	}
+
+	return r(received)
+}
+
+func (p *Pool) Reset(context.Context) error {
+	return nil
+}
+
+func (p *Pool) Destroy(context.Context) {}
+
+// Reply returns the response with the body and the response metadata (JSON context).
+func Reply(body []byte, md map[string]string) Response {
+	return func(*payload.Payload) (*payload.Payload, error) {
+		resp := &payload.Payload{Body: body}
+		if len(md) == 0 {
+			return resp, nil
+		}
+
+		ctx, err := json.Marshal(md)
+		if err != nil {
+			return nil, err
+		}
+
+		resp.Context = ctx
+		return resp, nil
+	}
+}
+
+// Fail returns the response failing with the error, e.g. the worker error: code|:|message|:|details.
+func Fail(err error) Response {
+	return func(*payload.Payload) (*payload.Payload, error) {
+		return nil, err
+	}
+}
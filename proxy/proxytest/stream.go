@@ -0,0 +1,88 @@
+package proxytest
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+)
+
+// Stream implements grpc.ServerTransportStream recording the headers and the trailers set by the handler,
+// without it grpc.SetHeader fails outside the gRPC server.
+type Stream struct {
+	method  string
+	mu      sync.Mutex
+	header  metadata.MD
+	trailer metadata.MD
+	sent    bool
+}
+
+// errHeaderSent is returned by the gRPC transport when the headers are set after they were sent
+var errHeaderSent = errors.New("transport: the stream is done or WriteHeader was already called") //nolint:gochecknoglobals
+
+// NewContext returns the context with the Stream attached, as the gRPC server does for the method call.
+func NewContext(ctx context.Context, method string) (context.Context, *Stream) {
+	s := &Stream{
+		method:  method,
+		header:  metadata.MD{},
+		trailer: metadata.MD{},
+	}
+
+	return grpc.NewContextWithServerTransportStream(ctx, s), s
+}
+
+func (s *Stream) Method() string {
+	return s.method
+}
+
+func (s *Stream) SetHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sent {
+		return errHeaderSent
+	}
+
+	s.header = metadata.Join(s.header, md)
+	return nil
+}
+
+// SendHeader sends the headers, as with the gRPC transport the headers can't be set or sent again after that.
+func (s *Stream) SendHeader(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.sent {
+		return errHeaderSent
+	}
+
+	s.header = metadata.Join(s.header, md)
+	s.sent = true
+	return nil
+}
+
+func (s *Stream) SetTrailer(md metadata.MD) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.trailer = metadata.Join(s.trailer, md)
+	return nil
+}
+
+// Header returns the headers set by the handler.
+func (s *Stream) Header() metadata.MD {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.header.Copy()
+}
+
+// Trailer returns the trailers set by the handler.
+func (s *Stream) Trailer() metadata.MD {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.trailer.Copy()
+}
@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"context"
+	"strings"
+
+	"go.opentelemetry.io/otel/attribute"
+	otelcodes "go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+	"google.golang.org/grpc"
+)
+
+const (
+	// execSpanName is the span wrapping the pool Exec: the worker execution including the wait for a free worker
+	execSpanName string = "php_worker_exec"
+	tracerName   string = "github.com/roadrunner-server/grpc/v3/proxy"
+)
+
+// startExecSpan starts the child span of the call span, the tracer is taken from the provider of the call span (set
+// by the tracing interceptor). No span is started when the call is not traced.
+func (p *Proxy) startExecSpan(ctx context.Context) (context.Context, trace.Span) {
+	parent := trace.SpanFromContext(ctx)
+	if !parent.IsRecording() {
+		return ctx, nil
+	}
+
+	method, _ := grpc.Method(ctx)
+
+	return parent.TracerProvider().Tracer(tracerName).Start(ctx, execSpanName,
+		trace.WithSpanKind(trace.SpanKindInternal),
+		trace.WithAttributes(
+			attribute.String("rpc.system", "grpc"),
+			attribute.String("rpc.service", p.name),
+			attribute.String("rpc.method", method[strings.LastIndex(method, "/")+1:]),
+		),
+	)
+}
+
+// endExecSpan records the worker error (as returned by the worker, before it is converted to the status) and ends the span
+func endExecSpan(span trace.Span, err error) {
+	if span == nil {
+		return
+	}
+
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(otelcodes.Error, GetOriginalErr(err))
+	}
+
+	span.End()
+}
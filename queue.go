@@ -0,0 +1,73 @@
+package grpc
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// workerQueue limits the number of calls sent to the pool to the number of workers, the rest of the calls wait
+// in the bounded queue for a free worker up to the timeout and fail with the ResourceExhausted status after that.
+type workerQueue struct {
+	slots   chan struct{}
+	size    int64
+	timeout time.Duration
+	waiting atomic.Int64
+	depth   prometheus.Gauge
+}
+
+func newWorkerQueue(workers uint64, size int, timeout time.Duration, depth prometheus.Gauge) *workerQueue {
+	return &workerQueue{
+		slots:   make(chan struct{}, workers),
+		size:    int64(size),
+		timeout: timeout,
+		depth:   depth,
+	}
+}
+
+func (q *workerQueue) interceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	select {
+	case q.slots <- struct{}{}:
+	default:
+		// queue_size 0 - the queue is unbounded
+		if n := q.waiting.Add(1); q.size > 0 && n > q.size {
+			q.waiting.Add(-1)
+			return nil, status.Errorf(codes.ResourceExhausted, "all workers are busy and the queue is full (%d), method %s", q.size, info.FullMethod)
+		}
+
+		q.depth.Inc()
+		err := q.wait(ctx, info.FullMethod)
+		q.depth.Dec()
+		q.waiting.Add(-1)
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// released even if the handler panics
+	defer func() {
+		<-q.slots
+	}()
+
+	return handler(ctx, req)
+}
+
+func (q *workerQueue) wait(ctx context.Context, method string) error {
+	timer := time.NewTimer(q.timeout)
+	defer timer.Stop()
+
+	select {
+	case q.slots <- struct{}{}:
+		return nil
+	case <-timer.C:
+		return status.Errorf(codes.ResourceExhausted, "no free worker within the queue timeout (%s), method %s", q.timeout, method)
+	case <-ctx.Done():
+		return status.FromContextError(ctx.Err()).Err()
+	}
+}
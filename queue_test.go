@@ -0,0 +1,145 @@
+package grpc
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+var queueInfo = &grpc.UnaryServerInfo{FullMethod: "/app.Service/Method"} //nolint:gochecknoglobals
+
+// busyCall occupies the worker slot until the returned function is called
+func busyCall(t *testing.T, q *workerQueue) func() {
+	t.Helper()
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		_, err := q.interceptor(context.Background(), nil, queueInfo, func(context.Context, any) (any, error) {
+			close(started)
+			<-release
+			return nil, nil
+		})
+		assert.NoError(t, err)
+	}()
+
+	<-started
+
+	return func() {
+		close(release)
+		<-done
+	}
+}
+
+func TestWorkerQueue(t *testing.T) {
+	handler := func(context.Context, any) (any, error) {
+		return "ok", nil
+	}
+
+	tests := []struct {
+		name string
+		size int
+		// the call waiting in the queue
+		run func(t *testing.T, q *workerQueue, release func())
+	}{
+		{
+			name: "timeout",
+			size: 1,
+			run: func(t *testing.T, q *workerQueue, release func()) {
+				start := time.Now()
+				_, err := q.interceptor(context.Background(), nil, queueInfo, handler)
+				require.Equal(t, codes.ResourceExhausted, status.Code(err))
+				require.Contains(t, err.Error(), "no free worker within the queue timeout")
+				require.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+				release()
+			},
+		},
+		{
+			name: "full queue",
+			size: 1,
+			run: func(t *testing.T, q *workerQueue, release func()) {
+				waiting := make(chan error, 1)
+				go func() {
+					_, err := q.interceptor(context.Background(), nil, queueInfo, handler)
+					waiting <- err
+				}()
+
+				require.Eventually(t, func() bool {
+					return q.waiting.Load() == 1
+				}, time.Second, time.Millisecond)
+				require.Equal(t, float64(1), testutil.ToFloat64(q.depth))
+
+				// rejected without waiting
+				start := time.Now()
+				_, err := q.interceptor(context.Background(), nil, queueInfo, handler)
+				require.Equal(t, codes.ResourceExhausted, status.Code(err))
+				require.Contains(t, err.Error(), "the queue is full (1)")
+				require.Less(t, time.Since(start), 50*time.Millisecond)
+
+				// the waiting call takes the released worker
+				release()
+				require.NoError(t, <-waiting)
+				require.Equal(t, float64(0), testutil.ToFloat64(q.depth))
+			},
+		},
+		{
+			name: "unbounded queue",
+			size: 0,
+			run: func(t *testing.T, q *workerQueue, release func()) {
+				errs := make(chan error, 3)
+				for i := 0; i < 3; i++ {
+					go func() {
+						_, err := q.interceptor(context.Background(), nil, queueInfo, handler)
+						errs <- err
+					}()
+				}
+
+				require.Eventually(t, func() bool {
+					return q.waiting.Load() == 3
+				}, time.Second, time.Millisecond)
+
+				release()
+				for i := 0; i < 3; i++ {
+					require.NoError(t, <-errs)
+				}
+			},
+		},
+		{
+			name: "canceled while waiting",
+			size: 1,
+			run: func(t *testing.T, q *workerQueue, release func()) {
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+				defer cancel()
+
+				_, err := q.interceptor(ctx, nil, queueInfo, handler)
+				require.Equal(t, codes.DeadlineExceeded, status.Code(err))
+				require.Equal(t, int64(0), q.waiting.Load())
+				release()
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newWorkerQueue(1, tt.size, 100*time.Millisecond, prometheus.NewGauge(prometheus.GaugeOpts{Name: "queue_depth"}))
+			tt.run(t, q, busyCall(t, q))
+
+			// the slot is free again
+			resp, err := q.interceptor(context.Background(), nil, queueInfo, handler)
+			require.NoError(t, err)
+			require.Equal(t, "ok", resp)
+		})
+	}
+}
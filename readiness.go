@@ -0,0 +1,159 @@
+package grpc
+
+import (
+	"context"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/sdk/v3/worker"
+	"go.uber.org/zap"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/durationpb"
+)
+
+const (
+	// gateWait delays the listener creation until the workers are ready
+	gateWait string = "wait"
+	// gateUnavailable rejects the calls with the Unavailable status until the workers are ready
+	gateUnavailable string = "unavailable"
+
+	// poll interval of the workers state while waiting for the ready worker
+	readinessPoll = 100 * time.Millisecond
+	// retry delay suggested to the clients rejected by the readiness gate
+	readinessRetryDelay = time.Second
+)
+
+// poolReady reports whether at least one worker is allocated and may serve the calls
+func (p *Plugin) poolReady() bool {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	workers := p.gPool.Workers()
+	for i := 0; i < len(workers); i++ {
+		if workers[i].State().IsActive() {
+			return true
+		}
+	}
+
+	return false
+}
+
+// waitReady waits for the ready worker up to the timeout
+func (p *Plugin) waitReady(timeout time.Duration) error {
+	const op = errors.Op("grpc_plugin_wait_ready")
+
+	deadline := time.Now().Add(timeout)
+	for !p.poolReady() {
+		if time.Now().After(deadline) {
+			return errors.E(op, errors.Errorf("no ready workers after %s", timeout))
+		}
+
+		time.Sleep(readinessPoll)
+	}
+
+	return nil
+}
+
+// readinessInterceptor rejects the calls with the retriable Unavailable status until the first worker is ready,
+// the pool is not checked after that
+func (p *Plugin) readinessInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	if p.ready.Load() {
+		return handler(ctx, req)
+	}
+
+	if !p.poolReady() {
+		st, err := status.New(codes.Unavailable, "workers are not ready yet").WithDetails(&errdetails.RetryInfo{RetryDelay: durationpb.New(readinessRetryDelay)})
+		if err != nil {
+			return nil, status.Error(codes.Unavailable, "workers are not ready yet")
+		}
+
+		return nil, st.Err()
+	}
+
+	p.ready.Store(true)
+	return handler(ctx, req)
+}
+
+// workersGate makes the health service (and so the readiness) report NOT_SERVING while less than min_ready_workers
+// workers are active: on start while the workers are booting and after the reset. The pool is polled every
+// readinessPoll.
+type workersGate struct {
+	plugin *Plugin
+	min    int
+	stopCh chan struct{}
+	done   chan struct{}
+}
+
+func newWorkersGate(p *Plugin, min int) *workersGate {
+	return &workersGate{
+		plugin: p,
+		min:    min,
+		stopCh: make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+// start sets the status right away and polls the pool until stop is called
+func (g *workersGate) start() {
+	g.check()
+
+	go func() {
+		defer close(g.done)
+
+		ticker := time.NewTicker(readinessPoll)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				g.check()
+			case <-g.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+// stop waits for the last check, so the status set on stop is not overwritten
+func (g *workersGate) stop() {
+	close(g.stopCh)
+	<-g.done
+}
+
+func (g *workersGate) check() {
+	p := g.plugin
+	if p.stopping.Load() {
+		return
+	}
+
+	// the pool is locked while being reset, the status is NOT_SERVING until it is checked after the reset
+	if !p.mu.TryRLock() {
+		return
+	}
+
+	active := 0
+	var workers []*worker.Process
+	if p.gPool != nil {
+		workers = p.gPool.Workers()
+	}
+	for i := 0; i < len(workers); i++ {
+		if workers[i].State().IsActive() {
+			active++
+		}
+	}
+	p.mu.RUnlock()
+
+	st := grpc_health_v1.HealthCheckResponse_NOT_SERVING
+	if active >= g.min {
+		st = grpc_health_v1.HealthCheckResponse_SERVING
+	}
+
+	if p.healthServer.ServingStatus() != st {
+		p.log.Info("serving status was changed by the ready workers count", zap.String("status", st.String()), zap.Int("active_workers", active), zap.Int("min_ready_workers", g.min))
+		p.healthServer.SetServingStatus(st)
+	}
+}
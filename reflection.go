@@ -0,0 +1,184 @@
+package grpc
+
+import (
+	"path/filepath"
+	"strings"
+
+	"github.com/jhump/protoreflect/desc"
+	"github.com/jhump/protoreflect/desc/protoparse"
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/reflection"
+	v1 "google.golang.org/grpc/reflection/grpc_reflection_v1"
+	v1alpha "google.golang.org/grpc/reflection/grpc_reflection_v1alpha"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protodesc"
+	"google.golang.org/protobuf/reflect/protoreflect"
+	"google.golang.org/protobuf/reflect/protoregistry"
+	"google.golang.org/protobuf/types/dynamicpb"
+)
+
+// registerReflection registers the server reflection services describing the services of the proto files. Both
+// versions are registered: the recent clients (grpcurl, buf) use v1, the older ones only v1alpha.
+func (p *Plugin) registerReflection(server *grpc.Server) error {
+	const op = errors.Op("grpc_plugin_register_reflection")
+
+	files, types, err := p.compileProtos()
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	srv := reflection.NewServer(reflection.ServerOptions{
+		Services:           server,
+		DescriptorResolver: files,
+		ExtensionResolver:  types,
+	})
+
+	v1alpha.RegisterServerReflectionServer(server, srv)
+	v1.RegisterServerReflectionServer(server, &reflectionV1{srv: srv})
+
+	return nil
+}
+
+// compileProtos compiles the proto files with their imports to the descriptors
+func (p *Plugin) compileProtos() (*protoregistry.Files, *protoregistry.Types, error) {
+	files := &protoregistry.Files{}
+	types := &protoregistry.Types{}
+
+	for i := 0; i < len(p.config.Proto); i++ {
+		// imports are resolved the same way as by the parser: relative to the proto file directory
+		parser := protoparse.Parser{ImportPaths: []string{filepath.Dir(p.config.Proto[i])}}
+		fds, err := parser.ParseFiles(filepath.Base(p.config.Proto[i]))
+		if err != nil {
+			return nil, nil, err
+		}
+
+		for j := 0; j < len(fds); j++ {
+			p.registerFile(files, types, fds[j])
+		}
+	}
+
+	return files, types, nil
+}
+
+// checkProtos compiles the proto files and reports all problems at once, e.g. the method request or response type
+// which is not declared or imported: a.proto:3:23: method app.S.Call: unknown request type Foo
+func (p *Plugin) checkProtos() error {
+	var problems []string
+
+	for i := 0; i < len(p.config.Proto); i++ {
+		parser := protoparse.Parser{
+			ImportPaths: []string{filepath.Dir(p.config.Proto[i])},
+			ErrorReporter: func(err protoparse.ErrorWithPos) error {
+				problems = append(problems, err.Error())
+				// continue to collect the errors
+				return nil
+			},
+		}
+
+		_, err := parser.ParseFiles(filepath.Base(p.config.Proto[i]))
+		if err != nil && len(problems) == 0 {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.Errorf("invalid proto files: %s", strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// registerFile registers the file descriptor with its dependencies, the files shared by several proto files are
+// registered once
+func (p *Plugin) registerFile(files *protoregistry.Files, types *protoregistry.Types, fd *desc.FileDescriptor) {
+	if _, err := files.FindFileByPath(fd.GetName()); err == nil {
+		return
+	}
+
+	deps := fd.GetDependencies()
+	for i := 0; i < len(deps); i++ {
+		p.registerFile(files, types, deps[i])
+	}
+
+	// dependencies are resolved from the registry
+	file, err := protodesc.NewFile(fd.AsFileDescriptorProto(), files)
+	if err == nil {
+		err = files.RegisterFile(file)
+	}
+
+	if err != nil {
+		// e.g. the same message is declared in the different files, the file can't be described
+		p.log.Warn("proto file can't be described by the reflection", zap.String("proto", fd.GetName()), zap.Error(err))
+		return
+	}
+
+	registerExtensions(types, file.Extensions())
+	registerMessageExtensions(types, file.Messages())
+}
+
+func registerMessageExtensions(types *protoregistry.Types, messages protoreflect.MessageDescriptors) {
+	for i := 0; i < messages.Len(); i++ {
+		registerExtensions(types, messages.Get(i).Extensions())
+		registerMessageExtensions(types, messages.Get(i).Messages())
+	}
+}
+
+func registerExtensions(types *protoregistry.Types, extensions protoreflect.ExtensionDescriptors) {
+	for i := 0; i < extensions.Len(); i++ {
+		// the same extension from the other file is already registered
+		_ = types.RegisterExtension(dynamicpb.NewExtensionType(extensions.Get(i)))
+	}
+}
+
+// reflectionV1 serves the v1 reflection with the v1alpha server, the messages of the versions are identical on
+// the wire
+type reflectionV1 struct {
+	v1.UnimplementedServerReflectionServer
+	srv v1alpha.ServerReflectionServer
+}
+
+func (r *reflectionV1) ServerReflectionInfo(stream v1.ServerReflection_ServerReflectionInfoServer) error {
+	return r.srv.ServerReflectionInfo(&reflectionV1Stream{ServerStream: stream})
+}
+
+// reflectionV1Stream converts the v1alpha responses to v1 and the v1 requests to v1alpha
+type reflectionV1Stream struct {
+	grpc.ServerStream
+}
+
+func (s *reflectionV1Stream) Send(resp *v1alpha.ServerReflectionResponse) error {
+	out := &v1.ServerReflectionResponse{}
+	err := convertMessage(resp, out)
+	if err != nil {
+		return err
+	}
+
+	return s.ServerStream.SendMsg(out)
+}
+
+func (s *reflectionV1Stream) Recv() (*v1alpha.ServerReflectionRequest, error) {
+	req := &v1.ServerReflectionRequest{}
+	err := s.ServerStream.RecvMsg(req)
+	if err != nil {
+		return nil, err
+	}
+
+	out := &v1alpha.ServerReflectionRequest{}
+	err = convertMessage(req, out)
+	if err != nil {
+		return nil, err
+	}
+
+	return out, nil
+}
+
+func convertMessage(from, to proto.Message) error {
+	data, err := proto.Marshal(from)
+	if err != nil {
+		return err
+	}
+
+	return proto.Unmarshal(data, to)
+}
@@ -4,28 +4,256 @@ import (
 	"context"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	stderr "errors"
 	"fmt"
 	"os"
 	"path"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/grpc/v3/codec"
 	"github.com/roadrunner-server/grpc/v3/parser"
 	"github.com/roadrunner-server/grpc/v3/proxy"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding"
 	"google.golang.org/grpc/keepalive"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/reflect/protoreflect"
 )
 
-func (p *Plugin) createGRPCserver() (*grpc.Server, error) {
+// timing trailers, the time in milliseconds
+const (
+	serverTimeTrailer string = "x-server-time-ms"
+	workerTimeTrailer string = "x-worker-time-ms"
+)
+
+// the graceful stop limit of the replaced servers when the shutdown timeout is not set
+const replaceTimeout = time.Minute
+
+// RegisterProto registers services from the proto file in addition to the configured ones.
+// Services can't be registered on the running gRPC server, so a new server with all services is built and swapped
+// with the current one behind the same listener: new connections are accepted by the new server, while the old one
+// is gracefully stopped letting the calls in flight complete. Clients are expected to reconnect (GOAWAY is sent).
+func (p *Plugin) RegisterProto(file string) error {
+	const op = errors.Op("grpc_plugin_register_proto")
+
+	if _, err := os.Stat(file); err != nil {
+		return errors.E(op, err)
+	}
+
+	p.rebuildMu.Lock()
+	defer p.rebuildMu.Unlock()
+
+	p.mu.Lock()
+	for i := 0; i < len(p.config.Proto); i++ {
+		if p.config.Proto[i] == file {
+			p.mu.Unlock()
+			return nil
+		}
+	}
+
+	// not serving yet, services will be registered on Serve
+	p.config.Proto = append(p.config.Proto, file)
+	p.mu.Unlock()
+
+	rebuilt, err := p.rebuildServer()
+	if err != nil {
+		p.mu.Lock()
+		p.config.Proto = p.config.Proto[:len(p.config.Proto)-1]
+		p.mu.Unlock()
+		return errors.E(op, err)
+	}
+
+	if rebuilt {
+		p.log.Info("grpc server was rebuilt with the new proto file", zap.String("proto", file))
+	}
+
+	return nil
+}
+
+// DrainConnections sends GOAWAY to all connected clients, so they reconnect (through the load balancer) while the
+// calls in flight are completed, e.g. to shed the connection-level load during the incidents. The connections are
+// drained by the gracefully stopped server replaced with the new one behind the same listener. GOAWAY is sent with
+// the NO_ERROR code and without the debug data (not supported by gRPC), the reason is logged.
+func (p *Plugin) DrainConnections(reason string) error {
+	const op = errors.Op("grpc_plugin_drain_connections")
+
+	p.rebuildMu.Lock()
+	defer p.rebuildMu.Unlock()
+
+	rebuilt, err := p.rebuildServer()
+	if err != nil {
+		return errors.E(op, err)
+	}
+
+	if rebuilt {
+		p.log.Warn("connections are drained", zap.String("reason", reason))
+	}
+
+	return nil
+}
+
+// rebuildServer builds the new server and swaps it with the current one, false is returned when the plugin is not
+// serving (yet or anymore). The server is built without the pool's lock, so the calls in flight are not blocked while
+// the proto files are parsed, the lock is taken only for the swap. The rebuildMu should be held.
+func (p *Plugin) rebuildServer() (bool, error) {
+	p.mu.RLock()
+	serving := p.server != nil && !p.stopping.Load()
+	p.mu.RUnlock()
+
+	if !serving {
+		return false, nil
+	}
+
+	built, err := p.createGRPCserver()
+	if err != nil {
+		return false, err
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	// stopped while the server was being built
+	if p.stopping.Load() {
+		p.healthServer.CloseWatches(built.server)
+		built.server.Stop()
+		return false, nil
+	}
+
+	p.replaceServer(built)
+
+	return true, nil
+}
+
+// replaceServer replaces the current server with the new one behind the same listener, the old server is stopped
+// gracefully: GOAWAY is sent to its connections and the calls in flight are completed up to the shutdown timeout
+// (1m when not set), the remaining calls are canceled after. The lock should be held.
+func (p *Plugin) replaceServer(built *serverBuild) {
+	old := p.server
+	oldListener := p.serverListener
+	// the old server stops taking the connections before the new one starts, the connection taken meanwhile is
+	// handed to the new server
+	_ = oldListener.Close()
+
+	p.setServer(built)
+	p.serve(built.server)
+
+	// the health watches never end by themselves and would hold the graceful stop
+	p.healthServer.CloseWatches(old)
+
+	timeout := replaceTimeout
+	if p.config.ShutdownTimeout > 0 {
+		timeout = p.config.ShutdownTimeout
+	}
+
+	// calls in flight hold the pool's read lock, so the old server is stopped in the background
+	go func() {
+		// Serve passes the connections accepted before the listener was closed to the server, so they are drained
+		// by the graceful stop instead of being closed as the connections of the stopped server
+		<-oldListener.served
+
+		if !stopGracefully(old, timeout) {
+			p.log.Warn("replaced server was not stopped in time, the remaining calls are canceled", zap.Duration("timeout", timeout))
+		}
+	}()
+}
+
+// stopGracefully stops the server gracefully up to the timeout, the remaining calls are canceled after. Reports
+// whether the server was stopped in time.
+func stopGracefully(server *grpc.Server, timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		// GOAWAY is sent to the clients, the server waits for the calls in flight
+		server.GracefulStop()
+		close(done)
+	}()
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		server.Stop()
+		return false
+	}
+}
+
+// serverBuild holds the server and the values built with it, the values used by the plugin are assigned together
+// with the server by setServer
+type serverBuild struct {
+	server  *grpc.Server
+	proxies []*proxy.Proxy
+	// response messages of the json_responses methods
+	jsonTypes map[string]protoreflect.MessageDescriptor
+	// client CAs verified per call, see TLS.ClientAuthFailure
+	clientCertPool *x509.CertPool
+	// TLS config of the HTTP health endpoint
+	httpTLSConfig *tls.Config
+	certChecker   *certChecker
+}
+
+// setServer makes the built server the current one, the lock should be held when serving
+func (p *Plugin) setServer(built *serverBuild) {
+	p.server = built.server
+	p.proxyList = built.proxies
+	p.httpTLSConfig = built.httpTLSConfig
+	p.certChecker = built.certChecker
+}
+
+// createGRPCserver builds the server without changing the plugin, so it may run while the current server is serving
+func (p *Plugin) createGRPCserver() (*serverBuild, error) {
 	const op = errors.Op("grpc_plugin_create_server")
-	opts, err := p.serverOptions()
+
+	if p.config.FailOnUndefinedTypes {
+		err := p.checkProtos()
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
+	}
+
+	built := &serverBuild{}
+
+	// used by the interceptor
+	var err error
+	built.jsonTypes, err = p.jsonResponseTypes()
+	if err != nil {
+		return nil, err
+	}
+
+	opts, err := p.serverOptions(built)
 	if err != nil {
 		return nil, errors.E(op, err)
 	}
 
 	server := grpc.NewServer(opts...)
+	proxies := make([]*proxy.Proxy, 0, 1)
+	proxyOpts := p.proxyOptions()
+
+	proxyOpts.RequestTransforms, err = p.requestTransforms()
+	if err != nil {
+		return nil, err
+	}
+
+	proxyOpts.DecodedMethods, err = p.decodedMethods()
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	parsed, err := p.parseProtos()
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
 
 	for i := 0; i < len(p.config.Proto); i++ {
 		if p.config.Proto[i] == "" {
@@ -33,56 +261,302 @@ func (p *Plugin) createGRPCserver() (*grpc.Server, error) {
 		}
 
 		// php proxy services
-		services, errP := parser.File(p.config.Proto[i], path.Dir(p.config.Proto[i]))
-		if errP != nil {
-			return nil, errP
+		services := parsed[i]
+
+		// e.g. the file with the messages only was configured instead of the file with the services
+		if len(services) == 0 {
+			if p.config.FailOnEmptyProto {
+				return nil, errors.E(op, errors.Errorf("proto file '%s' does not declare any service", p.config.Proto[i]))
+			}
+
+			p.log.Warn("proto file does not declare any service, nothing is registered from it", zap.String("proto", p.config.Proto[i]))
 		}
 
 		for _, service := range services {
-			px := proxy.NewProxy(fmt.Sprintf("%s.%s", service.Package, service.Name), p.config.Proto[i], p.gPool, p.mu)
+			name := fmt.Sprintf("%s.%s", service.Package, service.Name)
+			px := proxy.NewProxy(name, p.config.ServiceMetadata(name, p.config.Proto[i]), p.gPool, p.mu, proxyOpts)
 			for _, m := range service.Methods {
+				// there is no streaming exec in the pool, the whole message is buffered and sent to the worker at once
+				if m.StreamsRequest || m.StreamsReturns {
+					p.log.Warn("streaming is not supported, the method is served as unary: one buffered request and one response",
+						zap.String("method", fullMethodName(name, m.Name)), zap.Bool("client_streaming", m.StreamsRequest), zap.Bool("server_streaming", m.StreamsReturns))
+				}
+
 				px.RegisterMethod(m.Name)
 			}
 
-			server.RegisterService(px.ServiceDesc(), px)
-			p.proxyList = append(p.proxyList, px)
+			desc := px.ServiceDesc()
+			server.RegisterService(desc, px)
+			p.log.Debug("service was registered", zap.String("service", name), zap.Strings("methods", methodNames(desc)))
+			proxies = append(proxies, px)
+		}
+	}
+
+	p.healthServer.RegisterServer(server)
+
+	if p.orca != nil {
+		p.orca.register(server)
+	}
+
+	if p.config.Reflection {
+		err = p.registerReflection(server)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	built.server = server
+	built.proxies = proxies
+
+	return built, nil
+}
+
+// parseProtos parses the proto files concurrently (up to parse_concurrency files at once), the services are returned
+// in the order of the files, so they are registered in the same order regardless of the parsing order
+func (p *Plugin) parseProtos() ([][]parser.Service, error) {
+	parsed := make([][]parser.Service, len(p.config.Proto))
+	errs := make([]error, len(p.config.Proto))
+
+	sem := make(chan struct{}, p.config.ParseConcurrency)
+	wg := sync.WaitGroup{}
+	for i := 0; i < len(p.config.Proto); i++ {
+		if p.config.Proto[i] == "" {
+			continue
+		}
+
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			parsed[i], errs[i] = parser.File(p.config.Proto[i], path.Dir(p.config.Proto[i]))
+		}(i)
+	}
+	wg.Wait()
+
+	var problems []string
+	for i := 0; i < len(errs); i++ {
+		if errs[i] != nil {
+			problems = append(problems, fmt.Sprintf("'%s': %v", p.config.Proto[i], errs[i]))
+		}
+	}
+
+	if len(problems) > 0 {
+		return nil, errors.Errorf("failed to parse the proto files: %s", strings.Join(problems, "; "))
+	}
+
+	return parsed, nil
+}
+
+// methodNames returns the names of the service methods in the order of the description
+func methodNames(desc *grpc.ServiceDesc) []string {
+	names := make([]string, 0, len(desc.Methods))
+	for i := 0; i < len(desc.Methods); i++ {
+		names = append(names, desc.Methods[i].MethodName)
+	}
+
+	return names
+}
+
+// fullMethodName returns the full method name: /package.Service/Method
+func fullMethodName(service, method string) string {
+	return "/" + service + "/" + method
+}
+
+// proxyOptions returns the options shared by all proxies
+func (p *Plugin) proxyOptions() *proxy.Options {
+	opts := &proxy.Options{
+		MaxMetadataSize:       p.config.MaxResponseMetadataSize,
+		MaxMetadataKeys:       p.config.MaxResponseMetadataKeys,
+		ResponseTransforms:    p.transforms,
+		RequestValidators:     p.validators,
+		ErrorKey:              p.config.ErrorKey,
+		StatusKey:             p.config.StatusKey,
+		JSONErrorDetails:      p.config.JSONErrorDetails,
+		ErrorMapper:           p.errorMapper,
+		ExecObserver:          p.observeExec,
+		ProtocolErrorObserver: p.observeProtocolError,
+		QueueWaitObserver:     p.observeQueueWait,
+		QueueWaitHeader:       p.config.WorkerQueueHeader,
+		ExecTimeHeader:        p.config.WorkerElapsedHeader,
+		InstanceID:            p.instanceID(),
+		CompressMinSize:       p.config.CompressMinSize,
+		ResponseEnvelope:      p.config.ResponseEnvelope,
+		HTTPCacheHeaders:      p.config.HTTPCacheHeaders,
+		ContextValues:         p.contextValues,
+		MetadataAllowlist:     p.config.MetadataAllowlist,
+		MetadataDenylist:      p.config.MetadataDenylist,
+		AffinityKey:           p.config.AffinityMetadata,
+		PeerAddressFormat:     p.config.PeerAddressFormat,
+		Log:                   p.log,
+	}
+
+	if p.config.CircuitBreaker != nil {
+		// shared by the servers rebuilt with the new proto files
+		if p.breaker == nil {
+			p.breaker = newCircuitBreaker(p.config.CircuitBreaker, p.metrics.breakerState, p.log)
+			if p.config.CircuitBreaker.DrainOnOpen {
+				p.breaker.onOpen = func() {
+					err := p.DrainConnections("circuit breaker was opened")
+					if err != nil {
+						p.log.Error("failed to drain the connections", zap.Error(err))
+					}
+				}
+			}
+		}
+
+		opts.Breaker = p.breaker
+	}
+
+	// validated on init
+	opts.ContextCodec, _ = proxy.NewContextCodec(p.config.ContextCodec)
+
+	if p.config.ContextKeys != nil {
+		opts.ContextKeys = &proxy.ContextKeys{
+			Service: p.config.ContextKeys.Service,
+			Method:  p.config.ContextKeys.Method,
+			Context: p.config.ContextKeys.Context,
 		}
 	}
 
-	return server, nil
+	return opts
 }
 
 func (p *Plugin) interceptor(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
 	start := time.Now()
-	resp, err := handler(ctx, req)
+	// set by the proxy
+	workerElapsed := new(time.Duration)
+	resp, err := handler(context.WithValue(ctx, workerElapsedKey{}, workerElapsed), req)
+	if p.latency != nil {
+		p.latency.record(info.FullMethod, time.Since(start))
+	}
+
+	if p.config.TimingTrailers {
+		setTimingTrailers(ctx, time.Since(start), *workerElapsed)
+	}
+
+	if _, ok := p.config.logBodies[info.FullMethod]; ok {
+		p.logBodies(ctx, info.FullMethod, req, resp)
+	}
+
 	if err != nil {
-		p.log.Error("method call was finished with error", zap.Error(err), zap.String("method", info.FullMethod), zap.Time("start", start), zap.Duration("elapsed", time.Since(start)))
+		err = contextStatus(err)
+
+		// the client canceled the call or its deadline has expired, not a server error
+		if code := status.Code(err); ctx.Err() != nil && (code == codes.Canceled || code == codes.DeadlineExceeded) {
+			p.log.Info("method call was not finished", zap.String("code", code.String()), zap.String("method", info.FullMethod), zap.String("request_id", requestID(ctx)), zap.Time("start", start), zap.Duration("elapsed", time.Since(start)), zap.Duration("worker_elapsed", *workerElapsed))
+
+			return nil, err
+		}
+
+		p.log.Error("method call was finished with error", zap.Error(err), zap.String("method", info.FullMethod), zap.String("request_id", requestID(ctx)), zap.Time("start", start), zap.Duration("elapsed", time.Since(start)), zap.Duration("worker_elapsed", *workerElapsed))
 
 		return nil, err
 	}
 
-	p.log.Debug("method was called successfully", zap.String("method", info.FullMethod), zap.Time("start", start), zap.Duration("elapsed", time.Since(start)))
+	p.log.Debug("method was called successfully", zap.String("method", info.FullMethod), zap.String("request_id", requestID(ctx)), zap.Time("start", start), zap.Duration("elapsed", time.Since(start)), zap.Duration("worker_elapsed", *workerElapsed))
 	return resp, nil
 }
 
-func (p *Plugin) serverOptions() ([]grpc.ServerOption, error) {
+// setTimingTrailers sends the call time and the worker execution time (when the call reached the worker) in
+// milliseconds in the trailers
+func setTimingTrailers(ctx context.Context, elapsed, workerElapsed time.Duration) {
+	md := metadata.Pairs(serverTimeTrailer, formatMillis(elapsed))
+	if workerElapsed > 0 {
+		md.Set(workerTimeTrailer, formatMillis(workerElapsed))
+	}
+
+	_ = grpc.SetTrailer(ctx, md)
+}
+
+func formatMillis(d time.Duration) string {
+	return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', 3, 64)
+}
+
+// contextStatus converts the context errors returned without the status to the Canceled and DeadlineExceeded statuses
+func contextStatus(err error) error {
+	if _, ok := status.FromError(err); ok {
+		return err
+	}
+
+	switch {
+	case stderr.Is(err, context.Canceled):
+		return status.Error(codes.Canceled, err.Error())
+	case stderr.Is(err, context.DeadlineExceeded):
+		return status.Error(codes.DeadlineExceeded, err.Error())
+	default:
+		return err
+	}
+}
+
+// logBodies logs the truncated base64 encoded request and response bodies, the response is empty on error
+func (p *Plugin) logBodies(ctx context.Context, method string, req, resp any) {
+	p.log.Info("method bodies",
+		zap.String("method", method),
+		zap.String("request_id", requestID(ctx)),
+		zap.String("request", p.encodeBody(req)),
+		zap.String("response", p.encodeBody(resp)),
+	)
+}
+
+func (p *Plugin) encodeBody(body any) string {
+	msg, ok := messageBytes(body)
+	if !ok {
+		return ""
+	}
+
+	if len(msg) > p.config.LogBodiesMaxSize {
+		return base64.StdEncoding.EncodeToString(msg[:p.config.LogBodiesMaxSize]) + fmt.Sprintf("... (truncated, %d bytes)", len(msg))
+	}
+
+	return base64.StdEncoding.EncodeToString(msg)
+}
+
+// messageBytes returns the wire form of the request or the response: the raw message or the message decoded by the
+// proxy with the proto codec
+func messageBytes(v any) (codec.RawMessage, bool) {
+	switch msg := v.(type) {
+	case codec.RawMessage:
+		return msg, true
+	case *codec.RawMessage:
+		if msg == nil {
+			return nil, false
+		}
+
+		return *msg, true
+	case proto.Message:
+		data, err := proto.Marshal(msg)
+		if err != nil {
+			return nil, false
+		}
+
+		return data, true
+	default:
+		return nil, false
+	}
+}
+
+// serverOptions returns the options of the server, the TLS values used by the server are set to the build
+func (p *Plugin) serverOptions(built *serverBuild) ([]grpc.ServerOption, error) {
 	const op = errors.Op("grpc_plugin_server_options")
 
 	var tcreds credentials.TransportCredentials
 	var opts []grpc.ServerOption
-	var cert tls.Certificate
+	var certs *certSource
+	var tlsConfig *tls.Config
 	var certPool *x509.CertPool
-	var rca []byte
 	var err error
 
 	if p.config.EnableTLS() {
-		// if client CA is not empty we combine it with Cert and Key
-		if p.config.TLS.RootCA != "" {
-			cert, err = tls.LoadX509KeyPair(p.config.TLS.Cert, p.config.TLS.Key)
-			if err != nil {
-				return nil, err
-			}
+		certs, err = p.certSource()
+		if err != nil {
+			return nil, errors.E(op, err)
+		}
 
+		if p.config.TLS.clientCAs() {
 			certPool, err = x509.SystemCertPool()
 			if err != nil {
 				return nil, err
@@ -91,51 +565,219 @@ func (p *Plugin) serverOptions() ([]grpc.ServerOption, error) {
 				certPool = x509.NewCertPool()
 			}
 
-			rca, err = os.ReadFile(p.config.TLS.RootCA)
-			if err != nil {
-				return nil, err
+			files, errF := p.config.TLS.caFiles()
+			if errF != nil {
+				return nil, errors.E(op, errF)
 			}
 
-			if ok := certPool.AppendCertsFromPEM(rca); !ok {
-				return nil, errors.E(op, errors.Str("could not append Certs from PEM"))
+			loaded := 0
+			for i := 0; i < len(files); i++ {
+				n, errA := appendCAFile(certPool, files[i])
+				if errA != nil {
+					return nil, errors.E(op, errA)
+				}
+
+				loaded += n
 			}
 
-			opts = append(opts, grpc.Creds(credentials.NewTLS(&tls.Config{
-				MinVersion:   tls.VersionTLS12,
-				ClientAuth:   p.config.TLS.auth,
-				Certificates: []tls.Certificate{cert},
-				ClientCAs:    certPool,
-			})))
+			p.log.Info("client certificates CAs were loaded", zap.Int("files", len(files)), zap.Int("certificates", loaded))
+
+			tlsConfig = &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				ClientAuth:     p.config.TLS.auth,
+				GetCertificate: certs.getCertificate,
+				ClientCAs:      certPool,
+			}
 		} else {
 			// regular TLS from the cert+key
-			tcreds, err = credentials.NewServerTLSFromFile(p.config.TLS.Cert, p.config.TLS.Key)
-			if err != nil {
-				return nil, err
+			tlsConfig = &tls.Config{
+				MinVersion:     tls.VersionTLS12,
+				GetCertificate: certs.getCertificate,
+			}
+		}
+
+		if p.certCheck != nil {
+			// shared by the servers rebuilt with the new proto files
+			built.certChecker = p.certChecker
+			if built.certChecker == nil {
+				built.certChecker = newCertChecker(p.certCheck, p.config.TLS, p.log)
 			}
 
-			opts = append(opts, grpc.Creds(tcreds))
+			tlsConfig.VerifyConnection = built.certChecker.verifyConnection
+		}
+
+		if p.config.HTTPHealthPath != "" {
+			built.httpTLSConfig = tlsConfig.Clone()
+			built.httpTLSConfig.NextProtos = []string{"http/1.1"}
+		}
+
+		if p.config.TLS.verifyPerCall() {
+			// verified by the clientCertInterceptor
+			built.clientCertPool = certPool
+			tlsConfig.ClientAuth = tls.RequestClientCert
+		}
+
+		if p.ticketKeys != nil {
+			tlsConfig = p.ticketKeys.wrap(tlsConfig)
+		}
+
+		tcreds = credentials.NewTLS(tlsConfig)
+
+		if p.config.TLS.LogHandshakes {
+			tcreds = newHandshakeLogCreds(tcreds, p.log, p.metrics.tlsHandshakes)
+		}
+
+		if p.config.TLS.AllowPlaintext {
+			p.log.Warn("plaintext (h2c) connections are accepted on the TLS port, workers should check the peer auth type")
+			tcreds = newFallbackCreds(tcreds, p.config.TLS.HandshakeTimeout)
 		}
 	}
 
+	if p.config.LogConnections {
+		tcreds = newPingLogCreds(tcreds, p.log)
+	}
+
+	if tcreds != nil {
+		opts = append(opts, grpc.Creds(tcreds))
+	}
+
 	serverOptions := []grpc.ServerOption{
 		grpc.MaxSendMsgSize(int(p.config.MaxSendMsgSize)),
 		grpc.MaxRecvMsgSize(int(p.config.MaxRecvMsgSize)),
 		grpc.KeepaliveParams(keepalive.ServerParameters{
 			MaxConnectionIdle:     p.config.MaxConnectionIdle,
 			MaxConnectionAge:      p.config.MaxConnectionAge,
-			MaxConnectionAgeGrace: p.config.MaxConnectionAge,
+			MaxConnectionAgeGrace: p.config.MaxConnectionAgeGrace,
 			Time:                  p.config.PingTime,
 			Timeout:               p.config.Timeout,
 		}),
 		grpc.MaxConcurrentStreams(uint32(p.config.MaxConcurrentStreams)),
 	}
 
+	if p.config.LogConnections || p.config.MaxConnectionCalls > 0 {
+		serverOptions = append(serverOptions, grpc.StatsHandler(newConnStats(p.config.LogConnections, p.config.MaxConnectionAge, p.config.MaxConnectionIdle, p.log)))
+	}
+
 	opts = append(opts, serverOptions...)
 	opts = append(opts, p.opts...)
 
 	// custom codec is required to bypass protobuf, common interceptor used for debug and stats
 	return append(
 		opts,
-		grpc.UnaryInterceptor(p.interceptor),
+		grpc.ForceServerCodec(p.serverCodec()),
+		grpc.ChainUnaryInterceptor(p.unaryInterceptors(built)...),
 	), nil
 }
+
+// serverCodec returns the codec used to decode requests and encode responses: the raw messages are passed as is,
+// the messages decoded by the proxies (proto codec) are encoded with the standard codec
+func (p *Plugin) serverCodec() encoding.Codec {
+	return &codec.Codec{
+		Base: encoding.GetCodec(codec.Name),
+	}
+}
+
+// decodedMethods returns the descriptors of all methods of the compiled proto files when the proto codec is used,
+// the proxies decode the messages of the methods for the interceptors
+func (p *Plugin) decodedMethods() (map[string]protoreflect.MethodDescriptor, error) {
+	if p.config.Codec != ProtoCodec {
+		return nil, nil
+	}
+
+	files, _, err := p.compileProtos()
+	if err != nil {
+		return nil, err
+	}
+
+	methods := make(map[string]protoreflect.MethodDescriptor)
+	files.RangeFiles(func(fd protoreflect.FileDescriptor) bool {
+		for i := 0; i < fd.Services().Len(); i++ {
+			sd := fd.Services().Get(i)
+			for j := 0; j < sd.Methods().Len(); j++ {
+				md := sd.Methods().Get(j)
+				methods[fullMethodName(string(sd.FullName()), string(md.Name()))] = md
+			}
+		}
+
+		return true
+	})
+
+	p.log.Warn("requests and responses are decoded with the proto codec, use it only for debugging")
+
+	return methods, nil
+}
+
+// certSource returns the source of the server certificate: the files are loaded on every server rebuild, the
+// registered provider is shared by the rebuilt servers and refreshes the certificate itself
+func (p *Plugin) certSource() (*certSource, error) {
+	if !p.config.TLS.ExternalCert {
+		return newCertSource(&fileCertProvider{cert: p.config.TLS.Cert, key: p.config.TLS.Key, password: p.config.TLS.KeyPassword}, p.log)
+	}
+
+	if p.certs != nil {
+		return p.certs, nil
+	}
+
+	if p.certProvider == nil {
+		return nil, errors.Str("tls external_cert is enabled, but no certificate provider was registered")
+	}
+
+	certs, err := newCertSource(p.certProvider, p.log)
+	if err != nil {
+		return nil, err
+	}
+
+	p.certs = certs
+	p.certs.start()
+
+	return certs, nil
+}
+
+// instanceID returns the id sent in the response headers, empty when the header is disabled
+func (p *Plugin) instanceID() string {
+	if !p.config.InstanceIDHeader {
+		return ""
+	}
+
+	return p.config.InstanceID
+}
+
+// RegisterResponseTransform registers the function post-processing the raw response bodies of the method
+// (full method name: /package.Service/Method) before they are sent to the client, e.g. to strip a field during the
+// schema migration. Transforms should be registered before the plugin starts serving.
+func (p *Plugin) RegisterResponseTransform(method string, transform proxy.BodyTransform) {
+	if p.transforms == nil {
+		p.transforms = make(map[string]proxy.BodyTransform)
+	}
+
+	p.transforms[method] = transform
+}
+
+// RegisterErrorMapper replaces the conversion of the worker errors to the call statuses (code|:|message|:|details by
+// default, see proxy.DefaultErrorMapper), e.g. to map the PHP exception classes to the codes. The mapper should be
+// registered before the plugin starts serving.
+func (p *Plugin) RegisterErrorMapper(mapper proxy.ErrorMapper) {
+	p.errorMapper = mapper
+}
+
+// RegisterRequestValidator registers the function checking the raw request bodies of the method (full method name:
+// /package.Service/Method) before they are sent to the worker, the calls failing the check are rejected with the
+// InvalidArgument status. Validators should be registered before the plugin starts serving.
+func (p *Plugin) RegisterRequestValidator(method string, validator proxy.RequestValidator) {
+	if p.validators == nil {
+		p.validators = make(map[string]proxy.RequestValidator)
+	}
+
+	p.validators[method] = validator
+}
+
+// RegisterContextValue forwards the value stored in the call context with the key (e.g. by the interceptor passed
+// as the server option) to the worker as the context metadata entry name, serialize converts the value to the
+// metadata values. Values should be registered before the plugin starts serving.
+func (p *Plugin) RegisterContextValue(name string, key any, serialize func(v any) ([]string, error)) {
+	p.contextValues = append(p.contextValues, &proxy.ContextValue{
+		Name:      name,
+		Key:       key,
+		Serialize: serialize,
+	})
+}
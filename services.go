@@ -0,0 +1,26 @@
+package grpc
+
+// ServiceInfo describes the service registered from the proto files
+type ServiceInfo struct {
+	// Name is the full service name: package.Service
+	Name string `json:"name"`
+	// Methods are the registered methods names
+	Methods []string `json:"methods"`
+}
+
+// Services returns the services and methods registered on the running server, it's purely introspective and
+// helps to check that all methods of the proto files were registered as expected.
+func (p *Plugin) Services() []ServiceInfo {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	services := make([]ServiceInfo, 0, len(p.proxyList))
+	for i := 0; i < len(p.proxyList); i++ {
+		services = append(services, ServiceInfo{
+			Name:    p.proxyList[i].Name(),
+			Methods: p.proxyList[i].Methods(),
+		})
+	}
+
+	return services
+}
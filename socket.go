@@ -0,0 +1,93 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/roadrunner-server/sdk/v3/utils"
+	"go.uber.org/zap"
+)
+
+// createListener creates the listening socket. Without the socket options the listener is created the same way as
+// by the other RoadRunner plugins (SO_REUSEPORT and TCP_FASTOPEN are set on Linux, macOS and FreeBSD).
+func (p *Plugin) createListener() (net.Listener, error) {
+	if p.config.Socket == nil {
+		return utils.CreateListener(p.config.Listen)
+	}
+
+	addr := p.config.Listen
+	if strings.HasPrefix(addr, "unix://") {
+		p.log.Warn("socket options are supported only for the tcp listener, ignored", zap.String("address", addr))
+		return utils.CreateListener(addr)
+	}
+
+	addr = strings.TrimPrefix(addr, "tcp://")
+
+	lc := &net.ListenConfig{
+		KeepAlive: p.config.Socket.TCPKeepAlive,
+	}
+
+	if p.config.Socket.ReusePort {
+		if !reusePortSupported {
+			p.log.Warn("SO_REUSEPORT is not supported on this platform, ignored")
+		} else {
+			lc.Control = func(_, _ string, c syscall.RawConn) error {
+				var errS error
+				err := c.Control(func(fd uintptr) {
+					errS = setReusePort(fd)
+				})
+				if err != nil {
+					return err
+				}
+
+				return errS
+			}
+		}
+	}
+
+	ln, err := lc.Listen(context.Background(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if p.config.Socket.Backlog > 0 {
+		err = p.setBacklog(ln)
+		if err != nil {
+			_ = ln.Close()
+			return nil, err
+		}
+	}
+
+	return ln, nil
+}
+
+// setBacklog calls listen(2) again on the listening socket, it updates the backlog set by Go (the net package uses
+// the OS limit and has no option to change it)
+func (p *Plugin) setBacklog(ln net.Listener) error {
+	if !backlogSupported {
+		p.log.Warn("listen backlog is not supported on this platform, ignored")
+		return nil
+	}
+
+	tl, ok := ln.(*net.TCPListener)
+	if !ok {
+		return nil
+	}
+
+	rc, err := tl.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var errS error
+	err = rc.Control(func(fd uintptr) {
+		errS = setBacklog(fd, p.config.Socket.Backlog)
+	})
+	if err != nil {
+		return err
+	}
+
+	return errS
+}
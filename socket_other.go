@@ -0,0 +1,16 @@
+//go:build !linux && !darwin && !freebsd
+
+package grpc
+
+const (
+	reusePortSupported = false
+	backlogSupported   = false
+)
+
+func setReusePort(uintptr) error {
+	return nil
+}
+
+func setBacklog(uintptr, int) error {
+	return nil
+}
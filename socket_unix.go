@@ -0,0 +1,22 @@
+//go:build linux || darwin || freebsd
+
+package grpc
+
+import (
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// SO_REUSEPORT is available on the platform
+	reusePortSupported = true
+	// listen(2) on the listening socket updates the backlog
+	backlogSupported = true
+)
+
+func setReusePort(fd uintptr) error {
+	return unix.SetsockoptInt(int(fd), unix.SOL_SOCKET, unix.SO_REUSEPORT, 1)
+}
+
+func setBacklog(fd uintptr, backlog int) error {
+	return unix.Listen(int(fd), backlog)
+}
@@ -0,0 +1,53 @@
+package grpc
+
+import (
+	"net/http"
+
+	"github.com/roadrunner-server/sdk/v3/fsm"
+	"github.com/roadrunner-server/sdk/v3/plugins/status"
+	"google.golang.org/grpc/health/grpc_health_v1"
+)
+
+// Status returns the liveness status: at least one worker is alive
+func (p *Plugin) Status() (*status.Status, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.gPool == nil {
+		return &status.Status{Code: http.StatusServiceUnavailable}, nil
+	}
+
+	workers := p.gPool.Workers()
+	for i := 0; i < len(workers); i++ {
+		if workers[i].State().IsActive() {
+			return &status.Status{Code: http.StatusOK}, nil
+		}
+	}
+
+	// if there are no workers, threat this as error
+	return &status.Status{Code: http.StatusServiceUnavailable}, nil
+}
+
+// Ready returns the readiness status: the server accepts connections, the health service reports SERVING
+// and at least one worker is ready to accept the calls
+func (p *Plugin) Ready() (*status.Status, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	if p.gPool == nil || p.listener == nil || p.healthServer == nil {
+		return &status.Status{Code: http.StatusServiceUnavailable}, nil
+	}
+
+	if p.healthServer.ServingStatus() != grpc_health_v1.HealthCheckResponse_SERVING {
+		return &status.Status{Code: http.StatusServiceUnavailable}, nil
+	}
+
+	workers := p.gPool.Workers()
+	for i := 0; i < len(workers); i++ {
+		if workers[i].State().Compare(fsm.StateReady) {
+			return &status.Status{Code: http.StatusOK}, nil
+		}
+	}
+
+	return &status.Status{Code: http.StatusServiceUnavailable}, nil
+}
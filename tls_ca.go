@@ -0,0 +1,99 @@
+package grpc
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/roadrunner-server/errors"
+)
+
+// clientCAs reports whether the client certificates CAs are configured
+func (t *TLS) clientCAs() bool {
+	return t.RootCA != "" || len(t.RootCAs) > 0
+}
+
+// caFiles returns the root CA files, directories are expanded to the regular files they contain (not recursively)
+func (t *TLS) caFiles() ([]string, error) {
+	paths := make([]string, 0, len(t.RootCAs)+1)
+	if t.RootCA != "" {
+		paths = append(paths, t.RootCA)
+	}
+	paths = append(paths, t.RootCAs...)
+
+	files := make([]string, 0, len(paths))
+	for i := 0; i < len(paths); i++ {
+		fi, err := os.Stat(paths[i])
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil, errors.Errorf("root ca file '%s' does not exists", paths[i])
+			}
+
+			return nil, errors.Errorf("root ca file '%s' is not readable: %v", paths[i], err)
+		}
+
+		if !fi.IsDir() {
+			files = append(files, paths[i])
+			continue
+		}
+
+		entries, err := os.ReadDir(paths[i])
+		if err != nil {
+			return nil, errors.Errorf("root ca directory '%s' is not readable: %v", paths[i], err)
+		}
+
+		dirFiles := make([]string, 0, len(entries))
+		for _, e := range entries {
+			if e.Type().IsRegular() {
+				dirFiles = append(dirFiles, filepath.Join(paths[i], e.Name()))
+			}
+		}
+
+		if len(dirFiles) == 0 {
+			return nil, errors.Errorf("root ca directory '%s' is empty", paths[i])
+		}
+
+		sort.Strings(dirFiles)
+		files = append(files, dirFiles...)
+	}
+
+	return files, nil
+}
+
+// appendCAFile adds the PEM certificates of the file to the pool and returns the number of the added certificates,
+// the file without certificates is an error
+func appendCAFile(pool *x509.CertPool, file string) (int, error) {
+	data, err := readTLSFile("root ca", file)
+	if err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for len(data) > 0 {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			break
+		}
+
+		if block.Type != "CERTIFICATE" || len(block.Headers) != 0 {
+			continue
+		}
+
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return 0, errors.Errorf("root ca '%s' contains invalid certificate: %v", file, err)
+		}
+
+		pool.AddCert(cert)
+		n++
+	}
+
+	if n == 0 {
+		return 0, errors.Errorf("root ca '%s' does not contain PEM certificates", file)
+	}
+
+	return n, nil
+}
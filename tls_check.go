@@ -0,0 +1,121 @@
+package grpc
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"sync"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// the expired results are purged when the cache grows over the size
+const certCheckCachePurgeSize int = 1024
+
+// CertificateCheck checks the client certificate during the TLS handshake, e.g. in the external revocation service,
+// the connection is rejected when the error is returned
+type CertificateCheck func(cert *x509.Certificate) error
+
+// RegisterCertificateCheck registers the check of the client certificates called during the handshakes (including
+// the resumed sessions). The results are cached by the certificate for TLS.CertCheckCacheTTL. The check should be
+// registered before the plugin starts serving.
+func (p *Plugin) RegisterCertificateCheck(check CertificateCheck) {
+	p.certCheck = check
+}
+
+// certChecker calls the certificate check with the timeout and caches the results
+type certChecker struct {
+	check    CertificateCheck
+	ttl      time.Duration
+	timeout  time.Duration
+	failOpen bool
+	log      *zap.Logger
+
+	mu    sync.Mutex
+	cache map[[sha256.Size]byte]certCheckResult
+}
+
+type certCheckResult struct {
+	err     error
+	expires time.Time
+}
+
+func newCertChecker(check CertificateCheck, cfg *TLS, log *zap.Logger) *certChecker {
+	return &certChecker{
+		check:    check,
+		ttl:      cfg.CertCheckCacheTTL,
+		timeout:  cfg.CertCheckTimeout,
+		failOpen: cfg.CertCheckFailOpen,
+		log:      log,
+		cache:    make(map[[sha256.Size]byte]certCheckResult),
+	}
+}
+
+// verifyConnection is the tls.Config VerifyConnection callback, the connections without the client certificate
+// are left to the client auth type
+func (c *certChecker) verifyConnection(state tls.ConnectionState) error {
+	if len(state.PeerCertificates) == 0 {
+		return nil
+	}
+
+	cert := state.PeerCertificates[0]
+	key := sha256.Sum256(cert.Raw)
+
+	if r, ok := c.cached(key); ok {
+		return r.err
+	}
+
+	res := make(chan error, 1)
+	go func() {
+		err := c.check(cert)
+		// the late results are cached as well
+		c.store(key, err)
+		res <- err
+	}()
+
+	select {
+	case err := <-res:
+		if err != nil {
+			c.log.Warn("client certificate was rejected by the check", zap.String("subject", cert.Subject.String()), zap.String("serial", cert.SerialNumber.String()), zap.Error(err))
+		}
+
+		return err
+	case <-time.After(c.timeout):
+		c.log.Warn("client certificate check timed out", zap.String("subject", cert.Subject.String()), zap.Duration("timeout", c.timeout), zap.Bool("fail_open", c.failOpen))
+		if c.failOpen {
+			return nil
+		}
+
+		return errors.Errorf("client certificate check timed out after %s", c.timeout)
+	}
+}
+
+func (c *certChecker) cached(key [sha256.Size]byte) (certCheckResult, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	r, ok := c.cache[key]
+	if !ok || time.Now().After(r.expires) {
+		return certCheckResult{}, false
+	}
+
+	return r, true
+}
+
+func (c *certChecker) store(key [sha256.Size]byte, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if len(c.cache) >= certCheckCachePurgeSize {
+		for k, r := range c.cache {
+			if now.After(r.expires) {
+				delete(c.cache, k)
+			}
+		}
+	}
+
+	c.cache[key] = certCheckResult{err: err, expires: now.Add(c.ttl)}
+}
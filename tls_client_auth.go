@@ -0,0 +1,87 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+const (
+	// the client certificate problems fail the TLS handshake
+	clientAuthFailureHandshake string = "handshake"
+	// the client certificate is requested in the handshake and verified per call
+	clientAuthFailureUnauthenticated string = "unauthenticated"
+)
+
+// verifyPerCall reports whether the client certificate is required or verified per call instead of the handshake
+func (t *TLS) verifyPerCall() bool {
+	if t.ClientAuthFailure != clientAuthFailureUnauthenticated {
+		return false
+	}
+
+	switch t.auth { //nolint:exhaustive
+	case tls.RequireAnyClientCert, tls.VerifyClientCertIfGiven, tls.RequireAndVerifyClientCert:
+		return true
+	default:
+		return false
+	}
+}
+
+// clientCertInterceptor makes the checks of the client auth type skipped in the handshake (the certificate is only
+// requested) and rejects the calls with the Unauthenticated status: the clients get the reason instead of the
+// transport error. The chain is verified on every call.
+func clientCertInterceptor(auth tls.ClientAuthType, roots *x509.CertPool) grpc.UnaryServerInterceptor {
+	required := auth == tls.RequireAnyClientCert || auth == tls.RequireAndVerifyClientCert
+	verify := auth == tls.VerifyClientCertIfGiven || auth == tls.RequireAndVerifyClientCert
+
+	return func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		pr, ok := peer.FromContext(ctx)
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		// plaintext connections are allowed by allow_plaintext
+		info, ok := pr.AuthInfo.(credentials.TLSInfo)
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		certs := info.State.PeerCertificates
+		if len(certs) == 0 {
+			if required {
+				return nil, status.Error(codes.Unauthenticated, "client certificate required")
+			}
+
+			return handler(ctx, req)
+		}
+
+		if verify {
+			// the same verification as in the handshake
+			opts := x509.VerifyOptions{
+				Roots:         roots,
+				Intermediates: x509.NewCertPool(),
+				KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+			}
+
+			for i := 1; i < len(certs); i++ {
+				opts.Intermediates.AddCert(certs[i])
+			}
+
+			_, err := certs[0].Verify(opts)
+			if err != nil {
+				return nil, status.Errorf(codes.Unauthenticated, "client certificate '%s' verification failed: %v", certs[0].Subject.String(), err)
+			}
+		}
+
+		// for the client identities check
+		ctx = context.WithValue(ctx, verifiedClientCertKey{}, struct{}{})
+
+		return handler(ctx, req)
+	}
+}
@@ -0,0 +1,46 @@
+package grpc
+
+import (
+	"context"
+	"crypto/x509"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// clientEKUInterceptor rejects the calls made with the client certificate without the clientAuth extended key usage.
+// Go accepts the certificates without the EKU extension for any usage and does not check the EKU at all for the
+// not verified client certificates. The check is made per call (not in the TLS handshake) to reject the call
+// with the Unauthenticated status instead of the handshake failure.
+func clientEKUInterceptor(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return handler(ctx, req)
+	}
+
+	// plaintext connections and the connections without the client certificate are controlled by the auth type
+	info, ok := pr.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return handler(ctx, req)
+	}
+
+	leaf := info.State.PeerCertificates[0]
+	if !hasClientAuthEKU(leaf) {
+		return nil, status.Errorf(codes.Unauthenticated, "client certificate '%s' is not issued for the client authentication", leaf.Subject.String())
+	}
+
+	return handler(ctx, req)
+}
+
+func hasClientAuthEKU(cert *x509.Certificate) bool {
+	for _, eku := range cert.ExtKeyUsage {
+		if eku == x509.ExtKeyUsageClientAuth {
+			return true
+		}
+	}
+
+	return false
+}
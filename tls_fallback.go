@@ -0,0 +1,90 @@
+package grpc
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"google.golang.org/grpc/credentials"
+)
+
+const (
+	// first byte of the TLS record with the handshake content type
+	tlsHandshakeRecord byte   = 0x16
+	plaintextAuthType  string = "insecure"
+)
+
+// fallbackCreds accepts both TLS and plaintext (h2c) connections on the same listener.
+// The connection type is detected by the first byte sent by the client: TLS connections always start
+// with the handshake record, while plaintext HTTP/2 connections start with the client preface (PRI * HTTP/2.0).
+type fallbackCreds struct {
+	credentials.TransportCredentials
+	timeout time.Duration
+}
+
+func newFallbackCreds(tlsCreds credentials.TransportCredentials, timeout time.Duration) credentials.TransportCredentials {
+	return &fallbackCreds{
+		TransportCredentials: tlsCreds,
+		timeout:              timeout,
+	}
+}
+
+func (f *fallbackCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	const op = errors.Op("grpc_fallback_creds_handshake")
+
+	// slow or silent clients should not hold the connection forever, gRPC resets the deadline after the handshake
+	err := conn.SetDeadline(time.Now().Add(f.timeout))
+	if err != nil {
+		return nil, nil, errors.E(op, err)
+	}
+
+	first := make([]byte, 1)
+	_, err = conn.Read(first)
+	if err != nil {
+		return nil, nil, errors.E(op, err)
+	}
+
+	pc := &peekedConn{Conn: conn, peeked: first}
+	if first[0] == tlsHandshakeRecord {
+		return f.TransportCredentials.ServerHandshake(pc)
+	}
+
+	return pc, plaintextAuthInfo{CommonAuthInfo: credentials.CommonAuthInfo{SecurityLevel: credentials.NoSecurity}}, nil
+}
+
+func (f *fallbackCreds) Clone() credentials.TransportCredentials {
+	return &fallbackCreds{
+		TransportCredentials: f.TransportCredentials.Clone(),
+		timeout:              f.timeout,
+	}
+}
+
+func (f *fallbackCreds) ClientHandshake(_ context.Context, _ string, _ net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.Str("fallback credentials can be used only on the server side")
+}
+
+// plaintextAuthInfo is reported for the connections accepted without TLS
+type plaintextAuthInfo struct {
+	credentials.CommonAuthInfo
+}
+
+func (plaintextAuthInfo) AuthType() string {
+	return plaintextAuthType
+}
+
+// peekedConn returns already read bytes before reading from the underlying connection
+type peekedConn struct {
+	net.Conn
+	peeked []byte
+}
+
+func (p *peekedConn) Read(b []byte) (int, error) {
+	if len(p.peeked) > 0 {
+		n := copy(b, p.peeked)
+		p.peeked = p.peeked[n:]
+		return n, nil
+	}
+
+	return p.Conn.Read(b)
+}
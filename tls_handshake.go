@@ -0,0 +1,79 @@
+package grpc
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/credentials"
+)
+
+// handshakeLogCreds logs the successful TLS handshakes with the negotiated parameters and counts them by the version
+// and the cipher suite. The handshakes with the client certificate are logged at the info level (audit), the rest
+// at the debug level.
+type handshakeLogCreds struct {
+	credentials.TransportCredentials
+	log     *zap.Logger
+	counter *prometheus.CounterVec
+}
+
+func newHandshakeLogCreds(tlsCreds credentials.TransportCredentials, log *zap.Logger, counter *prometheus.CounterVec) credentials.TransportCredentials {
+	return &handshakeLogCreds{
+		TransportCredentials: tlsCreds,
+		log:                  log,
+		counter:              counter,
+	}
+}
+
+func (h *handshakeLogCreds) ServerHandshake(conn net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	c, info, err := h.TransportCredentials.ServerHandshake(conn)
+	if err != nil {
+		return c, info, err
+	}
+
+	// plaintext connections accepted by the fallback credentials
+	tlsInfo, ok := info.(credentials.TLSInfo)
+	if !ok {
+		return c, info, nil
+	}
+
+	state := tlsInfo.State
+	version := tls.VersionName(state.Version)
+	cipher := tls.CipherSuiteName(state.CipherSuite)
+	h.counter.WithLabelValues(version, cipher).Inc()
+
+	fields := []zap.Field{
+		zap.String("peer", conn.RemoteAddr().String()),
+		zap.String("version", version),
+		zap.String("cipher_suite", cipher),
+		zap.String("server_name", state.ServerName),
+		zap.String("alpn", state.NegotiatedProtocol),
+		zap.Bool("resumed", state.DidResume),
+	}
+
+	if len(state.PeerCertificates) == 0 {
+		h.log.Debug("tls handshake was completed", fields...)
+		return c, info, nil
+	}
+
+	leaf := state.PeerCertificates[0]
+	fields = append(fields, zap.String("client_subject", leaf.Subject.String()), zap.String("client_issuer", leaf.Issuer.String()), zap.String("client_serial", leaf.SerialNumber.String()))
+	h.log.Info("tls handshake was completed", fields...)
+
+	return c, info, nil
+}
+
+func (h *handshakeLogCreds) Clone() credentials.TransportCredentials {
+	return &handshakeLogCreds{
+		TransportCredentials: h.TransportCredentials.Clone(),
+		log:                  h.log,
+		counter:              h.counter,
+	}
+}
+
+func (h *handshakeLogCreds) ClientHandshake(_ context.Context, _ string, _ net.Conn) (net.Conn, credentials.AuthInfo, error) {
+	return nil, nil, errors.Str("handshake log credentials can be used only on the server side")
+}
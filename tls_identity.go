@@ -0,0 +1,101 @@
+package grpc
+
+import (
+	"context"
+	"crypto/x509"
+	"strings"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// verifiedClientCertKey marks the calls with the client certificate verified by the clientCertInterceptor, the
+// handshake doesn't verify it then
+type verifiedClientCertKey struct{}
+
+// clientIdentityInterceptor allows the calls of the methods only to the clients with the allowed identities: the
+// subject CN, the DNS, URI (e.g. SPIFFE ID) or email SAN of the verified client certificate. The calls of the other
+// methods are not checked.
+func (p *Plugin) clientIdentityInterceptor() grpc.UnaryServerInterceptor {
+	allowed := make(map[string][]string, len(p.config.ClientIdentities))
+	for _, ci := range p.config.ClientIdentities {
+		allowed[ci.Method] = append(allowed[ci.Method], ci.Identities...)
+	}
+
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		identities, ok := allowed[info.FullMethod]
+		if !ok {
+			return handler(ctx, req)
+		}
+
+		cert := verifiedClientCert(ctx)
+		if cert == nil {
+			return nil, status.Errorf(codes.PermissionDenied, "method %s requires the verified client certificate", info.FullMethod)
+		}
+
+		if !matchIdentity(identities, certIdentities(cert)) {
+			return nil, status.Errorf(codes.PermissionDenied, "client '%s' is not allowed to call the method %s", cert.Subject.String(), info.FullMethod)
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// verifiedClientCert returns the client certificate verified in the handshake or by the clientCertInterceptor
+func verifiedClientCert(ctx context.Context) *x509.Certificate {
+	pr, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	// plaintext connections are not authenticated
+	info, ok := pr.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.PeerCertificates) == 0 {
+		return nil
+	}
+
+	if len(info.State.VerifiedChains) == 0 && ctx.Value(verifiedClientCertKey{}) == nil {
+		return nil
+	}
+
+	return info.State.PeerCertificates[0]
+}
+
+func certIdentities(cert *x509.Certificate) []string {
+	identities := make([]string, 0, 1+len(cert.DNSNames)+len(cert.URIs)+len(cert.EmailAddresses))
+	if cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+
+	identities = append(identities, cert.DNSNames...)
+	for i := 0; i < len(cert.URIs); i++ {
+		identities = append(identities, cert.URIs[i].String())
+	}
+
+	return append(identities, cert.EmailAddresses...)
+}
+
+// matchIdentity reports whether any identity is allowed, the trailing * of the allowed identity matches any suffix,
+// e.g. spiffe://example.org/ns/billing/*
+func matchIdentity(allowed, identities []string) bool {
+	for i := 0; i < len(allowed); i++ {
+		for j := 0; j < len(identities); j++ {
+			if strings.HasSuffix(allowed[i], "*") {
+				if strings.HasPrefix(identities[j], strings.TrimSuffix(allowed[i], "*")) {
+					return true
+				}
+
+				continue
+			}
+
+			if allowed[i] == identities[j] {
+				return true
+			}
+		}
+	}
+
+	return false
+}
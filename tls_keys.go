@@ -0,0 +1,89 @@
+package grpc
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"os"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/youmark/pkcs8"
+)
+
+const (
+	encryptedPKCS8Block string = "ENCRYPTED PRIVATE KEY"
+	pkcs8Block          string = "PRIVATE KEY"
+)
+
+// loadKeyPair reads the cert and the key files, the key is decrypted with the password if provided
+func loadKeyPair(certFile, keyFile, password string) (tls.Certificate, error) {
+	cert, err := os.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	key, err := os.ReadFile(keyFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	return keyPair(cert, key, password)
+}
+
+// keyPair parses the PEM encoded cert and key, the key is decrypted with the password if provided.
+// Both PKCS#8 (ENCRYPTED PRIVATE KEY) and legacy PKCS#1 (Proc-Type: 4,ENCRYPTED) encrypted keys are supported.
+func keyPair(cert, key []byte, password string) (tls.Certificate, error) {
+	if password == "" {
+		return tls.X509KeyPair(cert, key)
+	}
+
+	block, _ := pem.Decode(key)
+	if block == nil {
+		return tls.Certificate{}, errors.Str("failed to decode the key PEM block")
+	}
+
+	switch {
+	case block.Type == encryptedPKCS8Block:
+		pk, err := pkcs8.ParsePKCS8PrivateKey(block.Bytes, []byte(password))
+		if err != nil {
+			return tls.Certificate{}, errors.Errorf("failed to decrypt the PKCS#8 key, wrong key password or unsupported encryption: %v", err)
+		}
+
+		der, err := x509.MarshalPKCS8PrivateKey(pk)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+
+		key = pem.EncodeToMemory(&pem.Block{Type: pkcs8Block, Bytes: der})
+	case x509.IsEncryptedPEMBlock(block): //nolint:staticcheck
+		// legacy encryption, deprecated because it is insecure by design, but still widely used
+		der, err := x509.DecryptPEMBlock(block, []byte(password)) //nolint:staticcheck
+		// the padding is valid for about 1/256 of the wrong passwords, the decrypted garbage is not a key then
+		if err == nil && !isPrivateKey(der) {
+			err = x509.IncorrectPasswordError
+		}
+		if err != nil {
+			return tls.Certificate{}, errors.Errorf("failed to decrypt the PKCS#1 key, wrong key password: %v", err)
+		}
+
+		key = pem.EncodeToMemory(&pem.Block{Type: block.Type, Bytes: der})
+	default:
+		return tls.Certificate{}, errors.Errorf("key password is provided, but the key (%s) is not encrypted", block.Type)
+	}
+
+	return tls.X509KeyPair(cert, key)
+}
+
+// isPrivateKey reports whether the DER is a PKCS#1, SEC 1 (EC) or PKCS#8 private key
+func isPrivateKey(der []byte) bool {
+	if _, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return true
+	}
+
+	if _, err := x509.ParseECPrivateKey(der); err == nil {
+		return true
+	}
+
+	_, err := x509.ParsePKCS8PrivateKey(der)
+	return err == nil
+}
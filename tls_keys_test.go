@@ -0,0 +1,120 @@
+package grpc
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/youmark/pkcs8"
+)
+
+// testKeyPair returns the PEM encoded self-signed certificate and its key
+func testKeyPair(t *testing.T) ([]byte, *rsa.PrivateKey) {
+	t.Helper()
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), key
+}
+
+func TestKeyPair(t *testing.T) {
+	cert, key := testKeyPair(t)
+
+	pkcs8Plain, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(t, err)
+
+	pkcs8Encrypted, err := pkcs8.MarshalPrivateKey(key, []byte("secret"), nil)
+	require.NoError(t, err)
+
+	pkcs1Encrypted, err := x509.EncryptPEMBlock(rand.Reader, "RSA PRIVATE KEY", x509.MarshalPKCS1PrivateKey(key), []byte("secret"), x509.PEMCipherAES256) //nolint:staticcheck
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		key      []byte
+		password string
+		err      string
+	}{
+		{
+			name: "unencrypted pkcs8",
+			key:  pem.EncodeToMemory(&pem.Block{Type: pkcs8Block, Bytes: pkcs8Plain}),
+		},
+		{
+			name: "unencrypted pkcs1",
+			key:  pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}),
+		},
+		{
+			name:     "encrypted pkcs8",
+			key:      pem.EncodeToMemory(&pem.Block{Type: encryptedPKCS8Block, Bytes: pkcs8Encrypted}),
+			password: "secret",
+		},
+		{
+			name:     "encrypted pkcs1",
+			key:      pem.EncodeToMemory(pkcs1Encrypted),
+			password: "secret",
+		},
+		{
+			name:     "wrong pkcs8 password",
+			key:      pem.EncodeToMemory(&pem.Block{Type: encryptedPKCS8Block, Bytes: pkcs8Encrypted}),
+			password: "wrong",
+			err:      "failed to decrypt the PKCS#8 key, wrong key password",
+		},
+		{
+			name:     "wrong pkcs1 password",
+			key:      pem.EncodeToMemory(pkcs1Encrypted),
+			password: "wrong",
+			err:      "failed to decrypt the PKCS#1 key, wrong key password",
+		},
+		{
+			name:     "password for unencrypted key",
+			key:      pem.EncodeToMemory(&pem.Block{Type: pkcs8Block, Bytes: pkcs8Plain}),
+			password: "secret",
+			err:      "key password is provided, but the key (PRIVATE KEY) is not encrypted",
+		},
+		{
+			name:     "not pem",
+			key:      []byte("not a key"),
+			password: "secret",
+			err:      "failed to decode the key PEM block",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			kp, err := keyPair(cert, tt.key, tt.password)
+			if tt.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Equal(t, key.Public(), kp.PrivateKey.(*rsa.PrivateKey).Public())
+		})
+	}
+
+	// the padding of the legacy encryption is valid for some of the wrong passwords
+	for i := 0; i < 1024; i++ {
+		_, err = keyPair(cert, pem.EncodeToMemory(pkcs1Encrypted), "wrong"+strconv.Itoa(i))
+		require.Error(t, err)
+		require.Contains(t, err.Error(), "failed to decrypt the PKCS#1 key, wrong key password")
+	}
+}
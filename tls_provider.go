@@ -0,0 +1,116 @@
+package grpc
+
+import (
+	"crypto/tls"
+	"sync/atomic"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// CertProvider provides the server certificate, e.g. fetched from Vault or the cloud secrets manager instead of the
+// files. The certificate is requested on start and on every refresh signal, the handshakes use the last provided one.
+type CertProvider interface {
+	// GetCertificate returns the current server certificate
+	GetCertificate() (*tls.Certificate, error)
+	// Refresh signals that the certificate was rotated, nil if the certificate is never rotated
+	Refresh() <-chan struct{}
+}
+
+// RegisterCertProvider registers the provider of the server certificate used instead of the cert and key files,
+// the tls.external_cert option should be enabled. The provider should be registered before the plugin starts serving.
+func (p *Plugin) RegisterCertProvider(provider CertProvider) {
+	p.certProvider = provider
+}
+
+// fileCertProvider is the default provider loading the cert and the key files once
+type fileCertProvider struct {
+	cert     string
+	key      string
+	password string
+}
+
+func (f *fileCertProvider) GetCertificate() (*tls.Certificate, error) {
+	cert, err := loadKeyPair(f.cert, f.key, f.password)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cert, nil
+}
+
+func (f *fileCertProvider) Refresh() <-chan struct{} {
+	return nil
+}
+
+// certSource keeps the last certificate of the provider and requests the new one on the refresh signal, the previous
+// certificate is kept when the provider fails
+type certSource struct {
+	provider CertProvider
+	current  atomic.Pointer[tls.Certificate]
+	log      *zap.Logger
+	stopCh   chan struct{}
+}
+
+func newCertSource(provider CertProvider, log *zap.Logger) (*certSource, error) {
+	cert, err := provider.GetCertificate()
+	if err != nil {
+		return nil, err
+	}
+
+	if cert == nil {
+		return nil, errors.Str("certificate provider returned no certificate")
+	}
+
+	s := &certSource{
+		provider: provider,
+		log:      log,
+		stopCh:   make(chan struct{}),
+	}
+	s.current.Store(cert)
+
+	return s, nil
+}
+
+// getCertificate is the tls.Config GetCertificate callback
+func (s *certSource) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	return s.current.Load(), nil
+}
+
+// start refreshes the certificate on the provider's signals until stop is called
+func (s *certSource) start() {
+	refresh := s.provider.Refresh()
+	if refresh == nil {
+		return
+	}
+
+	go func() {
+		for {
+			select {
+			case _, ok := <-refresh:
+				if !ok {
+					return
+				}
+
+				s.refresh()
+			case <-s.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (s *certSource) stop() {
+	close(s.stopCh)
+}
+
+func (s *certSource) refresh() {
+	cert, err := s.provider.GetCertificate()
+	if err != nil || cert == nil {
+		s.log.Error("failed to refresh the tls certificate, the previous one is used", zap.Error(err))
+		return
+	}
+
+	s.current.Store(cert)
+	s.log.Info("tls certificate was refreshed")
+}
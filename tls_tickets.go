@@ -0,0 +1,160 @@
+package grpc
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roadrunner-server/errors"
+	"go.uber.org/zap"
+)
+
+// session ticket key length required by the crypto/tls
+const ticketKeyLen int = 32
+
+// ticketKeys keeps the session ticket keys of the server TLS config in sync with the keys file shared by the instances.
+// The keys file contains one hex or base64 encoded 32 bytes key per line, the first key is used to encrypt new tickets,
+// the rest are used only to decrypt the tickets issued before the rotation.
+type ticketKeys struct {
+	mu   sync.Mutex
+	file string
+	keys [][ticketKeyLen]byte
+	// config used for the handshakes of the current server
+	config *tls.Config
+	log    *zap.Logger
+	stopCh chan struct{}
+}
+
+func newTicketKeys(file string, log *zap.Logger) (*ticketKeys, error) {
+	keys, err := readTicketKeys(file)
+	if err != nil {
+		return nil, err
+	}
+
+	return &ticketKeys{
+		file:   file,
+		keys:   keys,
+		log:    log,
+		stopCh: make(chan struct{}),
+	}, nil
+}
+
+// wrap returns the config to pass to the transport credentials. Credentials clone the provided config, so the keys set
+// later would be lost: the handshakes are made with the provided config returned from the GetConfigForClient instead.
+func (t *ticketKeys) wrap(cfg *tls.Config) *tls.Config {
+	// credentials add h2 only to the clone
+	cfg.NextProtos = append(cfg.NextProtos, "h2")
+
+	t.mu.Lock()
+	cfg.SetSessionTicketKeys(t.keys)
+	t.config = cfg
+	t.mu.Unlock()
+
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return cfg, nil
+		},
+	}
+}
+
+// start re-reads the keys file every interval until stop is called
+func (t *ticketKeys) start(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				t.reload()
+			case <-t.stopCh:
+				return
+			}
+		}
+	}()
+}
+
+func (t *ticketKeys) stop() {
+	close(t.stopCh)
+}
+
+func (t *ticketKeys) reload() {
+	keys, err := readTicketKeys(t.file)
+	if err != nil {
+		// previous keys are kept
+		t.log.Error("failed to reload tls session ticket keys", zap.String("file", t.file), zap.Error(err))
+		return
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if equalTicketKeys(t.keys, keys) {
+		return
+	}
+
+	t.keys = keys
+	if t.config != nil {
+		t.config.SetSessionTicketKeys(keys)
+	}
+
+	t.log.Info("tls session ticket keys were rotated", zap.String("file", t.file), zap.Int("keys", len(keys)))
+}
+
+func readTicketKeys(file string) ([][ticketKeyLen]byte, error) {
+	const op = errors.Op("grpc_plugin_read_ticket_keys")
+
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, errors.E(op, err)
+	}
+
+	var keys [][ticketKeyLen]byte
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for line := 1; scanner.Scan(); line++ {
+		str := strings.TrimSpace(scanner.Text())
+		if str == "" || strings.HasPrefix(str, "#") {
+			continue
+		}
+
+		key, errD := hex.DecodeString(str)
+		if errD != nil {
+			key, errD = base64.StdEncoding.DecodeString(str)
+		}
+
+		if errD != nil || len(key) != ticketKeyLen {
+			return nil, errors.E(op, errors.Errorf("line %d of '%s': session ticket key should be hex or base64 encoded %d bytes", line, file, ticketKeyLen))
+		}
+
+		var k [ticketKeyLen]byte
+		copy(k[:], key)
+		keys = append(keys, k)
+	}
+
+	if len(keys) == 0 {
+		return nil, errors.E(op, errors.Errorf("no session ticket keys found in '%s'", file))
+	}
+
+	return keys, nil
+}
+
+func equalTicketKeys(a, b [][ticketKeyLen]byte) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := 0; i < len(a); i++ {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,130 @@
+package grpc
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+)
+
+func TestReadTicketKeys(t *testing.T) {
+	key1 := bytes.Repeat([]byte{1}, ticketKeyLen)
+	key2 := bytes.Repeat([]byte{2}, ticketKeyLen)
+
+	tests := []struct {
+		name    string
+		content string
+		keys    [][]byte
+		err     string
+	}{
+		{name: "hex", content: hex.EncodeToString(key1) + "\n", keys: [][]byte{key1}},
+		{name: "base64", content: base64.StdEncoding.EncodeToString(key1), keys: [][]byte{key1}},
+		{
+			name:    "rotated keys with comments",
+			content: "# current key first\n" + hex.EncodeToString(key2) + "\n\n  " + base64.StdEncoding.EncodeToString(key1) + "  \n",
+			keys:    [][]byte{key2, key1},
+		},
+		{name: "short key", content: hex.EncodeToString(key1[:16]), err: "line 1 of"},
+		{name: "invalid key", content: hex.EncodeToString(key1) + "\nnot a key\n", err: "line 2 of"},
+		{name: "empty file", content: "# no keys\n", err: "no session ticket keys found"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			file := filepath.Join(t.TempDir(), "keys")
+			require.NoError(t, os.WriteFile(file, []byte(tt.content), 0o600))
+
+			keys, err := readTicketKeys(file)
+			if tt.err != "" {
+				require.Error(t, err)
+				require.Contains(t, err.Error(), tt.err)
+				return
+			}
+
+			require.NoError(t, err)
+			require.Len(t, keys, len(tt.keys))
+			for i := 0; i < len(keys); i++ {
+				require.Equal(t, tt.keys[i], keys[i][:])
+			}
+		})
+	}
+
+	_, err := readTicketKeys(filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+}
+
+// resumed makes the TLS 1.2 handshake with the server config and reports whether the session was resumed
+func resumed(t *testing.T, server *tls.Config, cache tls.ClientSessionCache) bool {
+	t.Helper()
+
+	c, s := net.Pipe()
+	defer func() {
+		_ = c.Close()
+	}()
+
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- tls.Server(s, server).Handshake()
+		_ = s.Close()
+	}()
+
+	client := tls.Client(c, &tls.Config{
+		InsecureSkipVerify: true, //nolint:gosec
+		ClientSessionCache: cache,
+		MaxVersion:         tls.VersionTLS12,
+	})
+	require.NoError(t, client.Handshake())
+	require.NoError(t, <-errCh)
+
+	return client.ConnectionState().DidResume
+}
+
+func TestTicketKeysReload(t *testing.T) {
+	certPEM, key := testKeyPair(t)
+	cert, err := tls.X509KeyPair(certPEM, pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(key)}))
+	require.NoError(t, err)
+
+	key1 := hex.EncodeToString(bytes.Repeat([]byte{1}, ticketKeyLen))
+	key2 := hex.EncodeToString(bytes.Repeat([]byte{2}, ticketKeyLen))
+	key3 := hex.EncodeToString(bytes.Repeat([]byte{3}, ticketKeyLen))
+
+	file := filepath.Join(t.TempDir(), "keys")
+	require.NoError(t, os.WriteFile(file, []byte(key1), 0o600))
+
+	tk, err := newTicketKeys(file, zap.NewNop())
+	require.NoError(t, err)
+
+	server := tk.wrap(&tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}})
+	cache := tls.NewLRUClientSessionCache(1)
+
+	require.False(t, resumed(t, server, cache))
+	require.True(t, resumed(t, server, cache))
+
+	// the tickets of the previous key are still accepted after the rotation
+	require.NoError(t, os.WriteFile(file, []byte(key2+"\n"+key1), 0o600))
+	tk.reload()
+	require.Len(t, tk.keys, 2)
+	require.True(t, resumed(t, server, cache))
+
+	// the tickets of the removed keys are not accepted
+	require.NoError(t, os.WriteFile(file, []byte(key3), 0o600))
+	tk.reload()
+	require.Len(t, tk.keys, 1)
+	require.False(t, resumed(t, server, cache))
+	require.True(t, resumed(t, server, cache))
+
+	// the previous keys are kept when the file is broken
+	require.NoError(t, os.WriteFile(file, []byte("broken"), 0o600))
+	tk.reload()
+	require.Len(t, tk.keys, 1)
+	require.True(t, resumed(t, server, cache))
+}
@@ -0,0 +1,99 @@
+package grpc
+
+import (
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/roadrunner-server/errors"
+	"github.com/roadrunner-server/grpc/v3/parser"
+	"github.com/roadrunner-server/grpc/v3/proxy"
+	"google.golang.org/grpc"
+)
+
+// Validate checks the configuration of the initialized plugin without serving: the TLS files are loaded, the proto
+// files are compiled and the services are built the same way as on Serve, but the port is not bound and the workers
+// are not started. All problems are reported at once, it is intended for CI checks before the deploy.
+func (p *Plugin) Validate() error {
+	const op = errors.Op("grpc_plugin_validate")
+
+	if p.config == nil {
+		return errors.E(op, errors.Str("plugin is not initialized"))
+	}
+
+	var problems []string
+
+	if p.config.EnableTLS() {
+		err := p.config.TLS.validate()
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	err := p.checkProtos()
+	if err != nil {
+		problems = append(problems, err.Error())
+	}
+
+	// the services are registered on the server which is never served, it exits on the duplicated registration
+	server := grpc.NewServer()
+	defer server.Stop()
+	services := make(map[string]string)
+	for i := 0; i < len(p.config.Proto); i++ {
+		if p.config.Proto[i] == "" {
+			continue
+		}
+
+		problems = append(problems, p.validateProto(server, p.config.Proto[i], services)...)
+	}
+
+	// the masked fields and the JSON responses are resolved from the compiled protos, skipped when they can't be compiled
+	if err == nil {
+		_, err = p.requestTransforms()
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+
+		_, err = p.jsonResponseTypes()
+		if err != nil {
+			problems = append(problems, err.Error())
+		}
+	}
+
+	if len(problems) > 0 {
+		return errors.E(op, errors.Errorf("invalid configuration: %s", strings.Join(problems, "; ")))
+	}
+
+	return nil
+}
+
+// validateProto parses the proto file and registers its services on the server
+func (p *Plugin) validateProto(server *grpc.Server, file string, services map[string]string) []string {
+	parsed, err := parser.File(file, path.Dir(file))
+	if err != nil {
+		return []string{err.Error()}
+	}
+
+	if len(parsed) == 0 && p.config.FailOnEmptyProto {
+		return []string{fmt.Sprintf("proto file '%s' does not declare any service", file)}
+	}
+
+	var problems []string
+	for _, service := range parsed {
+		name := fmt.Sprintf("%s.%s", service.Package, service.Name)
+		if prev, ok := services[name]; ok {
+			problems = append(problems, fmt.Sprintf("service %s is declared in '%s' and '%s'", name, prev, file))
+			continue
+		}
+		services[name] = file
+
+		px := proxy.NewProxy(name, p.config.ServiceMetadata(name, file), nil, p.mu, nil)
+		for _, m := range service.Methods {
+			px.RegisterMethod(m.Name)
+		}
+
+		server.RegisterService(px.ServiceDesc(), px)
+	}
+
+	return problems
+}